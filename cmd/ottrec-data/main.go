@@ -2,14 +2,18 @@
 package main
 
 import (
+	"bufio"
 	"cmp"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"iter"
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
+	"text/tabwriter"
 	"time"
 	_ "time/tzdata"
 
@@ -18,25 +22,44 @@ import (
 	"github.com/pgaskin/ottrec-website/internal/gitsh"
 	"github.com/pgaskin/ottrec-website/internal/pflagx"
 	"github.com/pgaskin/ottrec-website/pkg/ottrecdata"
+	"github.com/pgaskin/ottrec-website/pkg/ottrecexp"
+	"github.com/pgaskin/ottrec-website/pkg/ottrecidx"
 	"github.com/pgaskin/ottrec-website/routes"
+	"github.com/pgaskin/ottrec-website/static"
 	"github.com/spf13/pflag"
 )
 
 // note: if the repo gets force-pushed over, old data won't be automatically cleaned up (TODO: maybe we should drop all rows, re-insert, and vacuum?)
 
 var (
-	EnvPrefix    = "OTTREC_DATA_"
-	Addr         = pflag.StringP("addr", "a", ":8082", "listen address")
-	Host         = pflag.StringP("host", "H", "data.ottrec.localhost", "canonical url host")
-	Cache        = pflag.StringP("cache", "c", "/tmp/ottrec-data.db", "cache database path (will be wiped and recreated if doesn't exist or outdated)")
-	Repo         = pflag.StringP("repo", "r", "/tmp/ottrec-data.git", "data git repo path (if not set, db will be treated as read-only) (will be initialized as a bare repo if empty)")
-	RepoRemote   = pflag.String("repo-remote", "https://github.com/pgaskin/ottrec-data.git", "remote to fetch")
-	RepoBranch   = pflag.String("repo-branch", "v1", "branch to fetch (will be overwriten in the local repo)")
-	RepoRev      = pflag.String("repo-rev", "", "override the rev to scan (for debugging only)")
-	RepoInterval = pflag.DurationP("repo-interval", "i", time.Minute*15, "poll interval for repo (0 to only pull once at startup)")
-	LogLevel     = pflagx.LevelP("log-level", "L", slog.LevelInfo, "log level")
-	LogJSON      = pflag.Bool("log-json", false, "use json logs")
-	Help         = pflag.BoolP("help", "h", false, "show this help text")
+	EnvPrefix        = "OTTREC_DATA_"
+	Addr             = pflag.StringP("addr", "a", ":8082", "listen address")
+	Host             = pflag.StringP("host", "H", "data.ottrec.localhost", "canonical url host")
+	Cache            = pflag.StringP("cache", "c", "/tmp/ottrec-data.db", "cache database path (will be wiped and recreated if doesn't exist or outdated and cannot be migrated)")
+	Repo             = pflag.StringP("repo", "r", "/tmp/ottrec-data.git", "data git repo path (if not set, db will be treated as read-only) (will be initialized as a bare repo if empty)")
+	RepoRemote       = pflag.String("repo-remote", "https://github.com/pgaskin/ottrec-data.git", "remote to fetch")
+	RepoBranch       = pflag.String("repo-branch", "v1", "branch to fetch (will be overwriten in the local repo)")
+	RepoExtra        = pflag.StringSlice("repo-extra-branches", nil, "additional branches to fetch and serve separately under /v1-NAME/ and /export-NAME/ (as NAME=BRANCH, or just BRANCH to use it as the name)")
+	RepoRev          = pflag.String("repo-rev", "", "override the rev to scan (for debugging only)")
+	RepoInterval     = pflag.DurationP("repo-interval", "i", time.Minute*15, "poll interval for repo (0 to only pull once at startup)")
+	ImportStrict     = pflag.Bool("import-strict", false, "skip commits which fail additional data validation checks instead of only logging a warning")
+	ImportContinue   = pflag.Bool("import-continue-on-error", false, "log and skip commits which fail to import instead of stopping")
+	ImportDryRun     = pflag.Bool("import-dry-run", false, "parse and validate new commits without writing them to the cache")
+	ImportGzip       = pflag.Int("import-gzip", 9, "gzip compression level for imported data (lower is faster but larger)")
+	DataFormats      = pflag.StringSlice("data-formats", ottrecdata.DefaultFormats, "data files (data.FORMAT) to import (suffix with ? to make it optional) (pb is always required)")
+	MaintainInterval = pflag.Duration("maintain-interval", time.Hour*24, "minimum interval between cache maintenance after updates (0 to disable)")
+	Validate         = pflag.Bool("validate", false, "enable the POST /v1/validate endpoint for checking a data.pb without importing it (do not enable in production)")
+	MaxExportSize    = pflag.Int64("max-export-size", 256<<20, "maximum uncompressed size of each export, which will fail instead of being served if exceeded (0 for no limit)")
+	StaticEnc        = pflag.StringSlice("static-encodings", static.DefaultEncodings, "content encodings to offer for static assets (br, deflate, gzip, zstd)")
+	StaticLazy       = pflag.Bool("static-lazy", false, "compress static assets on first request instead of at startup")
+	StaticCache      = pflag.Int("static-lazy-cache-size", static.DefaultLazyCacheSize, "maximum number of lazily compressed static assets to keep in memory")
+	TZ               = pflag.String("tz", "America/Toronto", "time zone for schedule dates and times")
+	Export           = pflag.Bool("export", false, "write the data for the spec and format arguments to stdout and exit instead of running the server (formats: pb, textpb, textpb-pretty, proto, json, export.json, export.csv.zip)")
+	Stats            = pflag.Bool("stats", false, "print cache statistics and exit instead of running the server")
+	Verify           = pflag.Bool("verify", false, "check the hash and size of every blob in the cache and exit instead of running the server")
+	LogLevel         = pflagx.LevelP("log-level", "L", slog.LevelInfo, "log level")
+	LogJSON          = pflag.Bool("log-json", false, "use json logs")
+	Help             = pflag.BoolP("help", "h", false, "show this help text")
 )
 
 // TODO: http logs, request id
@@ -50,8 +73,12 @@ func main() {
 	pflagx.ParseEnv(EnvPrefix)
 	pflag.Parse()
 
-	if *Help || pflag.NArg() != 0 {
-		fmt.Printf("usage: %s [options]\n%s", os.Args[0], pflag.CommandLine.FlagUsages())
+	nargs := 0
+	if *Export {
+		nargs = 2
+	}
+	if *Help || pflag.NArg() != nargs {
+		fmt.Printf("usage: %s [options]\n       %s [options] --export spec format\n       %s [options] --stats\n       %s [options] --verify\n%s", os.Args[0], os.Args[0], os.Args[0], os.Args[0], pflag.CommandLine.FlagUsages())
 		if *Help {
 			return
 		}
@@ -63,17 +90,58 @@ func main() {
 		os.Exit(2)
 	}
 
+	if *Export && *Stats || *Export && *Verify || *Stats && *Verify {
+		fmt.Fprintf(os.Stderr, "error: --export, --stats, and --verify are mutually exclusive\n")
+		os.Exit(2)
+	}
+
+	if tz, err := time.LoadLocation(*TZ); err != nil {
+		fmt.Fprintf(os.Stderr, "error: invalid time zone %q: %v\n", *TZ, err)
+		os.Exit(2)
+	} else {
+		ottrecidx.TZ = tz
+		ottrecdata.TZ = tz
+	}
+
+	logOut := os.Stdout
+	if *Export || *Stats {
+		logOut = os.Stderr // stdout is for the output
+	}
 	if *LogJSON {
-		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		slog.SetDefault(slog.New(slog.NewJSONHandler(logOut, &slog.HandlerOptions{
 			Level: LogLevel,
 		})))
 	} else {
-		slog.SetDefault(slog.New(tint.NewHandler(os.Stdout, &tint.Options{
+		slog.SetDefault(slog.New(tint.NewHandler(logOut, &tint.Options{
 			Level: LogLevel,
 		})))
 	}
 	slog.SetLogLoggerLevel(LogLevel.Level())
 
+	if *Export {
+		if err := export(context.Background(), os.Stdout, pflag.Arg(0), pflag.Arg(1)); err != nil {
+			slog.Error("failed to export data", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *Stats {
+		if err := stats(context.Background(), os.Stdout); err != nil {
+			slog.Error("failed to get cache stats", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *Verify {
+		if err := verify(context.Background()); err != nil {
+			slog.Error("failed to verify cache", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := run(); err != nil {
 		slog.Error("failed to run server", "error", err)
 		os.Exit(1)
@@ -81,6 +149,21 @@ func main() {
 }
 
 func run() error {
+	extra := map[string]string{} // [name]branch
+	for _, v := range *RepoExtra {
+		name, branch, ok := strings.Cut(v, "=")
+		if !ok {
+			branch = name
+		}
+		if name == "" || branch == "" {
+			return fmt.Errorf("invalid extra branch %q", v)
+		}
+		if _, ok := extra[name]; ok {
+			return fmt.Errorf("duplicate extra branch name %q", name)
+		}
+		extra[name] = branch
+	}
+
 	var readonly bool
 	if *Repo != "" {
 		if *RepoBranch == "" {
@@ -107,37 +190,61 @@ func run() error {
 		readonly = true
 	}
 
-	slog.Info("opening cache", "path", *Cache)
-	cache, err := ottrecdata.OpenCache(*Cache, false)
-	if !readonly && errors.Is(err, ottrecdata.ErrUnsupportedSchema) {
-		slog.Warn("unsupported cache schema version, resetting")
-		cache, err = ottrecdata.OpenCache(*Cache, true)
+	slog.Info("opening cache", "path", *Cache, "readonly", readonly)
+	var cache *ottrecdata.Cache
+	var err error
+	if readonly {
+		cache, err = ottrecdata.OpenCacheReadOnly(*Cache, false)
+	} else {
+		cache, err = ottrecdata.OpenCache(*Cache, false)
+		if errors.Is(err, ottrecdata.ErrUnsupportedSchema) {
+			slog.Warn("unsupported cache schema version, resetting")
+			cache, err = ottrecdata.OpenCache(*Cache, true)
+		}
 	}
 	if err != nil {
 		return fmt.Errorf("open cache: %w", err)
 	}
 	defer cache.Close()
 
+	cache.Strict = *ImportStrict
+	cache.ContinueOnError = *ImportContinue
+	cache.DryRun = *ImportDryRun
+	cache.GzipLevel = *ImportGzip
+	cache.Formats = *DataFormats
+
+	branches := map[string]*ottrecdata.Cache{}
+	for name := range extra {
+		branches[name] = cache.Branch(name)
+	}
+
 	if !readonly {
 		slog.Info("updater: starting repo fetcher", "interval", *RepoInterval)
 		go func() {
+			var maintained time.Time
 			ticker := time.Tick(*RepoInterval)
 			for {
 				if *RepoRemote != "" {
 					slog.Info("updater: fetching repo")
+					args := []string{
+						"fetch",
+						"--verbose",
+						"--no-write-fetch-head",
+						"--refmap", "+refs/heads/" + *RepoBranch + ":refs/heads/" + *RepoBranch + "", // +(force) (remote) (local)
+					}
+					for _, branch := range extra {
+						args = append(args, "--refmap", "+refs/heads/"+branch+":refs/heads/"+branch)
+					}
+					args = append(args, *RepoRemote, "refs/heads/"+*RepoBranch)
+					for _, branch := range extra {
+						args = append(args, "refs/heads/"+branch)
+					}
 					// TODO: fetch timeout
 					if err := gitsh.Exec(context.Background(), *Repo, func(lines iter.Seq[string]) {
 						for line := range lines {
 							slog.Info("updater: git fetch: " + line)
 						}
-					},
-						"fetch",
-						"--verbose",
-						"--no-write-fetch-head",
-						"--refmap", "+refs/heads/"+*RepoBranch+":refs/heads/"+*RepoBranch+"", // +(force) (remote) (local)
-						*RepoRemote,
-						"refs/heads/"+*RepoBranch,
-					); err != nil {
+					}, args...); err != nil {
 						slog.Error("updater: fetch failed", "error", err)
 					}
 				}
@@ -145,6 +252,19 @@ func run() error {
 				if err := cache.Import(context.Background(), slog.Default(), *Repo, cmp.Or(*RepoRev, *RepoBranch)); err != nil {
 					slog.Error("updater: cache update failed", "error", err)
 				}
+				for name, branch := range extra {
+					slog.Info("updater: updating cache branch", "name", name, "branch", branch)
+					if err := branches[name].Import(context.Background(), slog.Default(), *Repo, branch); err != nil {
+						slog.Error("updater: cache branch update failed", "name", name, "error", err)
+					}
+				}
+				if *MaintainInterval > 0 && time.Since(maintained) >= *MaintainInterval {
+					slog.Info("updater: maintaining cache")
+					if err := cache.Maintain(context.Background()); err != nil {
+						slog.Error("updater: cache maintenance failed", "error", err)
+					}
+					maintained = time.Now()
+				}
 				if ticker == nil {
 					slog.Warn("updater: repo polling disabled")
 					return
@@ -155,8 +275,16 @@ func run() error {
 	}
 
 	handler, err := routes.Data(routes.DataConfig{
-		Host:  *Host,
-		Cache: cache,
+		Host:          *Host,
+		Cache:         cache,
+		Validate:      *Validate,
+		Branches:      branches,
+		MaxExportSize: *MaxExportSize,
+		Static: static.Options{
+			Encodings:     *StaticEnc,
+			Lazy:          *StaticLazy,
+			LazyCacheSize: *StaticCache,
+		},
 	})
 	if err != nil {
 		return fmt.Errorf("initialize routes: %w", err)
@@ -165,3 +293,149 @@ func run() error {
 	slog.Info("http: listening", "addr", *Addr)
 	return http.ListenAndServe(*Addr, handler)
 }
+
+// export writes the data for spec in format to w.
+func export(ctx context.Context, w io.Writer, spec, format string) error {
+	var raw string
+	switch format {
+	case "pb", "textpb", "textpb-pretty", "proto", "json":
+		raw = format
+	case "export.json", "export.csv.zip":
+		raw = "pb"
+	default:
+		return fmt.Errorf("unsupported format %q", format)
+	}
+
+	cache, err := ottrecdata.OpenCacheReadOnly(*Cache, false)
+	if err != nil {
+		return fmt.Errorf("open cache: %w", err)
+	}
+	defer cache.Close()
+
+	id, _, ok, err := cache.ResolveVersion(ctx, spec)
+	if err != nil {
+		return fmt.Errorf("resolve %q: %w", spec, err)
+	}
+	if !ok {
+		return fmt.Errorf("invalid spec format %q", spec)
+	}
+	if id == "" {
+		return fmt.Errorf("no data found for %q", spec)
+	}
+	slog.Info("resolved data version", "spec", spec, "id", id)
+
+	var hash string
+	for h, f := range cache.DataFormats(ctx, id)(&err) {
+		if f == raw {
+			hash = h
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("resolve format: %w", err)
+	}
+	if hash == "" {
+		return fmt.Errorf("no %s for %q", raw, id)
+	}
+
+	var buf []byte
+	exists, err := cache.ReadBlob(ctx, hash, false, func(r io.Reader, size int64) error {
+		if raw == format {
+			_, err := io.Copy(w, r)
+			return err
+		}
+		buf = make([]byte, size)
+		_, err := io.ReadFull(r, buf)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("read %s: %w", raw, err)
+	}
+	if !exists {
+		return fmt.Errorf("read %s: missing blob", raw)
+	}
+	if raw == format {
+		return nil
+	}
+
+	idx, err := new(ottrecidx.Indexer).Load(buf)
+	if err != nil {
+		return fmt.Errorf("load data: %w", err)
+	}
+	exp, err := ottrecexp.New(idx.Data())
+	if err != nil {
+		return fmt.Errorf("export data: %w", err)
+	}
+
+	bw := bufio.NewWriter(w)
+	switch format {
+	case "export.json":
+		err = ottrecexp.WriteJSON(exp, bw)
+	case "export.csv.zip":
+		err = ottrecexp.WriteCSVZip(exp, bw, ottrecexp.CSVOptions{ValidUTF8: true})
+	default:
+		panic("wtf")
+	}
+	if err != nil {
+		return fmt.Errorf("write %s: %w", format, err)
+	}
+	return bw.Flush()
+}
+
+// stats writes cache statistics to w.
+func stats(ctx context.Context, w io.Writer) error {
+	cache, err := ottrecdata.OpenCacheReadOnly(*Cache, false)
+	if err != nil {
+		return fmt.Errorf("open cache: %w", err)
+	}
+	defer cache.Close()
+
+	versions, oldest, newest, err := cache.DataVersionStats(ctx)
+	if err != nil {
+		return fmt.Errorf("get data version stats: %w", err)
+	}
+	blobs, blobRefs, blobMaxRefs, blobsStored, blobsLogical, err := cache.BlobStats(ctx)
+	if err != nil {
+		return fmt.Errorf("get blob stats: %w", err)
+	}
+	size, free, err := cache.Size(ctx)
+	if err != nil {
+		return fmt.Errorf("get size: %w", err)
+	}
+
+	date := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.In(ottrecdata.TZ).Format(time.RFC3339)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+	fmt.Fprintf(tw, "schema version:\t%d\n", ottrecdata.SchemaVersion)
+	fmt.Fprintf(tw, "database size:\t%d (%d free)\n", size, free)
+	fmt.Fprintf(tw, "versions:\t%d\n", versions)
+	fmt.Fprintf(tw, "oldest version:\t%s\n", date(oldest))
+	fmt.Fprintf(tw, "newest version:\t%s\n", date(newest))
+	fmt.Fprintf(tw, "blobs:\t%d\n", blobs)
+	fmt.Fprintf(tw, "blob refs:\t%d (max %d per blob)\n", blobRefs, blobMaxRefs)
+	fmt.Fprintf(tw, "blobs stored:\t%d\n", blobsStored)
+	fmt.Fprintf(tw, "blobs logical:\t%d\n", blobsLogical)
+	if blobsStored != 0 {
+		fmt.Fprintf(tw, "blobs ratio:\t%.1fx\n", float64(blobsLogical)/float64(blobsStored))
+	}
+	return tw.Flush()
+}
+
+func verify(ctx context.Context) error {
+	cache, err := ottrecdata.OpenCacheReadOnly(*Cache, false)
+	if err != nil {
+		return fmt.Errorf("open cache: %w", err)
+	}
+	defer cache.Close()
+
+	slog.Info("verifying cache blobs")
+	if err := cache.Verify(ctx); err != nil {
+		return err
+	}
+	slog.Info("all cache blobs are valid")
+	return nil
+}
@@ -18,6 +18,7 @@ import (
 	"github.com/pgaskin/ottrec-website/internal/pflagx"
 	"github.com/pgaskin/ottrec-website/pkg/ottrecidx"
 	"github.com/pgaskin/ottrec-website/routes"
+	"github.com/pgaskin/ottrec-website/static"
 	"github.com/spf13/pflag"
 )
 
@@ -27,6 +28,14 @@ var (
 	Host         = pflag.StringP("host", "H", "ottrec.localhost", "canonical url host")
 	Data         = pflag.StringP("data", "d", "http://data.ottrec.localhost:8082/v1/latest/pb", "url or path to data protobuf")
 	DataInterval = pflag.DurationP("data-interval", "i", time.Minute*15, "poll interval for data")
+	StaticEnc    = pflag.StringSlice("static-encodings", static.DefaultEncodings, "content encodings to offer for static assets (br, deflate, gzip, zstd)")
+	StaticLazy   = pflag.Bool("static-lazy", false, "compress static assets on first request instead of at startup")
+	StaticCache  = pflag.Int("static-lazy-cache-size", static.DefaultLazyCacheSize, "maximum number of lazily compressed static assets to keep in memory")
+	TZ           = pflag.String("tz", "America/Toronto", "time zone for schedule dates and times")
+	MaxAge       = pflag.Duration("max-age", 0, "how long pages can be cached without revalidation (0 to always revalidate)")
+	MaxAgeStale  = pflag.Duration("max-age-stale", 0, "how long stale pages can be served while revalidating in the background (only used if --max-age is set)")
+	EventsMax    = pflag.Int("events-max", 0, "maximum number of concurrent /events subscribers to notify of new data (0 to disable)")
+	Snapshot     = pflag.String("snapshot", "", "render the pages and static assets for the data to the specified directory and exit instead of running the server")
 	LogLevel     = pflagx.LevelP("log-level", "L", slog.LevelInfo, "log level")
 	LogJSON      = pflag.Bool("log-json", false, "use json logs")
 	Help         = pflag.BoolP("help", "h", false, "show this help text")
@@ -56,6 +65,13 @@ func main() {
 		os.Exit(2)
 	}
 
+	if tz, err := time.LoadLocation(*TZ); err != nil {
+		fmt.Fprintf(os.Stderr, "error: invalid time zone %q: %v\n", *TZ, err)
+		os.Exit(2)
+	} else {
+		ottrecidx.TZ = tz
+	}
+
 	if *LogJSON {
 		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 			Level: LogLevel,
@@ -74,7 +90,11 @@ func main() {
 }
 
 func run() error {
-	getData := func() func() (ottrecidx.DataRef, bool) {
+	if *Snapshot != "" {
+		return snapshot(context.Background(), *Snapshot)
+	}
+
+	getData, dataUpdated := func() (func() (ottrecidx.DataRef, bool), func() <-chan struct{}) {
 		var (
 			update     = time.Tick(*DataInterval)
 			backoffMin = time.Second
@@ -82,6 +102,7 @@ func run() error {
 			backoff    time.Duration
 			dbMu       sync.Mutex
 			dbPtr      *ottrecidx.Index
+			dbUpdate   chan struct{}
 		)
 		go func() {
 			for {
@@ -98,6 +119,12 @@ func run() error {
 
 					dbMu.Lock()
 					defer dbMu.Unlock()
+					if dbPtr == nil || dbPtr.Hash() != db.Hash() {
+						if dbUpdate != nil {
+							close(dbUpdate)
+							dbUpdate = nil
+						}
+					}
 					dbPtr = db
 
 					return nil
@@ -114,7 +141,7 @@ func run() error {
 				<-update
 			}
 		}()
-		return func() (ottrecidx.DataRef, bool) {
+		get := func() (ottrecidx.DataRef, bool) {
 			dbMu.Lock()
 			defer dbMu.Unlock()
 			if dbPtr == nil {
@@ -122,11 +149,32 @@ func run() error {
 			}
 			return dbPtr.Data(), true
 		}
+		updated := func() <-chan struct{} {
+			dbMu.Lock()
+			defer dbMu.Unlock()
+			if dbUpdate == nil {
+				dbUpdate = make(chan struct{})
+			}
+			return dbUpdate
+		}
+		return get, updated
 	}()
+	if *EventsMax <= 0 {
+		dataUpdated = nil
+	}
 
 	handler, err := routes.Website(routes.WebsiteConfig{
-		Host: *Host,
-		Data: getData,
+		Host:                 *Host,
+		Data:                 getData,
+		MaxAge:               *MaxAge,
+		StaleWhileRevalidate: *MaxAgeStale,
+		Updated:              dataUpdated,
+		MaxEventSubscribers:  *EventsMax,
+		Static: static.Options{
+			Encodings:     *StaticEnc,
+			Lazy:          *StaticLazy,
+			LazyCacheSize: *StaticCache,
+		},
 	})
 	if err != nil {
 		return fmt.Errorf("initialize routes: %w", err)
@@ -136,44 +184,76 @@ func run() error {
 	return http.ListenAndServe(*Addr, handler)
 }
 
+// snapshot renders the website for the data to dir.
+func snapshot(ctx context.Context, dir string) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*15)
+	defer cancel()
+
+	db, err := loadData(ctx, *Data)
+	if err != nil {
+		return err
+	}
+	if err := routes.WebsiteSnapshot(routes.WebsiteConfig{
+		Host: *Host,
+		Data: func() (ottrecidx.DataRef, bool) {
+			return db.Data(), true
+		},
+	}, dir); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	slog.Info("snapshot: wrote website", "dir", dir)
+	return nil
+}
+
 func loadData(ctx context.Context, uri string) (*ottrecidx.Index, error) {
-	var pb []byte
+	var (
+		r    io.ReadCloser
+		size int64
+	)
 	if strings.Contains(uri, "://") {
 		var err error
-		if pb, err = fetch(ctx, uri); err != nil {
+		if r, size, err = fetch(ctx, uri); err != nil {
 			return nil, fmt.Errorf("fetch %q: %w", uri, err)
 		}
 	} else {
-		var err error
-		if pb, err = os.ReadFile(uri); err != nil {
+		f, err := os.Open(uri)
+		if err != nil {
 			return nil, fmt.Errorf("read %q: %w", uri, err)
 		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("read %q: %w", uri, err)
+		}
+		r, size = f, fi.Size()
 	}
-	idx, err := new(ottrecidx.Indexer).Load(pb)
+	defer r.Close()
+
+	idx, err := new(ottrecidx.Indexer).LoadReader(r, size)
 	if err != nil {
 		return nil, fmt.Errorf("load %q: %w", uri, err)
 	}
 	return idx, nil
 }
 
-func fetch(ctx context.Context, uri string) ([]byte, error) {
+func fetch(ctx context.Context, uri string) (io.ReadCloser, int64, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	req.Header.Set("User-Agent", "ottrec")
 
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
 		if buf, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)); utf8.Valid(buf) {
-			return nil, fmt.Errorf("response status %d (body: %q)", resp.StatusCode, buf)
+			return nil, 0, fmt.Errorf("response status %d (body: %q)", resp.StatusCode, buf)
 		}
-		return nil, fmt.Errorf("response status %d", resp.StatusCode)
+		return nil, 0, fmt.Errorf("response status %d", resp.StatusCode)
 	}
-	return io.ReadAll(resp.Body)
+	return resp.Body, resp.ContentLength, nil
 }
@@ -9,6 +9,7 @@ tool (
 
 require (
 	github.com/a-h/templ v0.3.943
+	github.com/andybalholm/brotli v1.1.0
 	github.com/fastschema/qjs v0.0.4
 	github.com/kelindar/bitmap v1.5.3
 	github.com/klauspost/compress v1.18.0
@@ -18,12 +19,12 @@ require (
 	github.com/santhosh-tekuri/jsonschema/v6 v6.0.2
 	github.com/spf13/pflag v1.0.10
 	golang.org/x/net v0.44.0
+	golang.org/x/text v0.29.0
 	google.golang.org/protobuf v1.36.10
 )
 
 require (
 	github.com/a-h/parse v0.0.0-20250122154542-74294addb73e // indirect
-	github.com/andybalholm/brotli v1.1.0 // indirect
 	github.com/cenkalti/backoff/v4 v4.3.0 // indirect
 	github.com/cli/browser v1.3.0 // indirect
 	github.com/dlclark/regexp2 v1.11.4 // indirect
@@ -40,6 +41,5 @@ require (
 	golang.org/x/mod v0.27.0 // indirect
 	golang.org/x/sync v0.17.0 // indirect
 	golang.org/x/sys v0.36.0 // indirect
-	golang.org/x/text v0.29.0 // indirect
 	golang.org/x/tools v0.36.0 // indirect
 )
@@ -109,6 +109,13 @@ func init() {
 	slog.Info("postcss initialized")
 }
 
+// Noop returns true if DEBUG_POSTCSS_NOOP is set, in which case [Transform]
+// returns the css unchanged. This is only intended for faster iteration during
+// development since the css will not be minified or have fallbacks added.
+func Noop() bool {
+	return noop
+}
+
 func Transform(css, browsers string) (string, error) {
 	if noop {
 		return css, nil
@@ -6,6 +6,9 @@ import (
 )
 
 func TestPostCSS(t *testing.T) {
+	if Noop() {
+		t.Skip("DEBUG_POSTCSS_NOOP is set")
+	}
 	t.Run("Empty", func(t *testing.T) {
 		if res, err := Transform(``, "defaults"); err != nil {
 			t.Errorf("unexpected error: %v", err)
@@ -28,3 +31,19 @@ func TestPostCSS(t *testing.T) {
 		}
 	})
 }
+
+func TestPostCSSNoop(t *testing.T) {
+	defer func(v bool) { noop = v }(noop)
+	noop = true
+
+	if !Noop() {
+		t.Fatalf("expected noop to be reported")
+	}
+	for _, css := range []string{``, `{{{`, `html { body { color: rgb(0 0 100% / 90%) } }`} {
+		if res, err := Transform(css, "chrome 50"); err != nil {
+			t.Errorf("css %q: unexpected error: %v", css, err)
+		} else if res != css {
+			t.Errorf("css %q: expected it to be unchanged, got %q", css, res)
+		}
+	}
+}
@@ -4,6 +4,7 @@ package ottrecdata
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"crypto/sha1"
 	"database/sql"
@@ -14,26 +15,71 @@ import (
 	"io/fs"
 	"iter"
 	"log/slog"
+	"math"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/klauspost/compress/gzip"
 	"github.com/ncruces/go-sqlite3"
 	"github.com/ncruces/go-sqlite3/driver"
 	"github.com/pgaskin/ottrec-website/internal/gitsh"
 	"github.com/pgaskin/ottrec/schema"
+	"golang.org/x/text/runes"
+	"golang.org/x/text/transform"
+	"golang.org/x/text/unicode/norm"
+	"google.golang.org/protobuf/encoding/prototext"
 	"google.golang.org/protobuf/proto"
 )
 
 // Cache indexes and stores schedule data.
 type Cache struct {
-	db *sql.DB
+	db     *sql.DB
+	branch string
+
+	// Strict makes Import skip commits which fail additional data validation
+	// checks rather than just logging a warning.
+	Strict bool
+
+	// ContinueOnError makes Import log and skip commits which fail to import
+	// (e.g., due to a malformed data.pb) rather than stopping. Failed commits
+	// are recorded so they aren't retried by later imports.
+	ContinueOnError bool
+
+	// DryRun makes Import parse and validate each commit as usual, but roll
+	// back the transaction instead of committing it, so nothing is written.
+	// Since the commits aren't actually added, duplicates of commits earlier in
+	// the same run won't be detected, and revision numbers won't be
+	// incremented.
+	DryRun bool
+
+	// GzipLevel is the gzip compression level used for new blobs. If zero, the
+	// best compression level is used.
+	GzipLevel int
+
+	// Formats is the list of data files (data.FORMAT) to import. Formats
+	// suffixed with "?" are optional, and will be skipped if missing. The pb
+	// format is always required. If nil, [DefaultFormats] is used.
+	Formats []string
+
+	readOnly bool
+
+	updateMu sync.Mutex
+	update   chan struct{}
 }
 
+// DefaultFormats is the default value of [Cache.Formats]. Increment the
+// schema version if the default required formats change.
+var DefaultFormats = []string{"pb", "textpb", "proto", "json"}
+
 // SchemaVersion should be incremented if we change the schema, how import
-// works, or what gets imported.
-const SchemaVersion, schemaOptions, schemaDDL = 4, `
+// works, or what gets imported. If existing data can be updated in-place, add
+// an entry to schemaMigrations.
+const SchemaVersion, schemaOptions, schemaDDL = 11, `
 PRAGMA journal_mode=wal; -- so it's faster and writes/reads don't block each other
 PRAGMA busy_timeout=10000; -- avoid spurious database is locked errors
 PRAGMA cache_size = 4096; -- so we can fit more blobs in memory
@@ -44,30 +90,31 @@ PRAGMA foreign_keys = ON;
 PRAGMA encoding = 'UTF-8';
 
 CREATE TABLE commits ( -- commit metadata
+	branch TEXT NOT NULL, -- see Cache.Branch
 	hash TEXT NOT NULL, -- git commit hash
 	date REAL NOT NULL, -- unix fractional timestamp
-	PRIMARY KEY(hash)
+	PRIMARY KEY(branch, hash)
 ) STRICT, WITHOUT ROWID;
 
 CREATE TABLE data ( -- data metadata
+	branch TEXT NOT NULL, -- see Cache.Branch
 	id TEXT NOT NULL, -- opaque identifier, usually base32-encoded sha1
 	hash TEXT NOT NULL, -- git commit hash
 	updated REAL NOT NULL, -- unix fractional timestamp
 	revision INTEGER NOT NULL, -- positive integer
-	PRIMARY KEY(id),
-	FOREIGN KEY(hash) REFERENCES commits(hash),
-	UNIQUE(updated DESC, revision DESC),
-	UNIQUE(hash)
+	PRIMARY KEY(branch, id),
+	FOREIGN KEY(branch, hash) REFERENCES commits(branch, hash),
+	UNIQUE(branch, updated DESC, revision DESC),
+	UNIQUE(branch, hash)
 ) STRICT, WITHOUT ROWID;
 
-CREATE TABLE files ( -- data file
+CREATE TABLE files ( -- data file (shared between branches since the id is derived from the contents)
 	id TEXT NOT NULL,
 	format TEXT NOT NULL,
 	hash TEXT, -- base32-encoded sha1
 	PRIMARY KEY(id, format),
-	FOREIGN KEY(id) REFERENCES data(id),
 	FOREIGN KEY(hash) REFERENCES blobs(hash),
-	CHECK(format IN ('pb','textpb','proto','json'))
+	CHECK(format IN ('pb','textpb','textpb-pretty','proto','json'))
 ) STRICT, WITHOUT ROWID;
 
 CREATE TABLE blobs ( -- data file contents
@@ -76,8 +123,28 @@ CREATE TABLE blobs ( -- data file contents
 	data BLOB NOT NULL, -- gzipped data
 	PRIMARY KEY(hash)
 ) STRICT;
+
+CREATE TABLE facilities ( -- per-facility schedule hashes (shared between branches)
+	id TEXT NOT NULL, -- data id
+	url TEXT NOT NULL, -- facility source url
+	hash TEXT NOT NULL, -- base32-encoded sha1 of the facility schedule groups
+	PRIMARY KEY(id, url)
+) STRICT, WITHOUT ROWID;
+
+CREATE VIRTUAL TABLE search USING fts5( -- facility full-text search (shared between branches)
+	id UNINDEXED, -- data id
+	url UNINDEXED, -- facility source url
+	name, -- facility name
+	address, -- facility address
+	activities, -- newline-separated normalized activity names
+	tokenize = 'unicode61 remove_diacritics 2'
+);
+
+CREATE VIRTUAL TABLE search_vocab USING fts5vocab(search, row); -- search terms for fuzzy matching
 `
 
+// TZ is the time zone used to resolve date specs and format update times. It
+// defaults to America/Toronto, and may be changed before the cache is used.
 var TZ *time.Location
 
 func init() {
@@ -90,11 +157,11 @@ func init() {
 
 var ErrUnsupportedSchema = errors.New("unsupported schema version")
 
-// OpenCache opens a cache. If the schema version does not match, an error
-// matching [ErrUnsupportedSchema] is returned. If reset is true, the database
+// OpenCache opens a cache. If the schema version does not match and it cannot be
+// migrated, an error matching [ErrUnsupportedSchema] is returned. If reset is true, the database
 // is cleared.
 func OpenCache(name string, reset bool) (*Cache, error) {
-	db, err := driver.Open("file:"+escapeSqlitePath(name), sqliteRegisterGzip)
+	db, err := driver.Open("file:"+escapeSqlitePath(name), sqliteInit)
 	if err != nil {
 		return nil, err
 	}
@@ -106,11 +173,104 @@ func OpenCache(name string, reset bool) (*Cache, error) {
 	return idx, nil
 }
 
+// schemaMigrations contains functions to migrate the database from a schema
+// version to the next one. If there isn't a migration for every version between
+// the current one and [SchemaVersion], the database must be reset.
+var schemaMigrations = map[int]func(ctx context.Context, tx *sql.Tx) error{
+	10: func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, `CREATE VIRTUAL TABLE search_vocab USING fts5vocab(search, row)`)
+		return err
+	},
+}
+
+// migrate migrates the database from the specified schema version to the
+// current one, returning an error matching [ErrUnsupportedSchema] if it can't.
+func (db *Cache) migrate(from int) error {
+	if from > SchemaVersion {
+		return fmt.Errorf("%w: unsupported version %d (wanted %d)", ErrUnsupportedSchema, from, SchemaVersion)
+	}
+	for v := from; v < SchemaVersion; v++ {
+		if _, ok := schemaMigrations[v]; !ok {
+			return fmt.Errorf("%w: no migration from version %d (wanted %d)", ErrUnsupportedSchema, v, SchemaVersion)
+		}
+	}
+
+	ctx := context.Background()
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for v := from; v < SchemaVersion; v++ {
+		slog.Info("cache: migrating schema", "from", v, "to", v+1)
+		if err := schemaMigrations[v](ctx, tx); err != nil {
+			return fmt.Errorf("migrate schema from version %d: %w", v, err)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `PRAGMA user_version = `+strconv.Itoa(SchemaVersion)); err != nil {
+		return fmt.Errorf("update version: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ErrReadOnly is returned when attempting to modify a read-only cache.
+var ErrReadOnly = errors.New("cache is read-only")
+
+// OpenCacheReadOnly opens an existing cache without write access. The schema is
+// not created or migrated, and an error matching [ErrUnsupportedSchema] is
+// returned if the version does not match. If immutable is true, SQLite will
+// assume the file cannot be changed while it is open (i.e., no locking or
+// change detection), which is only safe if nothing else will write to it.
+func OpenCacheReadOnly(name string, immutable bool) (*Cache, error) {
+	uri := "file:" + escapeSqlitePath(name) + "?mode=ro"
+	if immutable {
+		uri += "&immutable=1"
+	}
+	db, err := driver.Open(uri, sqliteInit)
+	if err != nil {
+		return nil, err
+	}
+	idx := &Cache{db: db, readOnly: true}
+	var current int
+	if err := idx.db.QueryRow(`PRAGMA user_version`).Scan(&current); err != nil {
+		idx.db.Close()
+		return nil, fmt.Errorf("get version: %w", err)
+	}
+	if current != SchemaVersion {
+		idx.db.Close()
+		return nil, fmt.Errorf("%w: unsupported version %d (wanted %d)", ErrUnsupportedSchema, current, SchemaVersion)
+	}
+	if _, err := idx.db.Exec(`PRAGMA busy_timeout=10000`); err != nil {
+		idx.db.Close()
+		return nil, fmt.Errorf("set options: %w", err)
+	}
+	return idx, nil
+}
+
 // Close closes the cache.
 func (db *Cache) Close() error {
 	return db.db.Close()
 }
 
+// Branch returns a view of the cache containing a separate set of imported
+// data versions (e.g., for previewing data from a staging branch). The default
+// branch is the empty string. The options are copied from db. Files, blobs,
+// and the search index are shared. The returned cache must not be closed
+// separately.
+func (db *Cache) Branch(name string) *Cache {
+	return &Cache{
+		db:              db.db,
+		branch:          name,
+		Strict:          db.Strict,
+		ContinueOnError: db.ContinueOnError,
+		DryRun:          db.DryRun,
+		GzipLevel:       db.GzipLevel,
+		Formats:         db.Formats,
+		readOnly:        db.readOnly,
+	}
+}
+
 // initialize sets up the database.
 func (db *Cache) initialize(reset bool) error {
 	var current int
@@ -122,7 +282,9 @@ func (db *Cache) initialize(reset bool) error {
 			return nil
 		}
 		if current != 0 {
-			return fmt.Errorf("%w: unsupported version %d (wanted %d)", ErrUnsupportedSchema, current, SchemaVersion)
+			if err := db.migrate(current); err != nil {
+				return err
+			}
 		}
 	}
 	if current == 0 {
@@ -148,23 +310,46 @@ type DataVersion struct {
 	Committed time.Time
 	Updated   time.Time
 	Revision  int
+	Formats   []string // sorted
 }
 
 // DataVersions iterates over available versions, from most recently updated to
 // the lest recently updated.
 func (db *Cache) DataVersions(ctx context.Context) func(*error) iter.Seq[DataVersion] {
+	return db.dataVersions(ctx, `TRUE`)
+}
+
+// MonthlyVersions is like DataVersions, but only includes the most recently
+// updated version (and revision) for each calendar month in [TZ].
+func (db *Cache) MonthlyVersions(ctx context.Context) func(*error) iter.Seq[DataVersion] {
+	return db.dataVersions(ctx, `(data.updated, data.revision) IN (SELECT updated, max(revision) FROM data WHERE branch = ? AND updated IN (SELECT max(updated) FROM data WHERE branch = ? GROUP BY tzmonth(updated)) GROUP BY updated)`, db.branch, db.branch)
+}
+
+// DataVersionsBefore is like DataVersions, but starts after the version with the
+// specified id. If the id does not exist, nothing is returned.
+func (db *Cache) DataVersionsBefore(ctx context.Context, id string) func(*error) iter.Seq[DataVersion] {
+	return db.dataVersions(ctx, `(data.updated, data.revision) < (SELECT updated, revision FROM data WHERE branch = ? AND id = ?)`, db.branch, id)
+}
+
+func (db *Cache) dataVersions(ctx context.Context, where string, a ...any) func(*error) iter.Seq[DataVersion] {
 	return errSeq(func(yield func(DataVersion) bool) error {
-		rows, err := db.db.QueryContext(ctx, `SELECT data.id, commits.hash, commits.date, data.updated, data.revision FROM data LEFT JOIN commits ON commits.hash = data.hash ORDER BY data.updated DESC, data.revision DESC`)
+		rows, err := db.db.QueryContext(ctx, `SELECT data.id, commits.hash, commits.date, data.updated, data.revision, (SELECT group_concat(format, ',' ORDER BY format) FROM files WHERE files.id = data.id) FROM data LEFT JOIN commits ON commits.branch = data.branch AND commits.hash = data.hash WHERE data.branch = ? AND (`+where+`) ORDER BY data.updated DESC, data.revision DESC`, append([]any{db.branch}, a...)...)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
 
 		for rows.Next() {
-			var ver DataVersion
-			if err := rows.Scan(&ver.ID, &ver.Commit, sqlite3.TimeFormatUnixFrac.Scanner(&ver.Committed), sqlite3.TimeFormatUnixFrac.Scanner(&ver.Updated), &ver.Revision); err != nil {
+			var (
+				ver     DataVersion
+				formats sql.NullString
+			)
+			if err := rows.Scan(&ver.ID, &ver.Commit, sqlite3.TimeFormatUnixFrac.Scanner(&ver.Committed), sqlite3.TimeFormatUnixFrac.Scanner(&ver.Updated), &ver.Revision, &formats); err != nil {
 				return err
 			}
+			if formats.String != "" {
+				ver.Formats = strings.Split(formats.String, ",")
+			}
 			if !yield(ver) {
 				return nil
 			}
@@ -173,10 +358,28 @@ func (db *Cache) DataVersions(ctx context.Context) func(*error) iter.Seq[DataVer
 	})
 }
 
+// IsID checks whether s looks like a data version ID. IDs are normally the
+// base32-encoded sha1 of data.pb, but if another version already has the same
+// data.pb (i.e., only the other files changed), the ID is derived from all of
+// the files instead, and the first character is replaced with "9" (which isn't
+// in the base32 alphabet) to distinguish it. See [DeriveID].
 func IsID(s string) bool {
 	return len(s) == base32.StdEncoding.EncodedLen(sha1.Size)
 }
 
+// DeriveID returns the ID which would be assigned to a version with the
+// specified data.pb. If allFiles is not empty, it returns the fallback ID (used
+// when a version with the same data.pb already exists) derived from pb followed
+// by the contents of the other imported files in [Cache.Formats] order, and
+// true.
+func DeriveID(pb []byte, allFiles ...[]byte) (string, bool) {
+	if len(allFiles) == 0 {
+		return base32sha1(pb), false
+	}
+	id := base32sha1(append([][]byte{pb}, allFiles...)...)
+	return "9" + id[1:], true
+}
+
 // ResolveVersion resolves a version.
 func (db *Cache) ResolveVersion(ctx context.Context, spec string) (string, time.Time, bool, error) {
 	getOne := func(where string, a ...any) (string, time.Time, bool, error) {
@@ -184,7 +387,7 @@ func (db *Cache) ResolveVersion(ctx context.Context, spec string) (string, time.
 			id      string
 			updated time.Time
 		)
-		if err := db.db.QueryRowContext(ctx, `SELECT id, updated FROM data `+where, a...).Scan(&id, sqlite3.TimeFormatUnixFrac.Scanner(&updated)); err != nil {
+		if err := db.db.QueryRowContext(ctx, `SELECT id, updated FROM data WHERE branch = ? `+where, append([]any{db.branch}, a...)...).Scan(&id, sqlite3.TimeFormatUnixFrac.Scanner(&updated)); err != nil {
 			if errors.Is(err, sql.ErrNoRows) {
 				return "", time.Time{}, true, nil
 			}
@@ -193,7 +396,7 @@ func (db *Cache) ResolveVersion(ctx context.Context, spec string) (string, time.
 		return id, updated, true, nil
 	}
 	if IsID(spec) {
-		return getOne(`WHERE id = ?`, spec)
+		return getOne(`AND id = ?`, spec)
 	}
 	if offset, ok := strings.CutPrefix(spec, "latest"); ok {
 		if offset == "" {
@@ -231,16 +434,16 @@ func (db *Cache) ResolveVersion(ctx context.Context, spec string) (string, time.
 		}
 	}
 	if !upper.IsZero() {
-		return getOne(`WHERE updated < ? ORDER BY updated DESC, revision DESC LIMIT 1`, sqlite3.TimeFormatUnixFrac.Encode(upper))
+		return getOne(`AND updated < ? ORDER BY updated DESC, revision DESC LIMIT 1`, sqlite3.TimeFormatUnixFrac.Encode(upper))
 	}
 	return "", time.Time{}, false, nil
 }
 
 // DataFormats iterates over formats (hash, format) available for the specified
-// version ID.
+// version ID, ordered by format name.
 func (db *Cache) DataFormats(ctx context.Context, id string) func(*error) iter.Seq2[string, string] {
 	return errSeq2(func(yield func(string, string) bool) error {
-		rows, err := db.db.QueryContext(ctx, `SELECT hash, format FROM files WHERE id = ?`, id)
+		rows, err := db.db.QueryContext(ctx, `SELECT hash, format FROM files WHERE id = ? ORDER BY format`, id)
 		if err != nil {
 			return err
 		}
@@ -255,10 +458,174 @@ func (db *Cache) DataFormats(ctx context.Context, id string) func(*error) iter.S
 				return nil
 			}
 		}
-		return nil
+		return rows.Err()
+	})
+}
+
+type SearchHit struct {
+	URL     string
+	Name    string
+	Address string
+	Rank    float64 // lower is better
+}
+
+// SearchMode controls how search terms are matched. The zero value only
+// matches whole words.
+type SearchMode uint
+
+const (
+	SearchPrefix SearchMode = 1 << iota // also match words starting with each term
+	SearchFuzzy                         // also match words within an edit distance of one from each term
+)
+
+// searchFuzzyMinLength is the minimum number of characters in a word for it to
+// be fuzzy-matched.
+const searchFuzzyMinLength = 4
+
+// searchFuzzyMaxTerms is the maximum number of alternative words each word is
+// fuzzy-matched against, with the most common ones being chosen first.
+const searchFuzzyMaxTerms = 16
+
+// Search iterates over facilities in the specified version ID matching query,
+// from best to worst match. The query is split into whitespace-separated terms,
+// all of which must match the facility name, address, or activity names.
+// Matching is case-insensitive and ignores diacritics (e.g., "recreatif"
+// matches "Récréatif"), whether the text is precomposed or decomposed.
+func (db *Cache) Search(ctx context.Context, id, query string, mode SearchMode) func(*error) iter.Seq[SearchHit] {
+	return errSeq(func(yield func(SearchHit) bool) error {
+		var (
+			match strings.Builder
+			vocab []searchVocabTerm
+		)
+		quote := func(s string) {
+			match.WriteByte('"')
+			match.WriteString(strings.ReplaceAll(s, `"`, `""`))
+			match.WriteByte('"')
+			if mode&SearchPrefix != 0 {
+				match.WriteByte('*')
+			}
+		}
+		for term := range strings.FieldsSeq(query) {
+			if mode&SearchFuzzy == 0 {
+				if match.Len() != 0 {
+					match.WriteString(" AND ")
+				}
+				quote(term)
+				continue
+			}
+			for _, word := range searchWords(term) {
+				if match.Len() != 0 {
+					match.WriteString(" AND ")
+				}
+				if utf8.RuneCountInString(word) < searchFuzzyMinLength {
+					quote(word)
+					continue
+				}
+				if vocab == nil {
+					var err error
+					if vocab, err = db.searchVocab(ctx); err != nil {
+						return fmt.Errorf("get search vocabulary: %w", err)
+					}
+				}
+				match.WriteByte('(')
+				quote(word)
+				var n int
+				for _, v := range vocab {
+					if n == searchFuzzyMaxTerms {
+						break
+					}
+					if v.Term != word && withinEditDistance1(v.Term, word) {
+						match.WriteString(" OR ")
+						quote(v.Term)
+						n++
+					}
+				}
+				match.WriteByte(')')
+			}
+		}
+		if match.Len() == 0 {
+			return nil
+		}
+
+		rows, err := db.db.QueryContext(ctx, `SELECT url, name, address, rank FROM search WHERE search MATCH ? AND id = ? ORDER BY rank`, match.String(), id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var hit SearchHit
+			if err := rows.Scan(&hit.URL, &hit.Name, &hit.Address, &hit.Rank); err != nil {
+				return err
+			}
+			if !yield(hit) {
+				return nil
+			}
+		}
+		return rows.Err()
 	})
 }
 
+type searchVocabTerm struct {
+	Term string
+	Docs int
+}
+
+// searchVocab gets all words in the search index, from most to least common.
+func (db *Cache) searchVocab(ctx context.Context) ([]searchVocabTerm, error) {
+	rows, err := db.db.QueryContext(ctx, `SELECT term, doc FROM search_vocab ORDER BY doc DESC, term`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	vocab := []searchVocabTerm{}
+	for rows.Next() {
+		var v searchVocabTerm
+		if err := rows.Scan(&v.Term, &v.Docs); err != nil {
+			return nil, err
+		}
+		vocab = append(vocab, v)
+	}
+	return vocab, rows.Err()
+}
+
+// searchFold removes diacritics from s.
+var searchFold = transform.Chain(norm.NFD, runes.Remove(runes.In(unicode.Mn)), norm.NFC)
+
+// searchWords splits s into lowercase words without diacritics, approximately
+// the same way as the unicode61 tokenizer used by the search index.
+func searchWords(s string) []string {
+	if t, _, err := transform.String(searchFold, s); err == nil {
+		s = t
+	}
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// withinEditDistance1 checks if a can be turned into b by inserting, deleting,
+// or replacing at most one character.
+func withinEditDistance1(a, b string) bool {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra) < len(rb) {
+		ra, rb = rb, ra
+	}
+	if len(ra)-len(rb) > 1 {
+		return false
+	}
+	var i, j int
+	for i < len(ra) && j < len(rb) && ra[i] == rb[j] {
+		i, j = i+1, j+1
+	}
+	if len(ra) == len(rb) {
+		i, j = i+1, j+1 // replace
+	} else {
+		i++ // delete from the longer one
+	}
+	return string(ra[min(i, len(ra)):]) == string(rb[min(j, len(rb)):])
+}
+
 // ReadBlob reads a blob by the hash. If it doesn't exist, (false, nil) is
 // returned.
 func (db *Cache) ReadBlob(ctx context.Context, hash string, gzipped bool, fn func(io.Reader, int64) error) (bool, error) {
@@ -299,11 +666,21 @@ func (db *Cache) ReadBlob(ctx context.Context, hash string, gzipped bool, fn fun
 }
 
 // Import imports data from a git repository, skipping any commit hashes already
-// imported.
+// imported. See [Cache.DryRun] for validating commits without importing them.
 func (db *Cache) Import(ctx context.Context, logger *slog.Logger, repo, rev string) error {
 	slog := logger
+	dryRun := db.DryRun
+
+	if db.readOnly {
+		return ErrReadOnly
+	}
 
-	slog.Info("cache: importing data", "repo", repo, "rev", rev)
+	slog.Info("cache: importing data", "branch", db.branch, "repo", repo, "rev", rev, "dry_run", dryRun)
+
+	formats, required, err := db.importFormats()
+	if err != nil {
+		return err
+	}
 
 	// resolve the rev to a commit hash
 	head, err := gitsh.RevCommit(ctx, repo, rev)
@@ -315,7 +692,7 @@ func (db *Cache) Import(ctx context.Context, logger *slog.Logger, repo, rev stri
 
 	// short-circuit optimization if we already have all commits
 	var upToDate bool
-	if err := db.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM commits WHERE hash = ?)`, head).Scan(&upToDate); err != nil {
+	if err := db.db.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM commits WHERE branch = ? AND hash = ?)`, db.branch, head).Scan(&upToDate); err != nil {
 		return fmt.Errorf("check if up-to-date: %w", err)
 	}
 	if upToDate {
@@ -331,9 +708,17 @@ func (db *Cache) Import(ctx context.Context, logger *slog.Logger, repo, rev stri
 		// assume commits are all on the same timeline, so it's safe for each
 		// addition to be its own transaction (it won't mess up the revision
 		// numbers)
-		if skip, err := db.importCommit(ctx, slog.With("commit", commitHash), repo, commitHash, commitDate); err != nil {
-			slog.Error("cache: failed to import commit", "error", err)
-			return fmt.Errorf("import commit %q (%s): %w", commitHash, commitDate, err)
+		if skip, err := db.importCommit(ctx, slog.With("commit", commitHash), repo, commitHash, commitDate, formats, required, dryRun); err != nil {
+			if !db.ContinueOnError || ctx.Err() != nil {
+				slog.Error("cache: failed to import commit", "error", err)
+				return fmt.Errorf("import commit %q (%s): %w", commitHash, commitDate, err)
+			}
+			slog.Error("cache: failed to import commit, skipping", "commit", commitHash, "date", commitDate, "error", err)
+			if !dryRun {
+				if err := db.skipCommit(ctx, commitHash, commitDate); err != nil {
+					return fmt.Errorf("record failed commit %q (%s): %w", commitHash, commitDate, err)
+				}
+			}
 		} else if skip != nil {
 			slog.Warn("cache: skipping commit", "error", skip)
 		}
@@ -343,18 +728,263 @@ func (db *Cache) Import(ctx context.Context, logger *slog.Logger, repo, rev stri
 		return err
 	}
 
+	if dryRun {
+		slog.Info("cache: dry run finished")
+		return nil
+	}
+
 	// do a best-effort wal checkpoint
 	if err := sqliteCheckpointWAL(db.db, sqlite3.CHECKPOINT_PASSIVE); err != nil {
 		return err
 	}
 
+	db.notifyUpdated()
+
 	slog.Info("cache: import finished")
 	return nil
 }
 
+// BlobStats returns the number of stored blobs, the number of files referencing
+// them, the most files referencing a single blob, the total compressed size of
+// the blobs, and the total uncompressed size of all files referencing them
+// (i.e., what would be stored without compression or deduplication).
+func (db *Cache) BlobStats(ctx context.Context) (count, refs, maxRefs int, totalStored, totalLogical int64, err error) {
+	if err = db.db.QueryRowContext(ctx, `SELECT count(*), coalesce(sum(length(data)), 0) FROM blobs`).Scan(&count, &totalStored); err != nil {
+		return 0, 0, 0, 0, 0, err
+	}
+	if err = db.db.QueryRowContext(ctx, `SELECT count(*), coalesce(sum(blobs.size), 0) FROM files JOIN blobs ON blobs.hash = files.hash`).Scan(&refs, &totalLogical); err != nil {
+		return 0, 0, 0, 0, 0, err
+	}
+	if err = db.db.QueryRowContext(ctx, `SELECT coalesce(max(n), 0) FROM (SELECT count(*) AS n FROM files GROUP BY hash)`).Scan(&maxRefs); err != nil {
+		return 0, 0, 0, 0, 0, err
+	}
+	return count, refs, maxRefs, totalStored, totalLogical, nil
+}
+
+// Verify reads and decompresses every blob, checking the hash and size against
+// the contents. Blobs are read one at a time. If any blob is corrupt, an error
+// is returned for each one.
+func (db *Cache) Verify(ctx context.Context) error {
+	var hashes []string
+	rows, err := db.db.QueryContext(ctx, `SELECT hash FROM blobs ORDER BY rowid`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			rows.Close()
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, hash := range hashes {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var (
+			sum  string
+			n    int64
+			size int64
+		)
+		ok, err := db.ReadBlob(ctx, hash, false, func(r io.Reader, len int64) error {
+			s := sha1.New()
+			var err error
+			n, err = io.Copy(s, r)
+			sum, size = base32.StdEncoding.EncodeToString(s.Sum(nil)), len
+			return err
+		})
+		if err == nil && !ok {
+			err = fmt.Errorf("not found")
+		}
+		if err == nil && sum != hash {
+			err = fmt.Errorf("hash mismatch (got %s)", sum)
+		}
+		if err == nil && n != size {
+			err = fmt.Errorf("size mismatch (got %d, expected %d)", n, size)
+		}
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			errs = append(errs, fmt.Errorf("blob %s: %w", hash, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// DataVersionStats returns the number of data versions (including revisions),
+// and the update times of the oldest and newest ones (zero if there are none).
+func (db *Cache) DataVersionStats(ctx context.Context) (count int, oldest, newest time.Time, err error) {
+	if err = db.db.QueryRowContext(ctx, `SELECT count(*) FROM data WHERE branch = ?`, db.branch).Scan(&count); err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+	if count == 0 {
+		return 0, time.Time{}, time.Time{}, nil
+	}
+	if err = db.db.QueryRowContext(ctx, `SELECT min(updated), max(updated) FROM data WHERE branch = ?`, db.branch).Scan(sqlite3.TimeFormatUnixFrac.Scanner(&oldest), sqlite3.TimeFormatUnixFrac.Scanner(&newest)); err != nil {
+		return 0, time.Time{}, time.Time{}, err
+	}
+	return count, oldest, newest, nil
+}
+
+// FacilityChanges is like DataVersions, but only includes versions where the
+// schedule groups for the facility with the specified source url changed from
+// the previous version containing it. The first version containing the
+// facility is not included, and versions without it are ignored.
+func (db *Cache) FacilityChanges(ctx context.Context, url string) func(*error) iter.Seq[DataVersion] {
+	return db.dataVersions(ctx, `data.id IN (
+		SELECT id FROM (
+			SELECT data.id, facilities.hash, lag(facilities.hash) OVER (ORDER BY data.updated, data.revision) AS prev
+			FROM data JOIN facilities ON facilities.id = data.id
+			WHERE data.branch = ? AND facilities.url = ?
+		) WHERE prev IS NOT NULL AND prev != hash
+	)`, db.branch, url)
+}
+
+// FacilityChangeHistory returns the update times of the [Cache.FacilityChanges]
+// for the facility, from oldest to newest.
+func (db *Cache) FacilityChangeHistory(ctx context.Context, url string) ([]time.Time, error) {
+	var (
+		changes []time.Time
+		err     error
+	)
+	for ver := range db.FacilityChanges(ctx, url)(&err) {
+		changes = append(changes, ver.Updated)
+	}
+	if err != nil {
+		return nil, err
+	}
+	slices.Reverse(changes)
+	return changes, nil
+}
+
+// Size returns the size of the database and how much of it is free pages.
+func (db *Cache) Size(ctx context.Context) (size int64, free int64, err error) {
+	var pages, freePages, pageSize int64
+	if err = db.db.QueryRowContext(ctx, `PRAGMA page_count`).Scan(&pages); err != nil {
+		return 0, 0, err
+	}
+	if err = db.db.QueryRowContext(ctx, `PRAGMA freelist_count`).Scan(&freePages); err != nil {
+		return 0, 0, err
+	}
+	if err = db.db.QueryRowContext(ctx, `PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return 0, 0, err
+	}
+	return pages * pageSize, freePages * pageSize, nil
+}
+
+// maintainVacuumThreshold is the minimum fraction of free pages before Maintain
+// will vacuum the database.
+const maintainVacuumThreshold = 0.2
+
+// Maintain updates the query planner statistics, and vacuums the database if it
+// is fragmented enough. It is safe to call while the cache is in use, but may
+// block writes while vacuuming.
+func (db *Cache) Maintain(ctx context.Context) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	slog.Info("cache: starting maintenance")
+
+	if _, err := db.db.ExecContext(ctx, `ANALYZE`); err != nil {
+		return fmt.Errorf("analyze: %w", err)
+	}
+
+	size, free, err := db.Size(ctx)
+	if err != nil {
+		return fmt.Errorf("get size: %w", err)
+	}
+	if size == 0 || float64(free)/float64(size) < maintainVacuumThreshold {
+		slog.Info("cache: maintenance finished", "size", size, "free", free)
+		return nil
+	}
+
+	slog.Info("cache: vacuuming database", "size", size, "free", free)
+	if _, err := db.db.ExecContext(ctx, `VACUUM`); err != nil {
+		return fmt.Errorf("vacuum: %w", err)
+	}
+	if err := sqliteCheckpointWAL(db.db, sqlite3.CHECKPOINT_TRUNCATE); err != nil {
+		return fmt.Errorf("checkpoint: %w", err)
+	}
+
+	newSize, _, err := db.Size(ctx)
+	if err != nil {
+		return fmt.Errorf("get size: %w", err)
+	}
+	slog.Info("cache: maintenance finished", "size", newSize, "freed", size-newSize)
+	return nil
+}
+
+// Updated returns a channel which is closed the next time Import finishes
+// importing new commits. Note that this doesn't necessarily mean a new data
+// version was added (the commits could have been skipped or duplicates).
+func (db *Cache) Updated() <-chan struct{} {
+	db.updateMu.Lock()
+	defer db.updateMu.Unlock()
+
+	if db.update == nil {
+		db.update = make(chan struct{})
+	}
+	return db.update
+}
+
+func (db *Cache) notifyUpdated() {
+	db.updateMu.Lock()
+	defer db.updateMu.Unlock()
+
+	if db.update != nil {
+		close(db.update)
+		db.update = nil
+	}
+}
+
+// importFormats returns the formats to import, with the first required ones
+// first, followed by the optional ones. The first format is always pb.
+func (db *Cache) importFormats() ([]string, int, error) {
+	formats := db.Formats
+	if formats == nil {
+		formats = DefaultFormats
+	}
+	var required, optional []string
+	for _, format := range formats {
+		format, opt := strings.CutSuffix(format, "?")
+		switch {
+		case format == "" || strings.ContainsAny(format, "/?"):
+			return nil, 0, fmt.Errorf("invalid format %q", format)
+		case format == "textpb-pretty":
+			return nil, 0, fmt.Errorf("format %q is generated during import", format)
+		case slices.Contains(required, format) || slices.Contains(optional, format):
+			return nil, 0, fmt.Errorf("duplicate format %q", format)
+		case format == "pb" && opt:
+			return nil, 0, fmt.Errorf("format %q is always required", format)
+		case format == "pb":
+			required = slices.Insert(required, 0, format)
+		case opt:
+			optional = append(optional, format)
+		default:
+			required = append(required, format)
+		}
+	}
+	if !slices.Contains(required, "pb") {
+		required = slices.Insert(required, 0, "pb")
+	}
+	return append(required, optional...), len(required), nil
+}
+
 // importCommit imports a commit. Since it automatically calculates the
-// revision, it must be called from oldest to newest.
-func (db *Cache) importCommit(ctx context.Context, logger *slog.Logger, repo string, commitHash string, commitDate time.Time) (skip, err error) {
+// revision, it should be called from oldest to newest (if a backdated commit is
+// imported, the revisions for the update time are renumbered). The first
+// required format must be pb. If dryRun is true, the transaction is rolled back
+// instead of committed.
+func (db *Cache) importCommit(ctx context.Context, logger *slog.Logger, repo string, commitHash string, commitDate time.Time, formats []string, required int, dryRun bool) (skip, err error) {
 	slog := logger
 
 	tx, err := db.db.BeginTx(ctx, nil)
@@ -363,7 +993,8 @@ func (db *Cache) importCommit(ctx context.Context, logger *slog.Logger, repo str
 	}
 	defer tx.Rollback()
 
-	if res, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO commits (hash, date) VALUES (:hash, :date)`,
+	if res, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO commits (branch, hash, date) VALUES (:branch, :hash, :date)`,
+		sql.Named("branch", db.branch),
 		sql.Named("hash", commitHash),
 		sql.Named("date", sqlite3.TimeFormatUnixFrac.Encode(commitDate)),
 	); err != nil {
@@ -375,9 +1006,6 @@ func (db *Cache) importCommit(ctx context.Context, logger *slog.Logger, repo str
 	}
 	slog.Info("cache: import", "date", commitDate)
 
-	formats := []string{"pb", "textpb", "proto", "json"} // increment the schema version if we add more required formats
-	required := len(formats)
-	//formats = append(formats) // more optional formats if needed in the future
 	contents := make([][]byte, len(formats))
 
 	for i, format := range formats {
@@ -398,17 +1026,16 @@ func (db *Cache) importCommit(ctx context.Context, logger *slog.Logger, repo str
 	}
 
 	pb := contents[0]
-	id := base32sha1(pb)
+	id, _ := DeriveID(pb)
 
 	var dup bool
-	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM data WHERE id = ?)`, id).Scan(&dup); err != nil {
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM data WHERE branch = ? AND id = ?)`, db.branch, id).Scan(&dup); err != nil {
 		return nil, fmt.Errorf("check if duplicate: %w", err)
 	}
 	if dup {
 		old := id
-		id = base32sha1(contents...) // just sum all of it so it's deterministic
-		id = "9" + id[1:]            // 9 isn't in the base32 charset, and this lets us distinguish it later for debugging
-		if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM data WHERE id = ?)`, id).Scan(&dup); err != nil {
+		id, _ = DeriveID(pb, contents[1:]...) // just sum all of it so it's deterministic
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM data WHERE branch = ? AND id = ?)`, db.branch, id).Scan(&dup); err != nil {
 			return nil, fmt.Errorf("check if duplicate: %w", err)
 		}
 		if dup {
@@ -422,38 +1049,66 @@ func (db *Cache) importCommit(ctx context.Context, logger *slog.Logger, repo str
 		return nil, fmt.Errorf("unmarshal data.pb: %w", err)
 	}
 
-	var (
-		updated time.Time
-		nodate  int
-		yesdate int
-	)
-	for _, fac := range data.GetFacilities() {
-		if src := fac.GetSource(); src != nil {
-			if x := src.GetXDate(); x != nil {
-				yesdate++
-				if t := x.AsTime(); t.After(updated) {
-					updated = t
-				}
-				continue
-			}
-		}
-		nodate++
-	}
-	if updated.IsZero() {
+	c := checkData(&data)
+	if c.updated.IsZero() {
 		return errors.New("no facilities in data.pb with source date set"), nil
 	}
-	if nodate != 0 {
-		slog.Warn("cache: some facilities had no source._date set", "without_date", nodate, "with_date", yesdate)
+	if c.noDate != 0 {
+		slog.Warn("cache: some facilities had no source._date set", "without_date", c.noDate, "with_date", c.facilities-c.noDate)
 	}
+	if err := c.strictErr(); err != nil {
+		slog.Warn("cache: data failed validation checks", "facilities", c.facilities, "without_name", c.noName, "without_schedule_groups", c.noGroups, "times", c.times, "unparsed_times", c.badTimes)
+		if db.Strict {
+			return err, nil
+		}
+	}
+	updated := c.updated
 
+	var renumber bool
 	if _, err := tx.ExecContext(ctx,
-		`INSERT INTO data (id, hash, updated, revision) VALUES (:id, :hash, :updated,
-					1+coalesce((SELECT revision FROM data WHERE updated = :updated ORDER BY revision DESC LIMIT 1), 0))`,
+		`INSERT INTO data (branch, id, hash, updated, revision) VALUES (:branch, :id, :hash, :updated,
+					1+coalesce((SELECT revision FROM data WHERE branch = :branch AND updated = :updated ORDER BY revision DESC LIMIT 1), 0))`,
+		sql.Named("branch", db.branch),
 		sql.Named("id", id),
 		sql.Named("hash", commitHash),
 		sql.Named("updated", sqlite3.TimeFormatUnixFrac.Encode(updated)),
 	); err != nil {
-		return nil, fmt.Errorf("insert data: %w", err)
+		if !errors.Is(err, sqlite3.CONSTRAINT_UNIQUE) {
+			return nil, fmt.Errorf("insert data: %w", err)
+		}
+		// the existing revisions for the update time are inconsistent, so
+		// insert it with a placeholder and fix them all below
+		slog.Warn("cache: revision conflict, will renumber", "updated", updated, "error", err)
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO data (branch, id, hash, updated, revision) VALUES (:branch, :id, :hash, :updated, 0)`,
+			sql.Named("branch", db.branch),
+			sql.Named("id", id),
+			sql.Named("hash", commitHash),
+			sql.Named("updated", sqlite3.TimeFormatUnixFrac.Encode(updated)),
+		); err != nil {
+			return nil, fmt.Errorf("insert data: %w", err)
+		}
+		renumber = true
+	}
+	if !renumber {
+		// if this is a backdated commit, there will be newer commits with the
+		// same update time which already got lower revisions
+		if err := tx.QueryRowContext(ctx,
+			`SELECT EXISTS(SELECT 1 FROM data JOIN commits ON commits.branch = data.branch AND commits.hash = data.hash WHERE data.branch = :branch AND data.updated = :updated AND commits.date > :date)`,
+			sql.Named("branch", db.branch),
+			sql.Named("updated", sqlite3.TimeFormatUnixFrac.Encode(updated)),
+			sql.Named("date", sqlite3.TimeFormatUnixFrac.Encode(commitDate)),
+		).Scan(&renumber); err != nil {
+			return nil, fmt.Errorf("check if backdated: %w", err)
+		}
+		if renumber {
+			slog.Warn("cache: backdated commit, will renumber", "updated", updated)
+		}
+	}
+	if renumber {
+		if err := renumberRevisions(ctx, tx, db.branch, updated); err != nil {
+			return nil, fmt.Errorf("renumber revisions: %w", err)
+		}
 	}
 	for format, buf := range iterTranspose(formats, contents) {
 		if buf != nil {
@@ -463,18 +1118,166 @@ func (db *Cache) importCommit(ctx context.Context, logger *slog.Logger, repo str
 		}
 	}
 
+	// the stored textpb isn't very readable, so also generate an indented one
+	// (but keep the original one as-is for reproducibility)
+	if buf, err := (prototext.MarshalOptions{Multiline: true, Indent: "  "}).Marshal(&data); err != nil {
+		return nil, fmt.Errorf("marshal pretty textpb: %w", err)
+	} else if err := db.insertFile(ctx, tx, id, "textpb-pretty", buf); err != nil {
+		return nil, fmt.Errorf("insert file: %w", err)
+	}
+	if err := db.insertSearch(ctx, tx, id, &data); err != nil {
+		return nil, fmt.Errorf("insert search: %w", err)
+	}
+	if err := db.insertFacilities(ctx, tx, id, &data); err != nil {
+		return nil, fmt.Errorf("insert facilities: %w", err)
+	}
+
+	if dryRun {
+		slog.Info("cache: would import", "id", id, "updated", updated)
+		return nil, nil // the deferred rollback will discard it
+	}
+
 	if err := tx.Commit(); err != nil {
 		return nil, fmt.Errorf("commit tx: %w", err)
 	}
 	return nil, nil
 }
 
+// skipCommit records a commit without any data so it won't be imported again.
+func (db *Cache) skipCommit(ctx context.Context, commitHash string, commitDate time.Time) error {
+	_, err := db.db.ExecContext(ctx, `INSERT OR IGNORE INTO commits (branch, hash, date) VALUES (:branch, :hash, :date)`,
+		sql.Named("branch", db.branch),
+		sql.Named("hash", commitHash),
+		sql.Named("date", sqlite3.TimeFormatUnixFrac.Encode(commitDate)),
+	)
+	return err
+}
+
+// renumberRevisions reassigns the revisions for the update time in the branch
+// in commit date order.
+func renumberRevisions(ctx context.Context, tx *sql.Tx, branch string, updated time.Time) error {
+	// negate them first so the unique constraint isn't violated while updating
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE data SET revision = -revision WHERE branch = :branch AND updated = :updated`,
+		sql.Named("branch", branch),
+		sql.Named("updated", sqlite3.TimeFormatUnixFrac.Encode(updated)),
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		`UPDATE data SET revision = (
+			SELECT count(*) FROM data AS d JOIN commits AS c ON c.branch = d.branch AND c.hash = d.hash
+			WHERE d.branch = data.branch AND d.updated = data.updated AND (c.date, c.hash) <= ((SELECT date FROM commits WHERE branch = data.branch AND hash = data.hash), data.hash)
+		) WHERE branch = :branch AND updated = :updated`,
+		sql.Named("branch", branch),
+		sql.Named("updated", sqlite3.TimeFormatUnixFrac.Encode(updated)),
+	); err != nil {
+		return err
+	}
+	return nil
+}
+
+// dataCheck contains the results of additional validation on the data which
+// may indicate scraper regressions.
+type dataCheck struct {
+	updated    time.Time // latest facility source date
+	facilities int
+	noDate     int // facilities without a source date
+	noName     int // facilities without a name
+	noGroups   int // facilities without any schedule groups
+	times      int
+	badTimes   int // times without a parsed weekday and range
+}
+
+func checkData(data *schema.Data) dataCheck {
+	var c dataCheck
+	for _, fac := range data.GetFacilities() {
+		c.facilities++
+		if x := fac.GetSource().GetXDate(); x != nil {
+			if t := x.AsTime(); t.After(c.updated) {
+				c.updated = t
+			}
+		} else {
+			c.noDate++
+		}
+		if fac.GetName() == "" {
+			c.noName++
+		}
+		if len(fac.GetScheduleGroups()) == 0 {
+			c.noGroups++
+		}
+		for _, grp := range fac.GetScheduleGroups() {
+			for _, sch := range grp.GetSchedules() {
+				for _, act := range sch.GetActivities() {
+					for _, day := range act.GetDays() {
+						for _, tm := range day.GetTimes() {
+							c.times++
+							if _, _, ok := tm.AsXParsed(); !ok {
+								c.badTimes++
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	return c
+}
+
+// strictErr returns the error for failing strict validation, or nil.
+func (c dataCheck) strictErr() error {
+	if c.noName != 0 || c.noGroups != 0 || c.badTimes != 0 {
+		return fmt.Errorf("failed strict validation (%d/%d facilities without name, %d/%d facilities without schedule groups, %d/%d unparsed times)", c.noName, c.facilities, c.noGroups, c.facilities, c.badTimes, c.times)
+	}
+	return nil
+}
+
+// DataReport contains the results of validating a data.pb.
+type DataReport struct {
+	ID                    string    // ID the data would have if it isn't a duplicate
+	Updated               time.Time // latest facility source date
+	Facilities            int
+	WithoutDate           int // facilities without a source date
+	WithoutName           int // facilities without a name
+	WithoutScheduleGroups int // facilities without any schedule groups
+	Times                 int
+	UnparsedTimes         int   // times without a parsed weekday and range
+	Skip                  error // why the data would be skipped by Import, if it would be
+}
+
+// Validate runs the same checks as Import on pb without storing anything. An
+// error is only returned if pb could not be unmarshaled.
+func (db *Cache) Validate(pb []byte) (*DataReport, error) {
+	var data schema.Data
+	if err := proto.Unmarshal(pb, &data); err != nil {
+		return nil, fmt.Errorf("unmarshal data.pb: %w", err)
+	}
+	c := checkData(&data)
+	r := &DataReport{
+		ID:                    base32sha1(pb),
+		Updated:               c.updated,
+		Facilities:            c.facilities,
+		WithoutDate:           c.noDate,
+		WithoutName:           c.noName,
+		WithoutScheduleGroups: c.noGroups,
+		Times:                 c.times,
+		UnparsedTimes:         c.badTimes,
+	}
+	if c.updated.IsZero() {
+		r.Skip = errors.New("no facilities in data.pb with source date set")
+	} else if db.Strict {
+		r.Skip = c.strictErr()
+	}
+	return r, nil
+}
+
 func (db *Cache) insertFile(ctx context.Context, tx *sql.Tx, id string, format string, buf []byte) error {
 	hash := base32sha1(buf)
-	if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO blobs (hash, size, data) VALUES (:hash, :size, gzip(:data, 9))`,
+	if _, err := tx.ExecContext(ctx, `INSERT OR IGNORE INTO blobs (hash, size, data) VALUES (:hash, :size, gzip(:data, :level))`,
 		sql.Named("hash", hash),
 		sql.Named("size", len(buf)),
 		sql.Named("data", buf),
+		sql.Named("level", cmp.Or(db.GzipLevel, gzip.BestCompression)),
 	); err != nil {
 		return fmt.Errorf("insert blob: %w", err)
 	}
@@ -488,6 +1291,83 @@ func (db *Cache) insertFile(ctx context.Context, tx *sql.Tx, id string, format s
 	return nil
 }
 
+func (db *Cache) insertSearch(ctx context.Context, tx *sql.Tx, id string, data *schema.Data) error {
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS(SELECT 1 FROM search WHERE id = ?)`, id).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil // already imported in another branch
+	}
+
+	stmt, err := tx.PrepareContext(ctx, `INSERT INTO search (id, url, name, address, activities) VALUES (:id, :url, :name, :address, :activities)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	var (
+		activities []string
+		seen       = map[string]bool{}
+	)
+	for _, fac := range data.GetFacilities() {
+		activities = activities[:0]
+		clear(seen)
+		for _, grp := range fac.GetScheduleGroups() {
+			for _, sch := range grp.GetSchedules() {
+				for _, act := range sch.GetActivities() {
+					if name := act.GetXName(); name != "" && !seen[name] {
+						seen[name] = true
+						activities = append(activities, name)
+					}
+				}
+			}
+		}
+		if _, err := stmt.ExecContext(ctx,
+			sql.Named("id", id),
+			sql.Named("url", fac.GetSource().GetUrl()),
+			sql.Named("name", fac.GetName()),
+			sql.Named("address", fac.GetAddress()),
+			sql.Named("activities", strings.Join(activities, "\n")),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *Cache) insertFacilities(ctx context.Context, tx *sql.Tx, id string, data *schema.Data) error {
+	stmt, err := tx.PrepareContext(ctx, `INSERT OR IGNORE INTO facilities (id, url, hash) VALUES (:id, :url, :hash)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	var grps [][]byte
+	for _, fac := range data.GetFacilities() {
+		url := fac.GetSource().GetUrl()
+		if url == "" {
+			continue
+		}
+		grps = grps[:0]
+		for _, grp := range fac.GetScheduleGroups() {
+			buf, err := proto.MarshalOptions{Deterministic: true}.Marshal(grp)
+			if err != nil {
+				return fmt.Errorf("marshal schedule group: %w", err)
+			}
+			grps = append(grps, buf)
+		}
+		if _, err := stmt.ExecContext(ctx,
+			sql.Named("id", id),
+			sql.Named("url", url),
+			sql.Named("hash", base32sha1(grps...)),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 var sqliteURIEscaper = strings.NewReplacer("?", "%3f", "#", "%23")
 
 func escapeSqlitePath(path string) string {
@@ -538,6 +1418,27 @@ func sqliteCheckpointWAL(db *sql.DB, mode sqlite3.CheckpointMode) error {
 	})
 }
 
+// sqliteInit registers the custom functions in c.
+func sqliteInit(c *sqlite3.Conn) error {
+	return errors.Join(
+		sqliteRegisterGzip(c),
+		sqliteRegisterTZMonth(c))
+}
+
+// sqliteRegisterTZMonth registers a tzmonth function in c, which formats a
+// unix fractional timestamp as a month (YYYY-MM) in [TZ]. The time zone is
+// captured when the function is registered so the result stays deterministic
+// for the connection even if [TZ] is changed later.
+//
+//	tzmonth(real) text
+func sqliteRegisterTZMonth(c *sqlite3.Conn) error {
+	tz := TZ
+	return c.CreateFunction("tzmonth", 1, sqlite3.DETERMINISTIC, func(ctx sqlite3.Context, arg ...sqlite3.Value) {
+		sec, frac := math.Modf(arg[0].Float())
+		ctx.ResultText(time.Unix(int64(sec), int64(frac*1e9)).In(tz).Format("2006-01"))
+	})
+}
+
 // sqliteRegisterGzip registers a gzip function in c.
 //
 //	gzip(blob) blob
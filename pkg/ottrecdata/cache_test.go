@@ -0,0 +1,716 @@
+package ottrecdata
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	_ "github.com/ncruces/go-sqlite3/embed"
+	"github.com/pgaskin/ottrec-website/internal/gitsh"
+	"github.com/pgaskin/ottrec/schema"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/prototext"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// testRepo is a git repo for importing test data.
+type testRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	if _, err := exec.LookPath(gitsh.Git); err != nil {
+		t.Skipf("git not available: %v", err)
+	}
+	r := &testRepo{t, t.TempDir()}
+	r.git(time.Time{}, "init", "--quiet")
+	return r
+}
+
+func (r *testRepo) git(date time.Time, arg ...string) string {
+	cmd := exec.Command(gitsh.Git, arg...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test",
+		"GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test",
+		"GIT_COMMITTER_EMAIL=test@example.com",
+	)
+	if !date.IsZero() {
+		cmd.Env = append(cmd.Env,
+			"GIT_AUTHOR_DATE="+date.Format(time.RFC3339),
+			"GIT_COMMITTER_DATE="+date.Format(time.RFC3339),
+		)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %s: %v\n%s", strings.Join(arg, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit commits a data.pb with a single facility with the specified name and
+// source date, returning the commit hash.
+func (r *testRepo) commit(date time.Time, name string, updated time.Time) string {
+	return r.commitData(date, name, schema.Data_builder{
+		Facilities: []*schema.Facility{
+			schema.Facility_builder{
+				Name: name,
+				Source: schema.Source_builder{
+					XDate: timestamppb.New(updated),
+				}.Build(),
+			}.Build(),
+		},
+	}.Build())
+}
+
+// commitData commits data as data.pb with the specified message, returning the
+// commit hash.
+func (r *testRepo) commitData(date time.Time, message string, data *schema.Data) string {
+	pb, err := proto.Marshal(data)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(r.dir, "data.pb"), pb, 0644); err != nil {
+		r.t.Fatal(err)
+	}
+	r.git(date, "add", "data.pb")
+	r.git(date, "commit", "--quiet", "--allow-empty", "--message", message)
+	return r.git(time.Time{}, "rev-parse", "HEAD")
+}
+
+// testCache opens a new cache importing the specified formats (or only pb if
+// none are specified), and returns it with a logger which discards output.
+func testCache(t *testing.T, formats ...string) (*Cache, *slog.Logger) {
+	t.Helper()
+	db, err := OpenCache(filepath.Join(t.TempDir(), "cache.db"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if len(formats) == 0 {
+		formats = []string{"pb"}
+	}
+	db.Formats = formats
+	return db, slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+func TestImportBackdated(t *testing.T) {
+	repo := newTestRepo(t)
+
+	db, logger := testCache(t)
+	var err error
+	updated := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	a := repo.commit(time.Date(2025, 9, 1, 13, 0, 0, 0, time.UTC), "A", updated)
+	b := repo.commit(time.Date(2025, 9, 1, 15, 0, 0, 0, time.UTC), "B", updated)
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	// committed after b, but dated between a and b
+	c := repo.commit(time.Date(2025, 9, 1, 14, 0, 0, 0, time.UTC), "C", updated)
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Fatalf("import backdated: %v", err)
+	}
+
+	revisions := map[string]int{}
+	for ver := range db.DataVersions(context.Background())(&err) {
+		if !ver.Updated.Equal(updated) {
+			t.Errorf("unexpected updated time %s", ver.Updated)
+		}
+		revisions[ver.Commit] = ver.Revision
+	}
+	if err != nil {
+		t.Fatalf("list versions: %v", err)
+	}
+	for hash, exp := range map[string]int{a: 1, c: 2, b: 3} {
+		if act, ok := revisions[hash]; !ok {
+			t.Errorf("commit %s not imported", hash)
+		} else if act != exp {
+			t.Errorf("commit %s: expected revision %d, got %d", hash, exp, act)
+		}
+	}
+	if len(revisions) != 3 {
+		t.Errorf("expected 3 versions, got %d", len(revisions))
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	repo := newTestRepo(t)
+
+	db, logger := testCache(t)
+	db.DryRun = true
+
+	repo.commit(time.Date(2025, 9, 1, 13, 0, 0, 0, time.UTC), "A", time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC))
+	repo.commit(time.Date(2025, 9, 2, 13, 0, 0, 0, time.UTC), "B", time.Date(2025, 9, 2, 12, 0, 0, 0, time.UTC))
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	for _, table := range []string{"commits", "data", "files"} {
+		var n int
+		if err := db.db.QueryRow(`SELECT count(*) FROM ` + table).Scan(&n); err != nil {
+			t.Fatalf("count %s: %v", table, err)
+		}
+		if n != 0 {
+			t.Errorf("expected no rows in %s after a dry run, got %d", table, n)
+		}
+	}
+}
+
+func TestImportContinueOnError(t *testing.T) {
+	repo := newTestRepo(t)
+
+	db, logger := testCache(t)
+	var err error
+
+	a := repo.commit(time.Date(2025, 9, 1, 13, 0, 0, 0, time.UTC), "A", time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC))
+	if err := os.WriteFile(filepath.Join(repo.dir, "data.pb"), []byte("not a protobuf"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	repo.git(time.Date(2025, 9, 2, 13, 0, 0, 0, time.UTC), "add", "data.pb")
+	repo.git(time.Date(2025, 9, 2, 13, 0, 0, 0, time.UTC), "commit", "--quiet", "--message", "bad")
+	b := repo.commit(time.Date(2025, 9, 3, 13, 0, 0, 0, time.UTC), "B", time.Date(2025, 9, 3, 12, 0, 0, 0, time.UTC))
+
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err == nil {
+		t.Fatalf("expected import to fail on the bad commit")
+	}
+
+	db.ContinueOnError = true
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	var commits []string
+	for ver := range db.DataVersions(context.Background())(&err) {
+		commits = append(commits, ver.Commit)
+	}
+	if err != nil {
+		t.Fatalf("list versions: %v", err)
+	}
+	if !slices.Equal(commits, []string{b, a}) {
+		t.Errorf("expected versions %q, got %q", []string{b, a}, commits)
+	}
+
+	// the bad commit was recorded, so it shouldn't be retried
+	db.ContinueOnError = false
+	repo.commit(time.Date(2025, 9, 4, 13, 0, 0, 0, time.UTC), "C", time.Date(2025, 9, 4, 12, 0, 0, 0, time.UTC))
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Errorf("re-import: %v", err)
+	}
+}
+
+func TestDeriveID(t *testing.T) {
+	repo := newTestRepo(t)
+
+	db, logger := testCache(t, "pb", "json")
+
+	updated := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	data := schema.Data_builder{
+		Facilities: []*schema.Facility{
+			schema.Facility_builder{
+				Name: "A",
+				Source: schema.Source_builder{
+					XDate: timestamppb.New(updated),
+				}.Build(),
+			}.Build(),
+		},
+	}.Build()
+	pb, err := proto.Marshal(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same data.pb, but a different data.json
+	var exp []string
+	for i, opt := range []protojson.MarshalOptions{{}, {Multiline: true}} {
+		js, err := opt.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(repo.dir, "data.json"), js, 0644); err != nil {
+			t.Fatal(err)
+		}
+		repo.git(time.Time{}, "add", "data.json")
+		repo.commitData(updated.Add(time.Duration(i+1)*time.Hour), "data", data)
+
+		var id string
+		var fallback bool
+		if i == 0 {
+			id, fallback = DeriveID(pb)
+		} else {
+			id, fallback = DeriveID(pb, js)
+		}
+		if !IsID(id) {
+			t.Errorf("derived id %q is not an id", id)
+		}
+		if fallback != (i != 0) {
+			t.Errorf("derived id %q: unexpected fallback %t", id, fallback)
+		}
+		exp = append(exp, id)
+	}
+	if !strings.HasPrefix(exp[1], "9") {
+		t.Errorf("expected fallback id %q to start with 9", exp[1])
+	}
+
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	var act []string
+	for ver := range db.DataVersions(context.Background())(&err) {
+		act = append(act, ver.ID)
+	}
+	if err != nil {
+		t.Fatalf("list versions: %v", err)
+	}
+	slices.Reverse(act)
+	if !slices.Equal(act, exp) {
+		t.Errorf("expected ids %q, got %q", exp, act)
+	}
+}
+
+func TestBlobStats(t *testing.T) {
+	repo := newTestRepo(t)
+
+	db, logger := testCache(t, "pb", "json")
+
+	updated := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	data := schema.Data_builder{
+		Facilities: []*schema.Facility{
+			schema.Facility_builder{
+				Name: "A",
+				Source: schema.Source_builder{
+					XDate: timestamppb.New(updated),
+				}.Build(),
+			}.Build(),
+		},
+	}.Build()
+
+	// same data.pb (and textpb-pretty), but a different data.json
+	for i, opt := range []protojson.MarshalOptions{{}, {Multiline: true}} {
+		js, err := opt.Marshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(repo.dir, "data.json"), js, 0644); err != nil {
+			t.Fatal(err)
+		}
+		repo.git(time.Time{}, "add", "data.json")
+		repo.commitData(updated.Add(time.Duration(i+1)*time.Hour), "data", data)
+	}
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	count, refs, maxRefs, stored, logical, err := db.BlobStats(context.Background())
+	if err != nil {
+		t.Fatalf("blob stats: %v", err)
+	}
+	if count != 4 {
+		t.Errorf("expected 4 blobs, got %d", count)
+	}
+	if refs != 6 {
+		t.Errorf("expected 6 refs, got %d", refs)
+	}
+	if maxRefs != 2 {
+		t.Errorf("expected at most 2 refs per blob, got %d", maxRefs)
+	}
+	if stored <= 0 || logical <= 0 {
+		t.Errorf("expected non-zero sizes, got %d stored and %d logical", stored, logical)
+	}
+}
+
+func TestImportBranches(t *testing.T) {
+	repo := newTestRepo(t)
+
+	db, logger := testCache(t)
+	var err error
+	staging := db.Branch("staging")
+	updated := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	a := repo.commit(time.Date(2025, 9, 1, 13, 0, 0, 0, time.UTC), "A", updated)
+	repo.git(time.Time{}, "checkout", "--quiet", "-b", "staging")
+	b := repo.commit(time.Date(2025, 9, 1, 14, 0, 0, 0, time.UTC), "B", updated)
+
+	if err := db.Import(context.Background(), logger, repo.dir, a); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if err := staging.Import(context.Background(), logger, repo.dir, "staging"); err != nil {
+		t.Fatalf("import staging: %v", err)
+	}
+
+	commits := func(db *Cache) []string {
+		var commits []string
+		for ver := range db.DataVersions(context.Background())(&err) {
+			commits = append(commits, ver.Commit)
+		}
+		if err != nil {
+			t.Fatalf("list versions: %v", err)
+		}
+		return commits
+	}
+	if act := commits(db); !slices.Equal(act, []string{a}) {
+		t.Errorf("default branch: expected commits %q, got %q", []string{a}, act)
+	}
+	if act := commits(staging); !slices.Equal(act, []string{b, a}) {
+		t.Errorf("staging branch: expected commits %q, got %q", []string{b, a}, act)
+	}
+
+	// the same data should have the same id in both branches
+	id1, _, _, err := db.ResolveVersion(context.Background(), "latest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, _, _, err := staging.ResolveVersion(context.Background(), "latest-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id1 == "" || id1 != id2 {
+		t.Errorf("expected the same id for the shared commit, got %q and %q", id1, id2)
+	}
+	if id, _, _, err := db.ResolveVersion(context.Background(), "latest-1"); err != nil {
+		t.Fatal(err)
+	} else if id != "" {
+		t.Errorf("expected staging data to not be visible in the default branch, got %q", id)
+	}
+}
+
+func TestFacilityChangeHistory(t *testing.T) {
+	repo := newTestRepo(t)
+
+	db, logger := testCache(t)
+
+	commit := func(day int, name string, groups ...string) time.Time {
+		updated := time.Date(2025, 9, day, 12, 0, 0, 0, time.UTC)
+		var grps []*schema.ScheduleGroup
+		for _, label := range groups {
+			grps = append(grps, schema.ScheduleGroup_builder{Label: label}.Build())
+		}
+		repo.commitData(updated.Add(time.Hour), name, schema.Data_builder{
+			Facilities: []*schema.Facility{
+				schema.Facility_builder{
+					Name: name,
+					Source: schema.Source_builder{
+						Url:   "https://example.com/a",
+						XDate: timestamppb.New(updated),
+					}.Build(),
+					ScheduleGroups: grps,
+				}.Build(),
+			},
+		}.Build())
+		return updated
+	}
+	commit(1, "A", "Swimming")
+	commit(2, "A (renamed)", "Swimming")
+	t3 := commit(3, "A", "Swimming", "Skating")
+	commit(4, "A", "Swimming", "Skating")
+	t5 := commit(5, "A", "Skating")
+
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	act, err := db.FacilityChangeHistory(context.Background(), "https://example.com/a")
+	if err != nil {
+		t.Fatalf("get history: %v", err)
+	}
+	if exp := []time.Time{t3, t5}; !slices.EqualFunc(act, exp, time.Time.Equal) {
+		t.Errorf("expected changes %v, got %v", exp, act)
+	}
+
+	var ids []string
+	for ver := range db.FacilityChanges(context.Background(), "https://example.com/a")(&err) {
+		ids = append(ids, ver.ID)
+		if !ver.Updated.Equal(t3) && !ver.Updated.Equal(t5) {
+			t.Errorf("unexpected changed version %s", ver.Updated)
+		}
+	}
+	if err != nil {
+		t.Fatalf("list changes: %v", err)
+	}
+	if len(ids) != 2 {
+		t.Errorf("expected 2 changed versions, got %d", len(ids))
+	}
+
+	if act, err := db.FacilityChangeHistory(context.Background(), "https://example.com/b"); err != nil {
+		t.Fatalf("get history: %v", err)
+	} else if len(act) != 0 {
+		t.Errorf("expected no changes for unknown facility, got %v", act)
+	}
+}
+
+func TestSearchDiacritics(t *testing.T) {
+	repo := newTestRepo(t)
+
+	db, logger := testCache(t)
+
+	updated := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	facility := func(url, name string) *schema.Facility {
+		return schema.Facility_builder{
+			Name: name,
+			Source: schema.Source_builder{
+				Url:   url,
+				XDate: timestamppb.New(updated),
+			}.Build(),
+		}.Build()
+	}
+	repo.commitData(updated.Add(time.Hour), "data", schema.Data_builder{
+		Facilities: []*schema.Facility{
+			facility("https://example.com/a", "Centre R\u00e9cr\u00e9atif A"),   // precomposed
+			facility("https://example.com/b", "Centre Re\u0301cre\u0301atif B"), // decomposed
+			facility("https://example.com/c", "Community Centre C"),
+		},
+	}.Build())
+
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	id, _, _, err := db.ResolveVersion(context.Background(), "latest")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+
+	for _, query := range []string{
+		"recreatif",
+		"RECREATIF",
+		"r\u00e9cr\u00e9atif",
+		"re\u0301cre\u0301atif",
+		"centre r\u00c9CR\u00c9ATIF",
+	} {
+		var urls []string
+		for hit := range db.Search(context.Background(), id, query, 0)(&err) {
+			urls = append(urls, hit.URL)
+		}
+		if err != nil {
+			t.Fatalf("search %q: %v", query, err)
+		}
+		slices.Sort(urls)
+		if exp := []string{"https://example.com/a", "https://example.com/b"}; !slices.Equal(urls, exp) {
+			t.Errorf("search %q: expected %q, got %q", query, exp, urls)
+		}
+	}
+}
+
+func TestSearchMode(t *testing.T) {
+	repo := newTestRepo(t)
+
+	db, logger := testCache(t)
+
+	updated := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	facility := func(url, name string) *schema.Facility {
+		return schema.Facility_builder{
+			Name: name,
+			Source: schema.Source_builder{
+				Url:   url,
+				XDate: timestamppb.New(updated),
+			}.Build(),
+		}.Build()
+	}
+	repo.commitData(updated.Add(time.Hour), "data", schema.Data_builder{
+		Facilities: []*schema.Facility{
+			facility("https://example.com/a", "Centre Récréatif Plaza"),
+			facility("https://example.com/b", "Champagne Pool"),
+			facility("https://example.com/c", "Bob MacQuarrie Recreation Complex"),
+		},
+	}.Build())
+
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	id, _, _, err := db.ResolveVersion(context.Background(), "latest")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+
+	for _, tc := range []struct {
+		query string
+		mode  SearchMode
+		exp   []string
+	}{
+		{"recreation", 0, []string{"https://example.com/c"}},
+		{"champ", 0, nil},
+		{"champ", SearchPrefix, []string{"https://example.com/b"}},
+		{"champagme", 0, nil},
+		{"champagme", SearchFuzzy, []string{"https://example.com/b"}},
+		{"champagme po", SearchFuzzy, nil},
+		{"champagme po", SearchFuzzy | SearchPrefix, []string{"https://example.com/b"}},
+		{"récréatf", SearchFuzzy, []string{"https://example.com/a"}},
+		{"recreatiff plaza", SearchFuzzy, []string{"https://example.com/a"}},
+		{"pol", SearchFuzzy, nil}, // too short
+	} {
+		var urls []string
+		for hit := range db.Search(context.Background(), id, tc.query, tc.mode)(&err) {
+			urls = append(urls, hit.URL)
+		}
+		if err != nil {
+			t.Fatalf("search %q (mode %d): %v", tc.query, tc.mode, err)
+		}
+		slices.Sort(urls)
+		if !slices.Equal(urls, tc.exp) {
+			t.Errorf("search %q (mode %d): expected %q, got %q", tc.query, tc.mode, tc.exp, urls)
+		}
+	}
+}
+
+func TestWithinEditDistance1(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		exp  bool
+	}{
+		{"", "", true},
+		{"a", "", true},
+		{"ab", "", false},
+		{"pool", "pool", true},
+		{"pool", "pol", true},
+		{"pool", "poold", true},
+		{"pool", "xpool", true},
+		{"pool", "poxl", true},
+		{"pool", "plo", false},
+		{"pool", "opol", false},
+		{"récré", "recré", true},
+		{"récré", "recre", false},
+	} {
+		if act := withinEditDistance1(tc.a, tc.b); act != tc.exp {
+			t.Errorf("withinEditDistance1(%q, %q): expected %t, got %t", tc.a, tc.b, tc.exp, act)
+		}
+		if act := withinEditDistance1(tc.b, tc.a); act != tc.exp {
+			t.Errorf("withinEditDistance1(%q, %q): expected %t, got %t", tc.b, tc.a, tc.exp, act)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	repo := newTestRepo(t)
+
+	db, logger := testCache(t)
+
+	repo.commit(time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC), "A", time.Date(2025, 9, 1, 0, 0, 0, 0, time.UTC))
+	repo.commit(time.Date(2025, 9, 2, 12, 0, 0, 0, time.UTC), "B", time.Date(2025, 9, 2, 0, 0, 0, 0, time.UTC))
+
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if err := db.Verify(context.Background()); err != nil {
+		t.Fatalf("unexpected verify error: %v", err)
+	}
+
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte("corrupt"))
+	zw.Close()
+	if _, err := db.db.Exec(`UPDATE blobs SET data = ? WHERE rowid = (SELECT min(rowid) FROM blobs)`, b.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(context.Background()); err == nil || !strings.Contains(err.Error(), "hash mismatch") {
+		t.Errorf("expected hash mismatch, got %v", err)
+	}
+
+	if _, err := db.db.Exec(`UPDATE blobs SET data = ? WHERE rowid = (SELECT max(rowid) FROM blobs)`, []byte("not gzip")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Verify(context.Background()); err == nil {
+		t.Errorf("expected error")
+	} else if n := len(err.(interface{ Unwrap() []error }).Unwrap()); n != 2 {
+		t.Errorf("expected 2 errors, got %d: %v", n, err)
+	}
+}
+
+func TestDataFormatsOrder(t *testing.T) {
+	repo := newTestRepo(t)
+
+	db, logger := testCache(t, "textpb", "pb", "json")
+
+	updated := time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)
+	data := schema.Data_builder{
+		Facilities: []*schema.Facility{
+			schema.Facility_builder{
+				Name: "A",
+				Source: schema.Source_builder{
+					XDate: timestamppb.New(updated),
+				}.Build(),
+			}.Build(),
+		},
+	}.Build()
+	for name, fn := range map[string]func(proto.Message) ([]byte, error){
+		"data.textpb": prototext.Marshal,
+		"data.json":   protojson.Marshal,
+	} {
+		buf, err := fn(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(repo.dir, name), buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		repo.git(time.Time{}, "add", name)
+	}
+	repo.commitData(updated.Add(time.Hour), "data", data)
+
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	id, _, _, err := db.ResolveVersion(context.Background(), "latest")
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+
+	var formats []string
+	for _, format := range db.DataFormats(context.Background(), id)(&err) {
+		formats = append(formats, format)
+	}
+	if err != nil {
+		t.Fatalf("get formats: %v", err)
+	}
+	if len(formats) < 3 {
+		t.Fatalf("expected at least 3 formats, got %q", formats)
+	}
+	if !slices.IsSorted(formats) {
+		t.Errorf("expected formats to be sorted, got %q", formats)
+	}
+}
+
+func TestMonthlyVersions(t *testing.T) {
+	repo := newTestRepo(t)
+
+	db, logger := testCache(t)
+	var err error
+
+	commit := func(day int, name string, updated time.Time) {
+		repo.commit(time.Date(2025, 10, day, 12, 0, 0, 0, time.UTC), name, updated)
+	}
+	commit(1, "A", time.Date(2025, 8, 20, 12, 0, 0, 0, TZ))
+	commit(2, "B", time.Date(2025, 9, 1, 12, 0, 0, 0, TZ))
+	commit(3, "C", time.Date(2025, 9, 15, 12, 0, 0, 0, TZ))
+	commit(4, "D", time.Date(2025, 9, 30, 22, 0, 0, 0, TZ)) // october in UTC
+	commit(5, "E", time.Date(2025, 9, 30, 22, 0, 0, 0, TZ)) // revision
+	commit(6, "F", time.Date(2025, 10, 2, 12, 0, 0, 0, TZ))
+
+	if err := db.Import(context.Background(), logger, repo.dir, "HEAD"); err != nil {
+		t.Fatalf("import: %v", err)
+	}
+
+	var act []string
+	for ver := range db.MonthlyVersions(context.Background())(&err) {
+		act = append(act, ver.Updated.In(TZ).Format("2006-01-02T15:04")+"_r"+strconv.Itoa(ver.Revision))
+	}
+	if err != nil {
+		t.Fatalf("list versions: %v", err)
+	}
+	if exp := []string{"2025-10-02T12:00_r1", "2025-09-30T22:00_r2", "2025-08-20T12:00_r1"}; !slices.Equal(act, exp) {
+		t.Errorf("expected versions %q, got %q", exp, act)
+	}
+}
@@ -9,30 +9,82 @@ import (
 	"io"
 	"io/fs"
 	"iter"
+	"log/slog"
 	"net/http"
 	"net/url"
+	"os"
+	"path"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 	"unicode/utf8"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
 )
 
+// Client is a client for the data v1 api. The methods accept a context which
+// should be used for finer control over cancellation and deadlines.
 type Client struct {
-	Client    *http.Client
+	Client    *http.Client // if nil, DefaultClient is used
 	Base      string
-	UserAgent string
+	UserAgent string // if empty, DefaultUserAgent is used
+	CacheDir  string // if not empty, data files are cached in this directory by id
+}
+
+// DefaultUserAgent is the User-Agent used if one is not set on the [Client].
+const DefaultUserAgent = "ottrec"
+
+// DefaultClient is the HTTP client used if one is not set on the [Client].
+var DefaultClient = &http.Client{
+	Timeout: 30 * time.Second,
 }
 
 type DataVersion struct {
-	ID       string    `json:"id"`
-	Updated  time.Time `json:"updated"`
-	Revision int       `json:"revision"`
+	ID        string    `json:"id"`
+	Updated   time.Time `json:"updated"`
+	Committed time.Time `json:"committed"` // when it was committed to the data repository (zero for older servers)
+	Revision  int       `json:"revision"`
+
+	// IsRevision is true if the previous version in the list has the same
+	// update time (i.e., this is an older revision of it). This can only
+	// happen when listing revisions.
+	IsRevision bool `json:"-"`
+}
+
+// Distinct filters a list of versions to only include the latest revision for
+// each update time (i.e., the ones where IsRevision is false). This is useful
+// if you need both when listing revisions.
+func Distinct(seq iter.Seq[DataVersion]) iter.Seq[DataVersion] {
+	return func(yield func(DataVersion) bool) {
+		for v := range seq {
+			if !v.IsRevision && !yield(v) {
+				return
+			}
+		}
+	}
 }
 
-// List lists all data versions.
+// List lists all data versions, from newest to oldest, starting after the
+// specified id if not empty.
 func (c *Client) List(ctx context.Context, revisions bool, after string) func(*error) iter.Seq[DataVersion] {
+	return c.list(ctx, revisions, after, "")
+}
+
+// ListSince lists data versions newer than since, from newest to oldest,
+// stopping once since is encountered. If since is not found, all versions are
+// listed.
+func (c *Client) ListSince(ctx context.Context, revisions bool, since string) func(*error) iter.Seq[DataVersion] {
+	return c.list(ctx, revisions, "", since)
+}
+
+func (c *Client) list(ctx context.Context, revisions bool, after, until string) func(*error) iter.Seq[DataVersion] {
 	return errSeq(func(yield func(DataVersion) bool) error {
-		var a []DataVersion
+		var (
+			a    []DataVersion
+			prev DataVersion
+		)
 		for {
 			if err := func() error {
 				resp, err := c.fetch(ctx, "/v1/?revisions="+strconv.FormatBool(revisions)+"&after="+url.QueryEscape(after))
@@ -57,6 +109,11 @@ func (c *Client) List(ctx context.Context, revisions bool, after string) func(*e
 				return nil
 			}
 			for _, v := range a {
+				if until != "" && v.ID == until {
+					return nil
+				}
+				v.IsRevision = prev.ID != "" && prev.Updated.Equal(v.Updated)
+				prev = v
 				if !yield(v) {
 					return nil
 				}
@@ -79,8 +136,14 @@ func (c *Client) On(ctx context.Context, year int, month time.Month, day int, fo
 	return c.Get(ctx, fmt.Sprintf("%04d-%02d-%02d", year, month, day), format)
 }
 
-// Get gets a data file.
+// Get gets a data file. If [Client.CacheDir] is set, it will be used to store
+// and retrieve data files by the resolved id, since they are immutable. Errors
+// writing to the cache are logged rather than returned.
 func (c *Client) Get(ctx context.Context, spec, format string) ([]byte, error) {
+	if buf, ok := c.cacheGet(spec, format); ok {
+		return buf, nil
+	}
+
 	resp, err := c.fetch(ctx, "/v1/"+url.PathEscape(spec)+"/"+url.PathEscape(format))
 	if err != nil {
 		return nil, err
@@ -99,25 +162,153 @@ func (c *Client) Get(ctx context.Context, spec, format string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	// spec will have been redirected to the canonical url for the id
+	if id, format, ok := parseFileURL(resp.Request.URL); ok {
+		if err := c.cachePut(id, format, buf); err != nil {
+			slog.Warn("ottrecdl: failed to cache data file", "id", id, "format", format, "error", err)
+		}
+	}
 	return buf, nil
 }
 
+// parseFileURL gets the id and format from a canonical data file url.
+func parseFileURL(u *url.URL) (id, format string, ok bool) {
+	dir, format := path.Split(u.EscapedPath())
+	_, id = path.Split(strings.TrimSuffix(dir, "/"))
+	if !isID(id) || !isFormat(format) {
+		return "", "", false
+	}
+	return id, format, true
+}
+
+func (c *Client) cachePath(id, format string) string {
+	return filepath.Join(c.CacheDir, id+"."+format)
+}
+
+func (c *Client) cacheGet(spec, format string) ([]byte, bool) {
+	if c.CacheDir == "" || !isID(spec) || !isFormat(format) {
+		return nil, false
+	}
+	buf, err := os.ReadFile(c.cachePath(spec, format))
+	if err != nil {
+		return nil, false
+	}
+	return buf, true
+}
+
+func (c *Client) cachePut(id, format string, buf []byte) error {
+	if c.CacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.CacheDir, 0777); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.CacheDir, ".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.cachePath(id, format))
+}
+
+// isID checks if s looks like a data id (a base32-encoded sha1, where the
+// first character may be replaced with "9" for ids derived from all files).
+func isID(s string) bool {
+	if len(s) != 32 {
+		return false
+	}
+	for i, c := range s {
+		if (c < 'A' || c > 'Z') && (c < '2' || c > '7') && (i != 0 || c != '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// isFormat checks if s looks like a data format name.
+func isFormat(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+			return false
+		}
+	}
+	return true
+}
+
 func (c *Client) fetch(ctx context.Context, path string) (*http.Response, error) {
 	u := strings.TrimRight(c.Base, "/") + path
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
 	if err != nil {
 		return nil, fmt.Errorf("fetch %q: %w", u, err)
 	}
-	if c.UserAgent != "" {
-		req.Header.Set("User-Agent", c.UserAgent)
-	}
-	resp, err := cmp.Or(c.Client, http.DefaultClient).Do(req)
+	req.Header.Set("User-Agent", cmp.Or(c.UserAgent, DefaultUserAgent))
+	req.Header.Set("Accept-Encoding", "gzip, zstd") // note: this disables the transparent gzip in net/http
+	resp, err := cmp.Or(c.Client, DefaultClient).Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("fetch %q: %w", u, err)
 	}
+	if err := decodeBody(resp); err != nil {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetch %q: %w", u, err)
+	}
 	return resp, nil
 }
 
+// decodeBody replaces the response body with a decompressing reader according
+// to the Content-Encoding.
+func decodeBody(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusNotModified {
+		return nil // no body
+	}
+	var zr io.ReadCloser
+	switch enc := resp.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+		return nil
+	case "gzip":
+		r, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("gzip: %w", err)
+		}
+		zr = r
+	case "zstd":
+		r, err := zstd.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf("zstd: %w", err)
+		}
+		zr = r.IOReadCloser()
+	default:
+		return fmt.Errorf("unsupported content encoding %q", enc)
+	}
+	resp.Body = &decodedBody{zr, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+type decodedBody struct {
+	io.ReadCloser
+	body io.ReadCloser
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.body.Close()
+}
+
 func statusCodeError(resp *http.Response) error {
 	if buf, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)); len(buf) != 0 && utf8.Valid(buf) {
 		return fmt.Errorf("response status %d (body: %q)", resp.StatusCode, buf)
@@ -10,6 +10,9 @@ import (
 	"strings"
 	"unicode"
 	"unicode/utf8"
+
+	"github.com/klauspost/compress/zip"
+	"github.com/pgaskin/ottrec/schema"
 )
 
 const (
@@ -17,6 +20,27 @@ const (
 	commaCSV = ','
 )
 
+// BOM is the UTF-8 byte order mark.
+const BOM = "\ufeff"
+
+// CSVOptions contains options for writing CSV.
+type CSVOptions struct {
+	// BOM prepends a UTF-8 byte order mark to each table so Excel detects the
+	// encoding correctly. Most other CSV parsers do not need or expect it.
+	BOM bool
+
+	// Null, if set, is written instead of an empty field for unset values in
+	// columns which may be empty (i.e., the ones which are null in JSON) so
+	// they can be distinguished from empty strings (e.g., \N for MySQL and
+	// PostgreSQL).
+	Null string
+
+	// ValidUTF8 replaces each invalid UTF-8 byte (including ones which are part
+	// of an encoded surrogate) in strings with U+FFFD like the JSON writer so
+	// the output is always valid UTF-8.
+	ValidUTF8 bool
+}
+
 func CSV(x *Data) iter.Seq2[string, []byte] {
 	if x == nil {
 		return nil
@@ -26,7 +50,7 @@ func CSV(x *Data) iter.Seq2[string, []byte] {
 		var err error
 		for table, val := range iterTablesCSV(x)(&err) {
 			typ := val.Type()
-			if err := writeTableRowsCSV(newStickyBufferedWriter(&buf), typ, val); err != nil {
+			if err := writeTableRowsCSV(newStickyBufferedWriter(&buf), typ, val, CSVOptions{}); err != nil {
 				panic(err)
 			}
 			if !yield(table, slices.Clone(buf.Bytes())) {
@@ -52,7 +76,7 @@ func TableCSV[T Row](x Table[T]) []byte {
 	val := reflect.ValueOf(x)
 	typ := val.Type()
 	var buf bytes.Buffer
-	if err := writeTableRowsCSV(newStickyBufferedWriter(&buf), typ, val); err != nil {
+	if err := writeTableRowsCSV(newStickyBufferedWriter(&buf), typ, val, CSVOptions{}); err != nil {
 		panic(err)
 	}
 	return buf.Bytes()
@@ -61,12 +85,20 @@ func TableCSV[T Row](x Table[T]) []byte {
 // WriteCSV writes the data as CSV, calling fn for each table to get w. If w is
 // nil, the table is skipped.
 func WriteCSV(x *Data, fn func(string) io.Writer) error {
+	return WriteCSVWithOptions(x, fn, CSVOptions{})
+}
+
+// WriteCSVWithOptions is like WriteCSV, but with options.
+func WriteCSVWithOptions(x *Data, fn func(string) io.Writer, opt CSVOptions) error {
 	var err error
 	for table, val := range iterTablesCSV(x)(&err) {
 		typ := val.Type()
 		if w := fn(table); w != nil {
 			bw := newStickyBufferedWriter(w)
-			if err := writeTableRowsCSV(bw, typ, val); err != nil {
+			if opt.BOM {
+				bw.String(BOM)
+			}
+			if err := writeTableRowsCSV(bw, typ, val, opt); err != nil {
 				return fmt.Errorf("write table %s: %w", table, err)
 			}
 			if err := bw.Flush(); err != nil {
@@ -80,6 +112,44 @@ func WriteCSV(x *Data, fn func(string) io.Writer) error {
 	return nil
 }
 
+// WriteCSVZip writes the data as a zip containing schema.csv and a CSV file for
+// each table.
+func WriteCSVZip(x *Data, w io.Writer, opt CSVOptions) error {
+	zw := zip.NewWriter(w)
+	{
+		w, err := zw.Create("schema.csv")
+		if err != nil {
+			return err
+		}
+		if opt.BOM {
+			if _, err := io.WriteString(w, BOM); err != nil {
+				return err
+			}
+		}
+		if err := WriteCSVSchema(w); err != nil {
+			return err
+		}
+	}
+	var zerr error
+	if err := WriteCSVWithOptions(x, func(table string) io.Writer {
+		if zerr != nil {
+			return nil
+		}
+		w, err := zw.Create(table + ".csv")
+		if err != nil {
+			zerr = err
+			return nil
+		}
+		return w
+	}, opt); err != nil {
+		return err
+	}
+	if zerr != nil {
+		return zerr
+	}
+	return zw.Close()
+}
+
 func WriteCSVSchema(w io.Writer) error {
 	bw := newStickyBufferedWriter(w)
 	if err := writeDataCSVSchema(bw, new(Data)); err != nil {
@@ -89,10 +159,18 @@ func WriteCSVSchema(w io.Writer) error {
 }
 
 func WriteTableCSV[T Row](x Table[T], w io.Writer) error {
+	return WriteTableCSVWithOptions(x, w, CSVOptions{})
+}
+
+// WriteTableCSVWithOptions is like WriteTableCSV, but with options.
+func WriteTableCSVWithOptions[T Row](x Table[T], w io.Writer, opt CSVOptions) error {
 	bw := newStickyBufferedWriter(w)
+	if opt.BOM {
+		bw.String(BOM)
+	}
 	val := reflect.ValueOf(x)
 	typ := val.Type()
-	if err := writeTableRowsCSV(bw, typ, val); err != nil {
+	if err := writeTableRowsCSV(bw, typ, val, opt); err != nil {
 		return err
 	}
 	return bw.Flush()
@@ -102,7 +180,7 @@ func WriteRowCSV[T Row](x *T, w io.Writer) error {
 	bw := newStickyBufferedWriter(w)
 	val := reflect.ValueOf(x)
 	typ := val.Type()
-	if err := writeRowCSV(bw, typ, val, false); err != nil {
+	if err := writeRowCSV(bw, typ, val, false, CSVOptions{}); err != nil {
 		return err
 	}
 	return bw.Flush()
@@ -152,6 +230,7 @@ func writeDataCSVSchema(w *stickyBufferedWriter, x any) error {
 	w.StringCSV(false, "table")
 	w.StringCSV(true, "column")
 	w.StringCSV(true, "description")
+	w.StringCSV(true, "stable")
 	if crlfCSV {
 		w.Byte('\r')
 	}
@@ -178,9 +257,19 @@ func writeDataCSVSchema(w *stickyBufferedWriter, x any) error {
 				return fmt.Errorf("table %q: missing doc tag", table)
 			}
 
+			stable, err := isStable(row)
+			if err != nil {
+				return fmt.Errorf("table %q: %w", table, err)
+			}
+
 			w.StringCSV(false, table)
 			w.StringCSV(true, name)
 			w.StringCSV(true, doc)
+			if stable {
+				w.String(",1")
+			} else {
+				w.String(",0")
+			}
 			if crlfCSV {
 				w.Byte('\r')
 			}
@@ -194,24 +283,24 @@ func writeDataCSVSchema(w *stickyBufferedWriter, x any) error {
 	return w.Err()
 }
 
-func writeTableRowsCSV(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value) error {
+func writeTableRowsCSV(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value, opt CSVOptions) error {
 	if typ.Kind() != reflect.Slice {
 		return fmt.Errorf("unsupported type %s", typ)
 	}
 	for j := range val.Len() {
 		if j == 0 {
-			if err := writeRowCSV(w, typ.Elem(), val.Index(j), true); err != nil {
+			if err := writeRowCSV(w, typ.Elem(), val.Index(j), true, opt); err != nil {
 				return fmt.Errorf("write row: %w", err)
 			}
 		}
-		if err := writeRowCSV(w, typ.Elem(), val.Index(j), false); err != nil {
+		if err := writeRowCSV(w, typ.Elem(), val.Index(j), false, opt); err != nil {
 			return fmt.Errorf("write row: %w", err)
 		}
 	}
 	return w.Err()
 }
 
-func writeRowCSV(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value, header bool) error {
+func writeRowCSV(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value, header bool, opt CSVOptions) error {
 	if typ.Kind() == reflect.Pointer {
 		if val.IsNil() {
 			return fmt.Errorf("is nil")
@@ -226,7 +315,7 @@ func writeRowCSV(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value, h
 		if k != 0 {
 			w.Byte(commaCSV)
 		}
-		if err := writeColumnCSV(w, typ.Field(k), val.Field(k), header); err != nil {
+		if err := writeColumnCSV(w, typ.Field(k), val.Field(k), header, opt); err != nil {
 			return fmt.Errorf("write column %q: %w", typ.Field(k).Name, err)
 		}
 	}
@@ -238,7 +327,7 @@ func writeRowCSV(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value, h
 	return w.Err()
 }
 
-func writeColumnCSV(w *stickyBufferedWriter, typ reflect.StructField, val reflect.Value, header bool) error {
+func writeColumnCSV(w *stickyBufferedWriter, typ reflect.StructField, val reflect.Value, header bool, opt CSVOptions) error {
 	tag, ok := typ.Tag.Lookup("scsv")
 	if !ok || tag == "" {
 		return fmt.Errorf("missing or invalid tag")
@@ -265,18 +354,21 @@ func writeColumnCSV(w *stickyBufferedWriter, typ reflect.StructField, val reflec
 	}
 
 	if emptyzero {
+		var zero bool
 		switch typ.Type.Kind() {
 		case reflect.Slice, reflect.Pointer:
-			if val.IsNil() {
-				return w.Err()
-			}
+			zero = val.IsNil()
 		default:
 			if !val.Comparable() {
 				return fmt.Errorf("cannot nullzero if not comparable")
 			}
-			if val.IsZero() {
-				return w.Err()
+			zero = val.IsZero()
+		}
+		if zero {
+			if opt.Null != "" {
+				w.StringCSV(false, opt.Null)
 			}
+			return w.Err()
 		}
 	}
 
@@ -287,7 +379,7 @@ func writeColumnCSV(w *stickyBufferedWriter, typ reflect.StructField, val reflec
 				if i != 0 {
 					w.Byte(',')
 				}
-				if err := writeFieldCSV(w, typ.Type.Elem(), val.Index(i), true); err != nil {
+				if err := writeFieldCSV(w, typ.Type.Elem(), val.Index(i), true, opt); err != nil {
 					return fmt.Errorf("write field item %s: %w", typ.Name, err)
 				}
 			}
@@ -296,22 +388,26 @@ func writeColumnCSV(w *stickyBufferedWriter, typ reflect.StructField, val reflec
 		return w.Err()
 	}
 
-	if err := writeFieldCSV(w, typ.Type, val, false); err != nil {
+	if err := writeFieldCSV(w, typ.Type, val, false, opt); err != nil {
 		return fmt.Errorf("write field %s: %w", typ.Name, err)
 	}
 	return w.Err()
 }
 
-func writeFieldCSV(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value, arr bool) error {
+func writeFieldCSV(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value, arr bool, opt CSVOptions) error {
 	switch typ.Kind() {
 	case reflect.String:
+		str := val.Interface().(string)
+		if opt.ValidUTF8 {
+			str = validUTF8CSV(str)
+		}
 		if arr {
-			if strings.ContainsRune(val.Interface().(string), ',') {
-				return fmt.Errorf("array item %q contains comma", val.Interface().(string))
+			if strings.ContainsRune(str, ',') {
+				return fmt.Errorf("array item %q contains comma", str)
 			}
-			w.StringInQuotesCSV(val.Interface().(string))
+			w.StringInQuotesCSV(str)
 		} else {
-			w.StringCSV(false, val.Interface().(string))
+			w.StringCSV(false, str)
 		}
 	case reflect.Bool:
 		if val.Bool() {
@@ -328,9 +424,18 @@ func writeFieldCSV(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value,
 	case reflect.Float64:
 		w.Float(val.Float(), 'f', -1, 64)
 	case reflect.Struct:
+		// note: ranges are written as a single string (empty sides if not
+		// parsed) since there's no nesting in csv
 		switch colVal := val.Interface().(type) {
+		case schema.ClockRange:
+			start, _ := formatClockTime(colVal.Start)
+			end, _ := formatClockTime(colVal.End)
+			w.StringCSV(false, start+"-"+end)
+		case schema.DateRange:
+			from, _ := formatDate(colVal.From)
+			to, _ := formatDate(colVal.To)
+			w.StringCSV(false, from+"/"+to)
 		default:
-			_ = colVal
 			return fmt.Errorf("unsupported type %s", typ)
 		}
 	default:
@@ -339,6 +444,24 @@ func writeFieldCSV(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value,
 	return w.Err()
 }
 
+// validUTF8CSV replaces each invalid UTF-8 byte in s with U+FFFD.
+func validUTF8CSV(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	b := make([]byte, 0, len(s)+len("\ufffd"))
+	for len(s) > 0 {
+		r, n := utf8.DecodeRuneInString(s)
+		if r == utf8.RuneError && n == 1 {
+			b = append(b, "\ufffd"...)
+		} else {
+			b = append(b, s[:n]...)
+		}
+		s = s[n:]
+	}
+	return string(b)
+}
+
 // writeStringCSV is based on encoding/csv.Writer.Write
 func (w *stickyBufferedWriter) StringCSV(comma bool, field string) {
 	if comma {
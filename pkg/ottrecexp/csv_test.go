@@ -6,7 +6,9 @@ import (
 	"flag"
 	"io"
 	"iter"
+	"strings"
 	"testing"
+	"unicode/utf8"
 )
 
 var LogCSV = flag.Bool("log-csv", false, "always log CSV in tests")
@@ -37,8 +39,8 @@ func TestCSV(t *testing.T) {
 				switch data {
 				case EmptyData:
 					if sha := sha1sum(buf); sha != map[string]string{
-						"facility":    "0cb5e85f0e3c9c2aea18ff0dae8f46345c1a82cd",
-						"activity":    "fe8a08310eddfe6d20479c72e688037a33e2ce22",
+						"facility":    "7d7586e337be26a59ad07f3b39483a4d44baa842",
+						"activity":    "6b9580a7529e1694ba6c2ac7a15ec7c66a587e42",
 						"error":       "5441d9ab6a74517681827f05ae4da06b07293257",
 						"html":        "3c193f3628a0ec52fc7ea7efe2cca136e1c7504a",
 						"attribution": "fce2f18d64f0e436dc8ce88f815ad9b2902d02a8",
@@ -48,8 +50,8 @@ func TestCSV(t *testing.T) {
 					}
 				case DummyData:
 					if sha := sha1sum(buf); sha != map[string]string{
-						"facility":    "0a8d3acd0b1db3157e467fb63bde6e896739a70c",
-						"activity":    "9bd1fc1fde1d0e57c0603f281aa9205dbfe4df62",
+						"facility":    "9d083f657cc9eb5ea9c37bef1f1edd4d230d51e8",
+						"activity":    "fe12d9f9fe72ce35ec4a82d547e294ce5f58fc93",
 						"error":       "484964de6b1eab8e4704806b78f68bbdd6dd99ec",
 						"html":        "c9cc1815fef07d65670de69747b5d5abf4557771",
 						"attribution": "64c53be844ef8855bbb2287440c7815947775898",
@@ -85,6 +87,129 @@ func TestCSVSchema(t *testing.T) {
 	// TODO: test structure
 }
 
+func TestCSVBOM(t *testing.T) {
+	for name, data := range testdata() {
+		t.Run(name, func(t *testing.T) {
+			var (
+				plain = map[string]*bytes.Buffer{}
+				bom   = map[string]*bytes.Buffer{}
+			)
+			if err := WriteCSV(data, func(table string) io.Writer {
+				plain[table] = new(bytes.Buffer)
+				return plain[table]
+			}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := WriteCSVWithOptions(data, func(table string) io.Writer {
+				bom[table] = new(bytes.Buffer)
+				return bom[table]
+			}, CSVOptions{BOM: true}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for table, buf := range plain {
+				if bytes.HasPrefix(buf.Bytes(), []byte(BOM)) {
+					t.Errorf("table %q: unexpected bom", table)
+				}
+				if exp := BOM + buf.String(); bom[table].String() != exp {
+					t.Errorf("table %q: expected output to be prefixed with bom", table)
+				}
+			}
+		})
+	}
+}
+
+func TestCSVNull(t *testing.T) {
+	for _, null := range []string{"", `\N`} {
+		var buf bytes.Buffer
+		if err := WriteTableCSVWithOptions(Table[Facility]{{URL: "a", Name: "b"}}, &buf, CSVOptions{Null: null}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		r := csv.NewReader(&buf)
+		r.Comma = commaCSV
+		records, err := r.ReadAll()
+		if err != nil {
+			t.Fatalf("null %q: invalid csv: %v", null, err)
+		}
+		if len(records) != 2 {
+			t.Fatalf("null %q: expected 2 records, got %d", null, len(records))
+		}
+		for i, col := range records[0] {
+			var exp string
+			switch col {
+			case "facility_url":
+				exp = "a"
+			case "facility_name":
+				exp = "b"
+			case "facility_longitude", "facility_latitude":
+				exp = null
+			case "facility_special_hours_html_id", "facility_notifications_html_id":
+				exp = "0"
+			}
+			if act := records[1][i]; act != exp {
+				t.Errorf("null %q: column %q: expected %q, got %q", null, col, exp, act)
+			}
+		}
+	}
+}
+
+func TestCSVValidUTF8(t *testing.T) {
+	for _, valid := range []bool{false, true} {
+		var buf bytes.Buffer
+		if err := WriteTableCSVWithOptions(Table[Facility]{{URL: "a", Name: "b\xffc\xed\xa0\x80d"}}, &buf, CSVOptions{ValidUTF8: valid}); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		exp := "b\xffc\xed\xa0\x80d"
+		if valid {
+			exp = "b\ufffdc\ufffd\ufffd\ufffdd"
+		}
+		if !strings.Contains(buf.String(), ","+exp+",") {
+			t.Errorf("valid %t: expected name to be written as %q, got %q", valid, exp, buf.String())
+		}
+		if act := utf8.Valid(buf.Bytes()); act != valid {
+			t.Errorf("valid %t: expected valid utf-8 to be %t", valid, act)
+		}
+	}
+}
+
+func TestPivotCSV(t *testing.T) {
+	for name, data := range testdata() {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := WritePivotCSV(data, &buf); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err := validCSV(buf.Bytes()); err != nil {
+				logCSV(t, false, "pivot", buf.Bytes())
+				t.Fatalf("invalid csv: %v", err)
+			}
+		})
+	}
+	t.Run("Pivot", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := WritePivotCSV(&Data{Activity: Table[Activity]{
+			{FacilityURL: "a", Name: "swim", Weekday: "monday", StartTime: "07:00", EndTime: "09:00"},
+			{FacilityURL: "a", Name: "swim", Weekday: "monday", StartTime: "18:00", EndTime: "20:00"},
+			{FacilityURL: "a", Name: "swim", Weekday: "saturday", RawTime: "noon"},
+			{FacilityURL: "a", Name: "swim", Weekday: "2025-09-01", StartTime: "07:00", EndTime: "09:00"},
+			{FacilityURL: "a", Name: "skate", Weekday: "sunday", StartTime: "13:00", EndTime: "14:00"},
+			{FacilityURL: "b", Name: "swim", Weekday: "monday", StartTime: "07:00", EndTime: "09:00"},
+		}}, &buf); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		exp := "" +
+			"facility_url,activity_date_start,activity_date_end,activity_group,activity_name,sunday,monday,tuesday,wednesday,thursday,friday,saturday\n" +
+			"a,,,,swim,,\"07:00-09:00, 18:00-20:00\",,,,,noon\n" +
+			"a,,,,skate,13:00-14:00,,,,,,\n" +
+			"b,,,,swim,,07:00-09:00,,,,,\n"
+		if crlfCSV {
+			exp = strings.ReplaceAll(exp, "\n", "\r\n")
+		}
+		if act := buf.String(); act != exp {
+			t.Errorf("expected:\n%s\ngot:\n%s", exp, act)
+		}
+	})
+}
+
 func validCSV(buf []byte) error {
 	r := csv.NewReader(bytes.NewReader(buf))
 	r.ReuseRecord = true
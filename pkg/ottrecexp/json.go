@@ -6,6 +6,8 @@ import (
 	"io"
 	"reflect"
 	"strings"
+
+	"github.com/pgaskin/ottrec/schema"
 )
 
 // JSONSchemaID, if set, is used as the ID of the JSON schema, and is included
@@ -31,10 +33,23 @@ func JSONSchema() []byte {
 	return buf.Bytes()
 }
 
+// JSONOptions contains options for the JSON export.
+type JSONOptions struct {
+	// OmitUnstable omits columns which are not stable (i.e., the raw fields and
+	// cross-referencing indexes). The unstableFields object is still included,
+	// but will be empty.
+	OmitUnstable bool
+}
+
 // WriteJSON writes the data as JSON to w.
 func WriteJSON(x *Data, w io.Writer) error {
+	return WriteJSONWithOptions(x, w, JSONOptions{})
+}
+
+// WriteJSONWithOptions is like WriteJSON, but with options.
+func WriteJSONWithOptions(x *Data, w io.Writer, opt JSONOptions) error {
 	bw := newStickyBufferedWriter(w)
-	if err := writeDataJSON(bw, x); err != nil {
+	if err := writeDataJSON(bw, x, opt); err != nil {
 		return err
 	}
 	return bw.Flush()
@@ -52,7 +67,7 @@ func WriteTableJSON[T Row](x Table[T], w io.Writer) error {
 	bw := newStickyBufferedWriter(w)
 	val := reflect.ValueOf(x)
 	typ := val.Type()
-	if err := writeTableRowsJSON(bw, typ, val); err != nil {
+	if err := writeTableRowsJSON(bw, typ, val, JSONOptions{}); err != nil {
 		return err
 	}
 	return bw.Flush()
@@ -62,13 +77,13 @@ func WriteRowJSON[T Row](x *T, w io.Writer) error {
 	bw := newStickyBufferedWriter(w)
 	val := reflect.ValueOf(x)
 	typ := val.Type()
-	if err := writeRowJSON(bw, typ, val); err != nil {
+	if err := writeRowJSON(bw, typ, val, JSONOptions{}); err != nil {
 		return err
 	}
 	return bw.Flush()
 }
 
-func writeDataJSON(w *stickyBufferedWriter, data any) error {
+func writeDataJSON(w *stickyBufferedWriter, data any, opt JSONOptions) error {
 	w.Byte('{')
 	var (
 		val = reflect.ValueOf(data)
@@ -85,11 +100,23 @@ func writeDataJSON(w *stickyBufferedWriter, data any) error {
 		w.KeyValueJSON(false, "$schema", JSONSchemaID)
 		w.Byte(',')
 	}
+	if d, ok := data.(*Data); ok {
+		w.KeyJSON(false, "version")
+		w.Int(SchemaVersion, 10)
+		w.Byte(',')
+		w.KeyValueJSON(false, "attributionText", d.AttributionText())
+		w.Byte(',')
+	}
+	w.KeyJSON(false, "unstableFields")
+	if err := writeUnstableFieldsJSON(w, typ, opt); err != nil {
+		return fmt.Errorf("write unstable fields: %w", err)
+	}
+	w.Byte(',')
 	for i := range typ.NumField() {
 		if i != 0 {
 			w.Byte(',')
 		}
-		if err := writeTableJSON(w, typ.Field(i), val.Field(i)); err != nil {
+		if err := writeTableJSON(w, typ.Field(i), val.Field(i), opt); err != nil {
 			return fmt.Errorf("write table %s: %w", typ.Field(i).Name, err)
 		}
 
@@ -115,6 +142,36 @@ func writeDataJSONSchema(w *stickyBufferedWriter, data any) error {
 	w.KeyValueJSON(true, "type", "object")
 	w.KeyJSON(true, "properties")
 	w.Byte('{')
+	if typ == reflect.TypeFor[Data]() {
+		w.KeyJSON(false, "version")
+		w.Byte('{')
+		w.KeyValueJSON(false, "type", "integer")
+		w.KeyJSON(true, "const")
+		w.Int(SchemaVersion, 10)
+		w.KeyValueJSON(true, "description", "schema version, incremented whenever tables or columns change")
+		w.Byte('}')
+		w.Byte(',')
+		w.KeyJSON(false, "attributionText")
+		w.Byte('{')
+		w.KeyValueJSON(false, "type", "string")
+		w.KeyValueJSON(true, "description", "attribution text which must be displayed where the data is used (the attribution table joined by newlines)")
+		w.Byte('}')
+		w.Byte(',')
+	}
+	w.KeyJSON(false, "unstableFields")
+	w.Byte('{')
+	w.KeyValueJSON(false, "type", "object")
+	w.KeyValueJSON(true, "description", "columns for each table which are not stable and should not be relied upon")
+	w.KeyJSON(true, "additionalProperties")
+	w.Byte('{')
+	w.KeyValueJSON(false, "type", "array")
+	w.KeyJSON(true, "items")
+	w.Byte('{')
+	w.KeyValueJSON(false, "type", "string")
+	w.Byte('}')
+	w.Byte('}')
+	w.Byte('}')
+	w.Byte(',')
 	for i := range typ.NumField() {
 		if i != 0 {
 			w.Byte(',')
@@ -128,7 +185,59 @@ func writeDataJSONSchema(w *stickyBufferedWriter, data any) error {
 	return w.Err()
 }
 
-func writeTableJSON(w *stickyBufferedWriter, typ reflect.StructField, val reflect.Value) error {
+// writeUnstableFieldsJSON writes an object containing the names of the columns
+// in each table which are not stable and included in the output.
+func writeUnstableFieldsJSON(w *stickyBufferedWriter, typ reflect.Type, opt JSONOptions) error {
+	w.Byte('{')
+	for i := range typ.NumField() {
+		table := typ.Field(i)
+
+		tag, ok := table.Tag.Lookup("sjson")
+		if !ok || tag == "" {
+			return fmt.Errorf("table %s: missing or invalid tag", table.Name)
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if table.Type.Kind() != reflect.Slice {
+			return fmt.Errorf("table %s: unsupported type %s", table.Name, table.Type)
+		}
+		row := table.Type.Elem()
+		if row.Kind() == reflect.Pointer {
+			row = row.Elem()
+		}
+
+		w.KeyJSON(i != 0, name)
+		w.Byte('[')
+		var n int
+		for k := range row.NumField() {
+			col := row.Field(k)
+
+			stable, err := isStable(col)
+			if err != nil {
+				return fmt.Errorf("table %s: column %s: %w", table.Name, col.Name, err)
+			}
+			if stable || opt.OmitUnstable {
+				continue
+			}
+
+			tag, ok := col.Tag.Lookup("sjson")
+			if !ok || tag == "" {
+				return fmt.Errorf("table %s: column %s: missing or invalid tag", table.Name, col.Name)
+			}
+			name, _, _ := strings.Cut(tag, ",")
+
+			if n++; n != 1 {
+				w.Byte(',')
+			}
+			w.StringJSON(name)
+		}
+		w.Byte(']')
+	}
+	w.Byte('}')
+	return w.Err()
+}
+
+func writeTableJSON(w *stickyBufferedWriter, typ reflect.StructField, val reflect.Value, opt JSONOptions) error {
 	tag, ok := typ.Tag.Lookup("sjson")
 	if !ok || tag == "" {
 		return fmt.Errorf("missing or invalid tag")
@@ -142,7 +251,7 @@ func writeTableJSON(w *stickyBufferedWriter, typ reflect.StructField, val reflec
 	}
 
 	w.KeyJSON(false, name)
-	return writeTableRowsJSON(w, typ.Type, val)
+	return writeTableRowsJSON(w, typ.Type, val, opt)
 }
 
 func writeTableJSONSchema(w *stickyBufferedWriter, typ reflect.StructField) error {
@@ -175,7 +284,7 @@ func writeTableJSONSchema(w *stickyBufferedWriter, typ reflect.StructField) erro
 	return w.Err()
 }
 
-func writeTableRowsJSON(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value) error {
+func writeTableRowsJSON(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value, opt JSONOptions) error {
 	w.Byte('[')
 	if typ.Kind() != reflect.Slice {
 		return fmt.Errorf("unsupported type %s", typ)
@@ -184,7 +293,7 @@ func writeTableRowsJSON(w *stickyBufferedWriter, typ reflect.Type, val reflect.V
 		if j != 0 {
 			w.Byte(',')
 		}
-		if err := writeRowJSON(w, typ.Elem(), val.Index(j)); err != nil {
+		if err := writeRowJSON(w, typ.Elem(), val.Index(j), opt); err != nil {
 			return fmt.Errorf("write row: %w", err)
 		}
 	}
@@ -208,7 +317,7 @@ func writeTableRowsJSONSchema(w *stickyBufferedWriter, typ reflect.Type) error {
 	return w.Err()
 }
 
-func writeRowJSON(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value) error {
+func writeRowJSON(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value, opt JSONOptions) error {
 	if typ.Kind() == reflect.Pointer {
 		if val.IsNil() {
 			return fmt.Errorf("is nil")
@@ -220,8 +329,18 @@ func writeRowJSON(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value)
 		return fmt.Errorf("unsupported type %s", typ)
 	}
 	w.Byte('{')
+	var n int
 	for k := range typ.NumField() {
-		if k != 0 {
+		if opt.OmitUnstable {
+			stable, err := isStable(typ.Field(k))
+			if err != nil {
+				return fmt.Errorf("column %q: %w", typ.Field(k).Name, err)
+			}
+			if !stable {
+				continue
+			}
+		}
+		if n++; n != 1 {
 			w.Byte(',')
 		}
 		if err := writeColumnJSON(w, typ.Field(k), val.Field(k)); err != nil {
@@ -387,8 +506,25 @@ func writeFieldJSON(w *stickyBufferedWriter, typ reflect.Type, val reflect.Value
 		w.FloatJSON(val.Float(), 64)
 	case reflect.Struct:
 		switch colVal := val.Interface().(type) {
+		case schema.ClockRange:
+			start, ok1 := formatClockTime(colVal.Start)
+			end, ok2 := formatClockTime(colVal.End)
+			w.Byte('{')
+			w.KeyJSON(false, "start")
+			w.NullableStringJSON(start, ok1)
+			w.KeyJSON(true, "end")
+			w.NullableStringJSON(end, ok2)
+			w.Byte('}')
+		case schema.DateRange:
+			from, ok1 := formatDate(colVal.From)
+			to, ok2 := formatDate(colVal.To)
+			w.Byte('{')
+			w.KeyJSON(false, "from")
+			w.NullableStringJSON(from, ok1)
+			w.KeyJSON(true, "to")
+			w.NullableStringJSON(to, ok2)
+			w.Byte('}')
 		default:
-			_ = colVal
 			return fmt.Errorf("unsupported type %s", typ)
 		}
 	default:
@@ -416,6 +552,8 @@ func writeFieldJSONSchema(w *stickyBufferedWriter, typ reflect.Type, nullable bo
 		w.StringJSON("number")
 	case reflect.Struct:
 		switch reflect.New(typ).Elem().Interface().(type) {
+		case schema.ClockRange, schema.DateRange:
+			w.StringJSON("object")
 		default:
 			return fmt.Errorf("unsupported type %s", typ)
 		}
@@ -427,9 +565,54 @@ func writeFieldJSONSchema(w *stickyBufferedWriter, typ reflect.Type, nullable bo
 		w.StringJSON("null")
 		w.Byte(']')
 	}
+	if typ.Kind() == reflect.Struct {
+		switch reflect.New(typ).Elem().Interface().(type) {
+		case schema.ClockRange:
+			writeObjectJSONSchema(w,
+				"start", "start time (HH:MM), inclusive (null if not parsed)", "^[0-9]{2}:[0-9]{2}$",
+				"end", "end time (HH:MM), exclusive (null if not parsed)", "^[0-9]{2}:[0-9]{2}$",
+			)
+		case schema.DateRange:
+			writeObjectJSONSchema(w,
+				"from", "start date (YYYY-MM-DD), inclusive (null if not set or incomplete)", "^[0-9]{4}-[0-9]{2}-[0-9]{2}$",
+				"to", "end date (YYYY-MM-DD), inclusive (null if not set or incomplete)", "^[0-9]{4}-[0-9]{2}-[0-9]{2}$",
+			)
+		}
+	}
 	return w.Err()
 }
 
+// writeObjectJSONSchema writes the properties for an object with nullable
+// string properties, where kv is a sequence of name, doc, pattern.
+func writeObjectJSONSchema(w *stickyBufferedWriter, kv ...string) {
+	if len(kv)%3 != 0 {
+		panic("wtf")
+	}
+	w.KeyJSON(true, "properties")
+	w.Byte('{')
+	for i := 0; i < len(kv); i += 3 {
+		w.KeyJSON(i != 0, kv[i])
+		w.Byte('{')
+		w.KeyValueJSON(false, "description", kv[i+1])
+		w.KeyJSON(true, "type")
+		w.String(`["string","null"]`)
+		w.KeyValueJSON(true, "pattern", kv[i+2])
+		w.Byte('}')
+	}
+	w.Byte('}')
+	w.KeyJSON(true, "required")
+	w.Byte('[')
+	for i := 0; i < len(kv); i += 3 {
+		if i != 0 {
+			w.Byte(',')
+		}
+		w.StringJSON(kv[i])
+	}
+	w.Byte(']')
+	w.KeyJSON(true, "additionalProperties")
+	w.String("false")
+}
+
 func (w *stickyBufferedWriter) KeyJSON(comma bool, key string) {
 	if comma {
 		w.Byte(',')
@@ -455,6 +638,14 @@ func (w *stickyBufferedWriter) StringJSON(s string) {
 	w.Write(buf)
 }
 
+func (w *stickyBufferedWriter) NullableStringJSON(s string, ok bool) {
+	if ok {
+		w.StringJSON(s)
+	} else {
+		w.String("null")
+	}
+}
+
 func (w *stickyBufferedWriter) FloatJSON(v float64, bits int) {
 	w.Write(appendFloatJSON(w.AvailableBuffer(), v, bits))
 }
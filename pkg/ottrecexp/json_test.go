@@ -5,8 +5,11 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"reflect"
 	"testing"
+	"time"
 
+	"github.com/pgaskin/ottrec/schema"
 	"github.com/santhosh-tekuri/jsonschema/v6"
 )
 
@@ -51,12 +54,12 @@ func TestJSON(t *testing.T) {
 
 			switch data {
 			case EmptyData:
-				if sha := sha1sum(buf); sha != "e6b245bd98849b97d072131dba29bde97f5380b0" {
+				if sha := sha1sum(buf); sha != "6bd57696ea53fbfe55d41eb8bd295cf16d54f21c" {
 					logJSON(t, false, buf)
 					t.Errorf("incorrect output or outdated test (sha: %s)", sha)
 				}
 			case DummyData:
-				if sha := sha1sum(buf); sha != "a7d82d4b82eec3de7f62d4b4661eaf94dd8b291b" {
+				if sha := sha1sum(buf); sha != "c169e7aa66006bdc988f59d0517790c0e61e9878" {
 					logJSON(t, false, buf)
 					t.Errorf("incorrect output or outdated test (sha: %s)", sha)
 				}
@@ -85,6 +88,93 @@ func TestJSONSchema(t *testing.T) {
 	_ = sch
 }
 
+func TestFieldJSONRanges(t *testing.T) {
+	for _, tc := range []struct {
+		val any
+		exp string
+	}{
+		{schema.ClockRange{Start: schema.MakeClockTime(6, 0), End: schema.MakeClockTime(21, 30)}, `{"start":"06:00","end":"21:30"}`},
+		{schema.ClockRange{Start: -1, End: -1}, `{"start":null,"end":null}`},
+		{schema.DateRange{From: schema.MakeDate(2025, time.January, 2, -1), To: schema.MakeDate(2025, time.March, 4, -1)}, `{"from":"2025-01-02","to":"2025-03-04"}`},
+		{schema.DateRange{From: schema.MakeDate(0, time.January, 2, -1)}, `{"from":null,"to":null}`},
+	} {
+		var b bytes.Buffer
+		w := newStickyBufferedWriter(&b)
+		if err := writeFieldJSON(w, reflect.TypeOf(tc.val), reflect.ValueOf(tc.val)); err != nil {
+			t.Errorf("%#v: unexpected error: %v", tc.val, err)
+			continue
+		}
+		if act := b.String(); act != tc.exp {
+			t.Errorf("%#v: expected %s, got %s", tc.val, tc.exp, act)
+		}
+
+		b.Reset()
+		b.WriteString(`{"type":`)
+		if err := writeFieldJSONSchema(w, reflect.TypeOf(tc.val), true); err != nil {
+			t.Errorf("%#v: unexpected schema error: %v", tc.val, err)
+			continue
+		}
+		b.WriteString(`}`)
+		if !json.Valid(b.Bytes()) {
+			t.Errorf("%#v: invalid schema json %s", tc.val, b.String())
+		}
+	}
+}
+
+func TestJSONOmitUnstable(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteJSONWithOptions(DummyData, &b, JSONOptions{OmitUnstable: true}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	logJSON(t, true, b.Bytes())
+
+	if buf, err := catch1(JSONSchema); err == nil {
+		if sch, err := compileSchema(JSONSchemaID, buf); err == nil {
+			obj, err := jsonschema.UnmarshalJSON(bytes.NewReader(b.Bytes()))
+			if err != nil {
+				t.Fatalf("invalid json: %v", err)
+			}
+			if err := sch.Validate(obj); err != nil {
+				t.Fatalf("failed to validate json against schema: %v", err)
+			}
+		}
+	}
+
+	var obj struct {
+		UnstableFields map[string][]string `json:"unstableFields"`
+		Activity       []map[string]any    `json:"activity"`
+		HTML           []map[string]any    `json:"html"`
+	}
+	if err := json.Unmarshal(b.Bytes(), &obj); err != nil {
+		t.Fatalf("invalid json: %v", err)
+	}
+	for table, cols := range obj.UnstableFields {
+		if len(cols) != 0 {
+			t.Errorf("expected no unstable fields for %s, got %q", table, cols)
+		}
+	}
+	if len(obj.Activity) == 0 || len(obj.HTML) == 0 {
+		t.Fatalf("expected activities and html")
+	}
+	for _, row := range obj.Activity {
+		if _, ok := row["rawTime"]; ok {
+			t.Errorf("expected rawTime to be omitted")
+		}
+		if _, ok := row["name"]; !ok {
+			t.Errorf("expected name to be included")
+		}
+	}
+	for _, row := range obj.HTML {
+		if _, ok := row["id"]; ok {
+			t.Errorf("expected html id to be omitted")
+		}
+	}
+
+	if full := JSON(DummyData); len(b.Bytes()) >= len(full) {
+		t.Errorf("expected output to be smaller than the full export")
+	}
+}
+
 func compileSchema(url string, buf []byte) (*jsonschema.Schema, error) {
 	obj, err := jsonschema.UnmarshalJSON(bytes.NewReader(buf))
 	if err != nil {
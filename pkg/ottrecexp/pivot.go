@@ -0,0 +1,95 @@
+package ottrecexp
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"time"
+)
+
+// WritePivotCSV writes a human-readable pivot of the activity table as CSV,
+// with a row for each activity in each schedule group and date range at each
+// facility, and a column containing the comma-separated time ranges for each
+// weekday. Activities for a single date, or where the weekday could not be
+// parsed, are not included. If a time range could not be parsed, the raw time
+// is used instead.
+func WritePivotCSV(x *Data, w io.Writer) error {
+	type pivotKey struct {
+		FacilityURL   string
+		StartDate     string
+		EndDate       string
+		ScheduleGroup string
+		Name          string
+	}
+	var (
+		keys  []pivotKey
+		cells = map[pivotKey]*[7][]string{}
+	)
+	for _, a := range x.Activity {
+		wd := slices.IndexFunc(pivotWeekdays[:], func(w string) bool {
+			return a.Weekday == w
+		})
+		if wd == -1 {
+			continue
+		}
+		k := pivotKey{
+			FacilityURL:   a.FacilityURL,
+			StartDate:     a.StartDate,
+			EndDate:       a.EndDate,
+			ScheduleGroup: a.ScheduleGroup,
+			Name:          a.Name,
+		}
+		c, ok := cells[k]
+		if !ok {
+			c = new([7][]string)
+			cells[k] = c
+			keys = append(keys, k)
+		}
+		tm := a.RawTime
+		if a.StartTime != "" && a.EndTime != "" {
+			tm = a.StartTime + "-" + a.EndTime
+		}
+		if !slices.Contains(c[wd], tm) {
+			c[wd] = append(c[wd], tm)
+		}
+	}
+
+	bw := newStickyBufferedWriter(w)
+	row := func(cols ...string) {
+		for i, col := range cols {
+			bw.StringCSV(i != 0, col)
+		}
+		if crlfCSV {
+			bw.Byte('\r')
+		}
+		bw.Byte('\n')
+	}
+	row(slices.Concat([]string{
+		"facility_url",
+		"activity_date_start",
+		"activity_date_end",
+		"activity_group",
+		"activity_name",
+	}, pivotWeekdays[:])...)
+	for _, k := range keys {
+		cols := []string{
+			k.FacilityURL,
+			k.StartDate,
+			k.EndDate,
+			k.ScheduleGroup,
+			k.Name,
+		}
+		for _, tms := range cells[k] {
+			cols = append(cols, strings.Join(tms, ", "))
+		}
+		row(cols...)
+	}
+	return bw.Flush()
+}
+
+var pivotWeekdays = func() (wd [7]string) {
+	for i := range wd {
+		wd[i] = strings.ToLower(time.Weekday(i).String())
+	}
+	return
+}()
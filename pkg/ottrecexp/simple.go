@@ -6,13 +6,23 @@ package ottrecexp
 import (
 	"bufio"
 	"bytes"
+	"fmt"
 	"io"
+	"reflect"
+	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/pgaskin/ottrec-website/pkg/ottrecidx"
+	"github.com/pgaskin/ottrec/schema"
 )
 
+// SchemaVersion is the version of the simplified dataset schema. It must be
+// incremented whenever tables or columns are added, removed, or changed.
+//
+//   - 1: versioned schema (facility description, activity schedule group)
+const SchemaVersion = 1
+
 type Table[T Row] []*T
 
 type Row interface {
@@ -32,6 +42,7 @@ type Facility struct {
 	ScrapedAt         string  `sjson:"scrapedAt" scsv:"facility_scraped_at" doc:"date (YYYY-MM-DD) the date for the facility was scraped at" pattern:"^[0-9]{4}-[0-9]{2}-[0-9]{2}$"`
 	Name              string  `sjson:"name" scsv:"facility_name" doc:"name of the facility"`
 	Address           string  `sjson:"address" scsv:"facility_address" doc:"the address of the facility"`
+	Description       string  `sjson:"description" scsv:"facility_description" doc:"description of the facility (may be empty)"`
 	Longitude         float32 `sjson:"longitude,nullzero" scsv:"facility_longitude,emptyzero" doc:"facility longitude (may not be set if geocoding failed)"`
 	Latitude          float32 `sjson:"latitude,nullzero" scsv:"facility_latitude,emptyzero" doc:"facility latitude (may not be set if geocoding failed)"`
 	SpecialHoursHTML  int     `sjson:"specialHoursHtmlId" scsv:"facility_special_hours_html_id" doc:"html for special hours"`
@@ -41,21 +52,24 @@ type Facility struct {
 type Activity struct {
 	FacilityURL string `sjson:"facilityUrl" scsv:"facility_url" doc:"facility url for the activity"`
 
-	StartDate           string   `sjson:"startDate,nullzero" scsv:"activity_date_start,emptyzero" doc:"start date (YYYY-MM-DD), inclusive (may not be set if parsing failed or there's no range)" pattern:"^[0-9]{4}-[0-9]{2}-[0-9]{2}$"`
-	EndDate             string   `sjson:"endDate,nullzero" scsv:"activity_date_end,emptyzero" doc:"end date (YYYY-MM-DD), inclusive (may not be set if parsing failed or there's no range)" pattern:"^[0-9]{4}-[0-9]{2}-[0-9]{2}$"`
+	StartDate           string   `sjson:"startDate,nullzero" scsv:"activity_date_start,emptyzero" doc:"start date (YYYY-MM-DD), inclusive (may not be set if parsing failed or there's no range, or may be the single date if the range is ambiguous)" pattern:"^[0-9]{4}-[0-9]{2}-[0-9]{2}$"`
+	EndDate             string   `sjson:"endDate,nullzero" scsv:"activity_date_end,emptyzero" doc:"end date (YYYY-MM-DD), inclusive (may not be set if parsing failed or there's no range, or may be the single date if the range is ambiguous)" pattern:"^[0-9]{4}-[0-9]{2}-[0-9]{2}$"`
 	Weekday             string   `sjson:"weekday,nullzero" scsv:"activity_weekday,emptyzero" doc:"weekday (lowercase, long-form) or single date (YYYY-MM-DD) (may not be set if parsing failed)" pattern:"^(sunday|monday|tuesday|wednesday|thursday|friday|saturday|[0-9]{4}-[0-9]{2}-[0-9]{2})$"`
 	StartTime           string   `sjson:"startTime,nullzero" scsv:"activity_time_start,emptyzero" doc:"start time (HH:MM), inclusive (may not be set if parsing failed)" pattern:"^[0-9]{2}:[0-9]{2}$"`
 	EndTime             string   `sjson:"endTime,nullzero" scsv:"activity_time_end,emptyzero" doc:"end time (HH:MM), exclusive (may not be set if parsing failed)" pattern:"^[0-9]{2}:[0-9]{2}$"`
 	Name                string   `sjson:"name" scsv:"activity_name" doc:"activity name, normalized"`
+	ScheduleGroup       string   `sjson:"scheduleGroup" scsv:"activity_group" doc:"schedule group title, cleaned up (see rawScheduleGroup for the original label)"`
 	ReservationRequired bool     `sjson:"reservationRequired" scsv:"activity_reservation_required" doc:"whether reservation is required, best-effort"`
-	ReservationLinks    []string `sjson:"reservationLinks" scsv:"activity_reservation_links" doc:"reservation urls (comma-separated for csv)"`
+	ReservationDefinite bool     `sjson:"reservationDefinite" scsv:"activity_reservation_definite" doc:"whether reservationRequired was explicitly specified rather than guessed"`
+	ReservationLinks    []string `sjson:"reservationLinks" scsv:"activity_reservation_links" doc:"reservation urls, deduplicated (comma-separated for csv)"`
+	ReservationLabels   []string `sjson:"reservationLabels" scsv:"activity_reservation_labels" doc:"reservation link labels, corresponding to reservationLinks (comma-separated for csv)"`
 	ExceptionsHTML      int      `sjson:"exceptionsHtmlId" scsv:"activity_exceptions_html_id" doc:"html for schedule exceptions"`
 
-	RawScheduleGroup string `sjson:"rawScheduleGroup" scsv:"activity_raw_group" doc:"raw schedule group text (this field is not stable)"`
-	RawSchedule      string `sjson:"rawSchedule" scsv:"activity_raw_schedule" doc:"raw schedule caption text (this field is not stable)"`
-	RawDay           string `sjson:"rawDay" scsv:"activity_raw_day" doc:"raw schedule activity day (this field is not stable)"`
-	RawActivity      string `sjson:"rawActivity" scsv:"activity_raw_activity" doc:"raw schedule activity label (this field is not stable)"`
-	RawTime          string `sjson:"rawTime" scsv:"activity_raw_time" doc:"raw schedule activity time (this field is not stable)"`
+	RawScheduleGroup string `sjson:"rawScheduleGroup" scsv:"activity_raw_group" doc:"raw schedule group text (this field is not stable)" stable:"false"`
+	RawSchedule      string `sjson:"rawSchedule" scsv:"activity_raw_schedule" doc:"raw schedule caption text (this field is not stable)" stable:"false"`
+	RawDay           string `sjson:"rawDay" scsv:"activity_raw_day" doc:"raw schedule activity day (this field is not stable)" stable:"false"`
+	RawActivity      string `sjson:"rawActivity" scsv:"activity_raw_activity" doc:"raw schedule activity label (this field is not stable)" stable:"false"`
+	RawTime          string `sjson:"rawTime" scsv:"activity_raw_time" doc:"raw schedule activity time (this field is not stable)" stable:"false"`
 }
 
 type Error struct {
@@ -64,7 +78,7 @@ type Error struct {
 }
 
 type HTML struct {
-	ID   int    `sjson:"id" scsv:"id" doc:"index for cross-referencing, not stable"`
+	ID   int    `sjson:"id" scsv:"id" doc:"index for cross-referencing, not stable" stable:"false"`
 	HTML string `sjson:"html" scsv:"html" doc:"raw html"` // note: 0th is always the empty string
 }
 
@@ -74,6 +88,38 @@ type Attribution struct {
 
 const dateFormat = "2006-01-02"
 
+// isStable checks the stable tag of a column, which defaults to true.
+func isStable(f reflect.StructField) (bool, error) {
+	tag, ok := f.Tag.Lookup("stable")
+	if !ok {
+		return true, nil
+	}
+	v, err := strconv.ParseBool(tag)
+	if err != nil {
+		return false, fmt.Errorf("invalid stable tag %q", tag)
+	}
+	return v, nil
+}
+
+// formatDate formats d as YYYY-MM-DD if it is a complete date.
+func formatDate(d schema.Date) (string, bool) {
+	year, ok1 := d.Year()
+	month, ok2 := d.Month()
+	day, ok3 := d.Day()
+	if !ok1 || !ok2 || !ok3 {
+		return "", false
+	}
+	return fmt.Sprintf("%04d-%02d-%02d", year, month, day), true
+}
+
+// formatClockTime formats t as HH:MM if it is valid.
+func formatClockTime(t schema.ClockTime) (string, bool) {
+	if !t.IsValid() {
+		return "", false
+	}
+	return t.Format(false), true
+}
+
 func New(data ottrecidx.DataRef) (*Data, error) {
 	result := &Data{
 		Facility: make([]*Facility, 0, data.Facilities().Len()),
@@ -98,6 +144,7 @@ func New(data ottrecidx.DataRef) (*Data, error) {
 		}
 		rf.Name = fac.GetName()
 		rf.Address = strings.ReplaceAll(fac.GetAddress(), "\n", ", ")
+		rf.Description = fac.GetDescription()
 		if lng, lat, ok := fac.GetLngLat(); ok {
 			rf.Longitude = lng
 			rf.Latitude = lat
@@ -124,6 +171,9 @@ func New(data ottrecidx.DataRef) (*Data, error) {
 				if !to.IsZero() {
 					ra.EndDate = to.Format(dateFormat)
 				}
+			} else if d, ok := tm.SingleDate(); ok {
+				ra.StartDate = d.Format(dateFormat)
+				ra.EndDate = ra.StartDate
 			}
 			if d, ok := tm.SingleDate(); ok {
 				ra.Weekday = d.Format(dateFormat)
@@ -139,11 +189,17 @@ func New(data ottrecidx.DataRef) (*Data, error) {
 				}
 			}
 			ra.Name = tm.Activity().GetName()
-			if r, _ := tm.Activity().GuessReservationRequirement(); r {
+			ra.ScheduleGroup = tm.ScheduleGroup().GetTitle()
+			r, definite := tm.Activity().GuessReservationRequirement()
+			ra.ReservationDefinite = definite
+			if r {
 				ra.ReservationRequired = true
 				for lnk := range tm.ScheduleGroup().GetReservationLinks() {
 					if lnk.URL != "" {
-						ra.ReservationLinks = append(ra.ReservationLinks, strings.ReplaceAll(lnk.URL, ",", "%2C"))
+						if u := strings.ReplaceAll(lnk.URL, ",", "%2C"); !slices.Contains(ra.ReservationLinks, u) {
+							ra.ReservationLinks = append(ra.ReservationLinks, u)
+							ra.ReservationLabels = append(ra.ReservationLabels, strings.ReplaceAll(lnk.Label, ",", "%2C"))
+						}
 					}
 				}
 			}
@@ -160,11 +216,28 @@ func New(data ottrecidx.DataRef) (*Data, error) {
 		result.Facility = append(result.Facility, &rf)
 	}
 	for attrib := range data.GetAttribution() {
-		result.Attribution = append(result.Attribution, &Attribution{attrib})
+		if attrib != "" {
+			result.Attribution = append(result.Attribution, &Attribution{attrib})
+		}
+	}
+	if len(result.Attribution) == 0 {
+		return nil, fmt.Errorf("missing attribution")
 	}
 	return result, nil
 }
 
+// AttributionText returns the attribution text joined by newlines.
+func (d *Data) AttributionText() string {
+	var b strings.Builder
+	for i, a := range d.Attribution {
+		if i != 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(a.Text)
+	}
+	return b.String()
+}
+
 type stickyBufferedWriter struct {
 	w interface {
 		Write([]byte) (int, error)
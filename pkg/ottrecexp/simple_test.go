@@ -46,7 +46,9 @@ var DummyData = &Data{
 		EndTime:             "23:59",
 		Name:                "DummyName",
 		ReservationRequired: true,
+		ReservationDefinite: true,
 		ReservationLinks:    []string{"DummyReservationLink1", "DummyReservationLink2"},
+		ReservationLabels:   []string{"DummyReservationLabel1", "DummyReservationLabel2"},
 		ExceptionsHTML:      3,
 		RawScheduleGroup:    "DummyRawScheduleGroup",
 		RawSchedule:         "DummyRawSchedule",
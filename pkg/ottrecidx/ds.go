@@ -176,6 +176,52 @@ func (dst *bitmap[T]) Remove(v T) {
 	dst.kbmut().Remove(uint32(v))
 }
 
+// SetRange sets start <= v < end, growing the bitmap if required.
+func (dst *bitmap[T]) SetRange(start, end T) {
+	if start >= end {
+		return
+	}
+	dst.kbmut().Grow(uint32(end - 1))
+	var (
+		startBlk, startBit = int(start >> 6), start & 63
+		endBlk, endBit     = int(end >> 6), end & 63
+	)
+	if startBlk == endBlk {
+		dst.kb[startBlk] |= (1<<(endBit-startBit) - 1) << startBit
+		return
+	}
+	dst.kb[startBlk] |= ^uint64(0) << startBit
+	for i := startBlk + 1; i < endBlk; i++ {
+		dst.kb[i] = ^uint64(0)
+	}
+	if endBit != 0 {
+		dst.kb[endBlk] |= 1<<endBit - 1
+	}
+}
+
+// RemoveRange clears start <= v < end.
+func (dst *bitmap[T]) RemoveRange(start, end T) {
+	if end > T(len(dst.kb)<<6) {
+		end = T(len(dst.kb) << 6)
+	}
+	if start >= end {
+		return
+	}
+	var (
+		startBlk, startBit = int(start >> 6), start & 63
+		endBlk, endBit     = int(end >> 6), end & 63
+	)
+	if startBlk == endBlk {
+		dst.kb[startBlk] &^= (1<<(endBit-startBit) - 1) << startBit
+		return
+	}
+	dst.kb[startBlk] &^= ^uint64(0) << startBit
+	clear(dst.kb[startBlk+1 : endBlk])
+	if endBit != 0 {
+		dst.kb[endBlk] &^= 1<<endBit - 1
+	}
+}
+
 func (dst *bitmap[T]) Ones() {
 	dst.kbmut().Ones()
 }
@@ -188,6 +234,19 @@ func (dst *bitmap[T]) And(other bitmap[T], extra ...bitmap[T]) {
 	dst.kbmut().And(other.kb, kbs(extra...)...)
 }
 
+// AndNot clears the bits in dst which are set in any of the other bitmaps.
+func (dst *bitmap[T]) AndNot(other bitmap[T], extra ...bitmap[T]) {
+	dst.kbmut().AndNot(other.kb, kbs(extra...)...)
+}
+
+// bitmapDifference returns a newly allocated bitmap with the bits in a which are not
+// set in any of the other bitmaps.
+func bitmapDifference[T ~uint32](a bitmap[T], other bitmap[T], extra ...bitmap[T]) bitmap[T] {
+	b := a.Clone(nil)
+	b.AndNot(other, extra...)
+	return b
+}
+
 func (dst bitmap[T]) Count() int {
 	return dst.kb.Count()
 }
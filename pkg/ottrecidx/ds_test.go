@@ -0,0 +1,63 @@
+package ottrecidx
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestBitmapDifference(t *testing.T) {
+	a := makeBitmap[refObj](200)
+	for _, v := range []refObj{1, 2, 3, 64, 65, 130, 199} {
+		a.Set(v)
+	}
+	b := makeBitmap[refObj](200)
+	for _, v := range []refObj{2, 64, 199} {
+		b.Set(v)
+	}
+	c := makeBitmap[refObj](200)
+	c.Set(130)
+
+	d := bitmapDifference(a, b, c)
+	if v, exp := slices.Collect(d.Range()), []refObj{1, 3, 65}; !slices.Equal(v, exp) {
+		t.Errorf("expected %v, got %v", exp, v)
+	}
+	if n := a.Count(); n != 7 {
+		t.Errorf("expected original bitmap to be unchanged, got %d bits", n)
+	}
+
+	a.AndNot(b)
+	if v, exp := slices.Collect(a.Range()), []refObj{1, 3, 65, 130}; !slices.Equal(v, exp) {
+		t.Errorf("expected %v, got %v", exp, v)
+	}
+}
+
+func TestBitmapRemoveRange(t *testing.T) {
+	for _, r := range [][2]refObj{
+		{0, 0}, {0, 1}, {5, 6}, {3, 60}, {0, 64}, {63, 65}, {10, 130}, {64, 128}, {100, 300}, {250, 300},
+	} {
+		a := makeBitmap[refObj](200)
+		a.Ones()
+		a.RemoveRange(r[0], r[1])
+		for v := refObj(0); v < refObj(len(a.kb)<<6); v++ {
+			if exp := v < r[0] || v >= r[1]; a.Contains(v) != exp {
+				t.Errorf("range [%d, %d): bit %d: expected %t", r[0], r[1], v, exp)
+				break
+			}
+		}
+	}
+}
+
+func TestBitmapSetRange(t *testing.T) {
+	for _, r := range [][2]refObj{
+		{0, 0}, {0, 1}, {5, 6}, {3, 60}, {0, 64}, {63, 65}, {10, 130}, {64, 128}, {100, 200}, {190, 200},
+	} {
+		a := makeBitmap[refObj](200)
+		a.SetRange(r[0], r[1])
+		for v := refObj(0); v < refObj(len(a.kb)<<6); v++ {
+			if exp := v >= r[0] && v < r[1]; a.Contains(v) != exp {
+				t.Errorf("range [%d, %d): bit %d: expected %t", r[0], r[1], v, exp)
+				break
+			}
+		}
+	}
+}
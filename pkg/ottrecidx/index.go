@@ -5,6 +5,9 @@ package ottrecidx
 import (
 	"crypto/sha1"
 	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
 	"iter"
 	"slices"
 	"time"
@@ -13,11 +16,12 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
-// TODO: unit tests
 // TODO: test round-trip back to protobuf
 
 // this file contains the main index logic
 
+// TZ is the time zone schedule dates and times are interpreted in. It defaults
+// to America/Toronto, and may be changed before any data is indexed.
 var TZ *time.Location
 
 func init() {
@@ -31,6 +35,13 @@ func init() {
 // Indexer contains shared memory for indexed data. It is not safe for
 // concurrent use (but the indexed schedules are).
 type Indexer struct {
+	// SkipPrecompute skips precomputing derived fields (e.g.,
+	// [ActivityRef.GuessReservationRequirement] and
+	// [ScheduleRef.ComputeEffectiveDateRange]) while indexing. They will be
+	// computed on-the-fly instead, which is slower if they are used a lot. This
+	// does not affect data which has already been loaded by the indexer.
+	SkipPrecompute bool
+
 	idx map[string]*Index
 
 	// most of the interning logic is quadratic complexity, but it isn't a big
@@ -45,6 +56,7 @@ type Indexer struct {
 	//	- 150 Index{hash:ND4ZTKUS obj:3687 scan:59.834µs import:22ms precompute:1ms dataUpdated:2025-05-20}
 	//	- 191 Index{hash:HONIS5GL obj:4148 scan:62.8µs import:11ms precompute:1ms dataUpdated:2025-04-14}
 	init bool
+	buf  []byte // reused by LoadReader
 	a    *arena              // this had 34946608 bytes (raw protobufs were 37376209 bytes, in-memory was more) over 2 chunks (ratio 0.016)
 	sa   stringInterner      // this had 406524 bytes over 2 chunks (ratio 0.020)
 	act  interner[xActivity] // this had 533 items (ratio 0.005)
@@ -98,6 +110,75 @@ type Index struct {
 // complexity, as the indexer focuses on optimizing memory usage and read-only
 // queries.
 func (dxr *Indexer) Load(pb []byte) (*Index, error) {
+	sum := sha1.Sum(pb)
+	return dxr.load(sum, pb)
+}
+
+// LoadReader is like Load, but reads the protobuf from r into a buffer which is
+// reused between calls. If size is not -1, it must be the exact length of the
+// data.
+func (dxr *Indexer) LoadReader(r io.Reader, size int64) (*Index, error) {
+	h := sha1.New()
+	r = io.TeeReader(r, h)
+
+	buf := dxr.buf[:0]
+	if size >= 0 {
+		buf = slices.Grow(buf, int(size))[:size]
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if n, _ := r.Read(make([]byte, 1)); n != 0 {
+			return nil, fmt.Errorf("data is longer than expected size %d", size)
+		}
+	} else {
+		for {
+			buf = slices.Grow(buf, 512)
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	dxr.buf = buf
+
+	var sum [sha1.Size]byte
+	h.Sum(sum[:0])
+	return dxr.load(sum, buf)
+}
+
+// LoadFiltered is like Load, but only indexes the facilities (and their
+// schedule groups, schedules, activities, and times) for which keep returns
+// true, which reduces memory usage if only some facilities are needed. The
+// facility must not be modified by keep. Since the index doesn't contain all
+// of the data, [Index.Hash] is computed from the filtered protobuf instead.
+func (dxr *Indexer) LoadFiltered(pb []byte, keep func(*schema.Facility) bool) (*Index, error) {
+	var msg schema.Data
+	if err := proto.Unmarshal(pb, &msg); err != nil {
+		return nil, err
+	}
+	msg.SetFacilities(slices.DeleteFunc(msg.GetFacilities(), func(fac *schema.Facility) bool {
+		return !keep(fac)
+	}))
+	fpb, err := proto.MarshalOptions{Deterministic: true}.Marshal(&msg)
+	if err != nil {
+		return nil, fmt.Errorf("marshal filtered data: %w", err)
+	}
+	dxr.lazyInit()
+	sum := sha1.Sum(fpb)
+	hash := base32.StdEncoding.EncodeToString(sum[:])
+	idx, ok := dxr.idx[hash]
+	if !ok {
+		idx = dxr.index(hash, &msg)
+		dxr.idx[hash] = idx
+	}
+	return idx, nil
+}
+
+func (dxr *Indexer) lazyInit() {
 	if !dxr.init {
 		dxr.idx = make(map[string]*Index)
 		dxr.a = newArena()
@@ -105,7 +186,10 @@ func (dxr *Indexer) Load(pb []byte) (*Index, error) {
 		dxr.sa.Cache(4096)
 		dxr.init = true
 	}
-	sum := sha1.Sum(pb)
+}
+
+func (dxr *Indexer) load(sum [sha1.Size]byte, pb []byte) (*Index, error) {
+	dxr.lazyInit()
 	hash := base32.StdEncoding.EncodeToString(sum[:])
 	idx, ok := dxr.idx[hash]
 	if !ok {
@@ -166,12 +250,14 @@ func (dxr *Indexer) index(hash string, data *schema.Data) *Index {
 		bActivityNotChild:      makeBitmap[refObj](n),
 		bTimeNotChild:          makeBitmap[refObj](n),
 
-		cached_ActivityRef_GuessReservationRequirement_required: makeBitmap[refObj](n),
-		cached_ActivityRef_GuessReservationRequirement_definite: makeBitmap[refObj](n),
+	}
+	if !dxr.SkipPrecompute {
+		idx.cached_ActivityRef_GuessReservationRequirement_required = makeBitmap[refObj](n)
+		idx.cached_ActivityRef_GuessReservationRequirement_definite = makeBitmap[refObj](n)
 
-		cached_ScheduleRef_ComputeEffectiveDateRange_from: make([]time.Time, nSch),
-		cached_ScheduleRef_ComputeEffectiveDateRange_to:   make([]time.Time, nSch),
-		cached_ScheduleRef_ComputeEffectiveDateRange_ok:   makeBitmap[refObj](n),
+		idx.cached_ScheduleRef_ComputeEffectiveDateRange_from = make([]time.Time, nSch)
+		idx.cached_ScheduleRef_ComputeEffectiveDateRange_to = make([]time.Time, nSch)
+		idx.cached_ScheduleRef_ComputeEffectiveDateRange_ok = makeBitmap[refObj](n)
 	}
 
 	idx.durScan, now = time.Since(now), time.Now()
@@ -205,33 +291,39 @@ func (dxr *Indexer) index(hash string, data *schema.Data) *Index {
 	idx.durImport, now = time.Since(now), time.Now()
 
 	if enableIndexerSanityCheck {
-		sanityCheck(idx, n)
-		sanityCheck1(idx, data)
+		if err := sanityCheck(idx, n); err != nil {
+			panic("wtf: " + err.Error())
+		}
+		if err := sanityCheck1(idx, data); err != nil {
+			panic("wtf: " + err.Error())
+		}
 
 		idx.durSanityCheck, now = time.Since(now), time.Now()
 	}
 
-	for act := range idx.Data().Activities() {
-		required, definite := act.GuessReservationRequirement()
-		if required {
-			idx.cached_ActivityRef_GuessReservationRequirement_required.Set(act.object())
-		}
-		if definite {
-			idx.cached_ActivityRef_GuessReservationRequirement_definite.Set(act.object())
+	if !dxr.SkipPrecompute {
+		for act := range idx.Data().Activities() {
+			required, definite := act.GuessReservationRequirement()
+			if required {
+				idx.cached_ActivityRef_GuessReservationRequirement_required.Set(act.object())
+			}
+			if definite {
+				idx.cached_ActivityRef_GuessReservationRequirement_definite.Set(act.object())
+			}
 		}
-	}
-	idx.cached_ActivityRef_GuessReservationRequirement = true
+		idx.cached_ActivityRef_GuessReservationRequirement = true
 
-	for act := range idx.Data().Schedules() {
-		i := act.nthOfType()
-		from, to, ok := act.ComputeEffectiveDateRange()
-		idx.cached_ScheduleRef_ComputeEffectiveDateRange_from[i] = from
-		idx.cached_ScheduleRef_ComputeEffectiveDateRange_to[i] = to
-		if ok {
-			idx.cached_ScheduleRef_ComputeEffectiveDateRange_ok.Set(act.object())
+		for act := range idx.Data().Schedules() {
+			i := act.nthOfType()
+			from, to, ok := act.ComputeEffectiveDateRange()
+			idx.cached_ScheduleRef_ComputeEffectiveDateRange_from[i] = from
+			idx.cached_ScheduleRef_ComputeEffectiveDateRange_to[i] = to
+			if ok {
+				idx.cached_ScheduleRef_ComputeEffectiveDateRange_ok.Set(act.object())
+			}
 		}
+		idx.cached_ScheduleRef_ComputeEffectiveDateRange = true
 	}
-	idx.cached_ScheduleRef_ComputeEffectiveDateRange = true
 
 	for fac := range idx.Data().Facilities() {
 		if d := fac.GetSourceDate(); !d.IsZero() && d.After(idx.updated) {
@@ -241,7 +333,7 @@ func (dxr *Indexer) index(hash string, data *schema.Data) *Index {
 
 	idx.durPrecompute, now = time.Since(now), time.Now()
 
-	if enableIndexerSanityCheck {
+	if enableIndexerSanityCheck && !dxr.SkipPrecompute {
 		sanityCheck2(idx)
 
 		idx.durSanityCheck += time.Since(now)
@@ -275,7 +367,8 @@ func (idx *Index) Data() DataRef {
 	}
 }
 
-// Hash returns an ASCII string representing a hash of the raw protobuf.
+// Hash returns an ASCII string representing a hash of the raw protobuf (or the
+// filtered one for [Indexer.LoadFiltered]).
 func (idx *Index) Hash() string {
 	return idx.hash
 }
@@ -286,15 +379,65 @@ func (idx *Index) Updated() time.Time {
 	return idx.updated
 }
 
-func sanityCheck(idx *Index, n int) {
+// IndexStats contains statistics about an [Index].
+type IndexStats struct {
+	Hash    string
+	Updated time.Time
+
+	Objects        int
+	Facilities     int
+	ScheduleGroups int
+	Schedules      int
+	Activities     int
+	Times          int
+
+	DurScan        time.Duration
+	DurImport      time.Duration
+	DurSanityCheck time.Duration // zero if sanity checks are disabled
+	DurPrecompute  time.Duration
+}
+
+// Stats returns statistics about the index.
+func (idx *Index) Stats() IndexStats {
+	return IndexStats{
+		Hash:           idx.hash,
+		Updated:        idx.updated,
+		Objects:        len(idx.obj),
+		Facilities:     idx.bFacility.Count(),
+		ScheduleGroups: idx.bScheduleGroup.Count(),
+		Schedules:      idx.bSchedule.Count(),
+		Activities:     idx.bActivity.Count(),
+		Times:          idx.bTime.Count(),
+		DurScan:        idx.durScan,
+		DurImport:      idx.durImport,
+		DurSanityCheck: idx.durSanityCheck,
+		DurPrecompute:  idx.durPrecompute,
+	}
+}
+
+// Verify checks the structural invariants of the index, returning an error if
+// any are violated. This should never fail unless there are bugs in the
+// indexer. It does not check the precomputed values since that requires
+// temporarily modifying the index.
+func (idx *Index) Verify() error {
+	if err := sanityCheck(idx, len(idx.obj)); err != nil {
+		return err
+	}
+	if err := sanityCheck1(idx, nil); err != nil {
+		return err
+	}
+	return nil
+}
+
+func sanityCheck(idx *Index, n int) error {
 	if !idx.bData.Contains(0) {
-		panic("wtf: xData must be the 0th item")
+		return errors.New("xData must be the 0th item")
 	}
 	if idx.bData.Count() != 1 {
-		panic("wtf: there must only be one xData")
+		return errors.New("there must only be one xData")
 	}
 	if len(idx.obj) != n {
-		panic("wtf: the object array must be the expected size")
+		return errors.New("the object array must be the expected size")
 	}
 	var (
 		total int
@@ -305,117 +448,128 @@ func sanityCheck(idx *Index, n int) {
 		total += bm.Count()
 		all.Or(bm)
 		if len(bm.kb) != len(all.kb) {
-			panic("wtf: the bitmaps should not have grown (which would happen if a bit out of range was manipulated)")
+			return errors.New("the bitmaps should not have grown (which would happen if a bit out of range was manipulated)")
 		}
 	}
 	if total != n {
-		panic("wtf: the total number of bits set must equal the number of objects")
+		return errors.New("the total number of bits set must equal the number of objects")
 	}
 	if all.Count() != n {
-		panic("wtf: every bit should be set in exactly one bitmap")
+		return errors.New("every bit should be set in exactly one bitmap")
 	}
+	return nil
 }
 
-func sanityCheck1(idx *Index, data *schema.Data) {
-	req := func(a ...anyRef) {
-		if slices.ContainsFunc(a, func(b anyRef) bool {
+// sanityCheck1 checks the consistency of the index references. If data is
+// nil, the counts are checked against the index bitmaps instead.
+func sanityCheck1(idx *Index, data *schema.Data) error {
+	var err error
+	req := func(what string, a ...anyRef) {
+		if err == nil && slices.ContainsFunc(a, func(b anyRef) bool {
 			ar, br := a[0].reflect(), b.reflect()
 			eq := ar.idx == br.idx && slices.Equal(ar.flt.kb, br.flt.kb) && ar.obj == br.obj
 			return !eq
 		}) {
-			panic("wtf")
+			err = fmt.Errorf("inconsistent %s parent refs", what)
 		}
 	}
-	ieq := func(a ...int) {
-		if slices.ContainsFunc(a, func(b int) bool {
+	ieq := func(what string, a ...int) {
+		if err == nil && slices.ContainsFunc(a, func(b int) bool {
 			return a[0] != b
 		}) {
-			panic("wtf")
+			err = fmt.Errorf("inconsistent %s count %v", what, a)
+		}
+	}
+	nth := func(what string, a, b int) {
+		if err == nil && a != b {
+			err = fmt.Errorf("%s has index %d within its type, expected %d", what, a, b)
 		}
 	}
 	var nfac, ngrp, nsch, nact, ntm int
-	for _, fac := range data.GetFacilities() {
-		nfac++
-		for _, grp := range fac.GetScheduleGroups() {
-			ngrp++
-			for _, sch := range grp.GetSchedules() {
-				nsch++
-				for _, act := range sch.GetActivities() {
-					nact++
-					for _, day := range act.GetDays() {
-						for range day.GetTimes() {
-							ntm++
+	if data != nil {
+		for _, fac := range data.GetFacilities() {
+			nfac++
+			for _, grp := range fac.GetScheduleGroups() {
+				ngrp++
+				for _, sch := range grp.GetSchedules() {
+					nsch++
+					for _, act := range sch.GetActivities() {
+						nact++
+						for _, day := range act.GetDays() {
+							for range day.GetTimes() {
+								ntm++
+							}
 						}
 					}
 				}
 			}
 		}
+	} else {
+		nfac = idx.bFacility.Count()
+		ngrp = idx.bScheduleGroup.Count()
+		nsch = idx.bSchedule.Count()
+		nact = idx.bActivity.Count()
+		ntm = idx.bTime.Count()
 	}
 	var dat_fac, dat_grp, dat_sch, dat_act, dat_tm int
 	dat := idx.Data()
 	for fac := range dat.Facilities() {
-		if fac.nthOfType() != dat_fac {
-			panic("wtf")
-		}
+		nth("facility", fac.nthOfType(), dat_fac)
 		dat_fac++
 		var fac_grp, fac_sch, fac_act, fac_tm int
 		for grp := range fac.ScheduleGroups() {
-			if grp.nthOfType() != dat_grp {
-				panic("wtf")
-			}
+			nth("schedule group", grp.nthOfType(), dat_grp)
 			dat_grp++
 			fac_grp++
 			var grp_sch, grp_act, grp_tm int
 			for sch := range grp.Schedules() {
-				if sch.nthOfType() != dat_sch {
-					panic("wtf")
-				}
+				nth("schedule", sch.nthOfType(), dat_sch)
 				dat_sch++
 				fac_sch++
 				grp_sch++
 				var sch_act, sch_tm int
 				for act := range sch.Activities() {
-					if act.nthOfType() != dat_act {
-						panic("wtf")
-					}
+					nth("activity", act.nthOfType(), dat_act)
 					dat_act++
 					fac_act++
 					grp_act++
 					sch_act++
 					for tm := range act.Times() {
-						if tm.nthOfType() != dat_tm {
-							panic("wtf")
-						}
+						nth("time", tm.nthOfType(), dat_tm)
 						dat_tm++
 						fac_tm++
 						grp_tm++
 						sch_tm++
 						// ensure parents are all consistently resolved
-						req(act, tm.Activity())
-						req(sch, act.Schedule(), tm.Schedule())
-						req(grp, sch.ScheduleGroup(), act.ScheduleGroup(), tm.ScheduleGroup())
-						req(fac, grp.Facility(), sch.Facility(), act.Facility(), tm.Facility())
-						req(dat, fac.Data(), grp.Data(), sch.Data(), act.Data(), tm.Data())
+						req("activity", act, tm.Activity())
+						req("schedule", sch, act.Schedule(), tm.Schedule())
+						req("schedule group", grp, sch.ScheduleGroup(), act.ScheduleGroup(), tm.ScheduleGroup())
+						req("facility", fac, grp.Facility(), sch.Facility(), act.Facility(), tm.Facility())
+						req("data", dat, fac.Data(), grp.Data(), sch.Data(), act.Data(), tm.Data())
 					}
 				}
 				// ensure iterating over skipped levels are consistent
-				ieq(sch_tm, iterCount(sch.Times().Iter()))
-				ieq(sch_act, iterCount(sch.Activities().Iter()))
+				ieq("schedule time", sch_tm, iterCount(sch.Times().Iter()))
+				ieq("schedule activity", sch_act, iterCount(sch.Activities().Iter()))
 			}
-			ieq(grp_tm, iterCount(grp.Times().Iter()))
-			ieq(grp_act, iterCount(grp.Activities().Iter()))
-			ieq(grp_sch, iterCount(grp.Schedules().Iter()))
+			ieq("schedule group time", grp_tm, iterCount(grp.Times().Iter()))
+			ieq("schedule group activity", grp_act, iterCount(grp.Activities().Iter()))
+			ieq("schedule group schedule", grp_sch, iterCount(grp.Schedules().Iter()))
 		}
-		ieq(fac_tm, iterCount(fac.Times().Iter()))
-		ieq(fac_act, iterCount(fac.Activities().Iter()))
-		ieq(fac_sch, iterCount(fac.Schedules().Iter()))
-		ieq(fac_grp, iterCount(fac.ScheduleGroups().Iter()))
-	}
-	ieq(nfac, dat_fac, iterCount(dat.Facilities().Iter()))
-	ieq(ngrp, dat_grp, iterCount(dat.ScheduleGroups().Iter()))
-	ieq(nsch, dat_sch, iterCount(dat.Schedules().Iter()))
-	ieq(nact, dat_act, iterCount(dat.Activities().Iter()))
-	ieq(ntm, dat_tm, iterCount(dat.Times().Iter()))
+		ieq("facility time", fac_tm, iterCount(fac.Times().Iter()))
+		ieq("facility activity", fac_act, iterCount(fac.Activities().Iter()))
+		ieq("facility schedule", fac_sch, iterCount(fac.Schedules().Iter()))
+		ieq("facility schedule group", fac_grp, iterCount(fac.ScheduleGroups().Iter()))
+		if err != nil {
+			return err
+		}
+	}
+	ieq("facility", nfac, dat_fac, iterCount(dat.Facilities().Iter()))
+	ieq("schedule group", ngrp, dat_grp, iterCount(dat.ScheduleGroups().Iter()))
+	ieq("schedule", nsch, dat_sch, iterCount(dat.Schedules().Iter()))
+	ieq("activity", nact, dat_act, iterCount(dat.Activities().Iter()))
+	ieq("time", ntm, dat_tm, iterCount(dat.Times().Iter()))
+	return err
 }
 
 func sanityCheck2(idx *Index) {
@@ -0,0 +1,761 @@
+package ottrecidx
+
+import (
+	"bytes"
+	"iter"
+	"math"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pgaskin/ottrec/schema"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func init() {
+	EnableIndexerSanityCheck()
+}
+
+// testData returns a small hand-built dataset.
+func testData() *schema.Data {
+	wkday := func(w time.Weekday) *schema.Weekday {
+		return schema.Weekday(w).Enum()
+	}
+	clock := func(hh, mm int) *int32 {
+		return proto.Int32(int32(schema.MakeClockTime(hh, mm)))
+	}
+	tm := func(label string, w time.Weekday, hh1, mm1, hh2, mm2 int) *schema.TimeRange {
+		return schema.TimeRange_builder{
+			Label:  label,
+			XStart: clock(hh1, mm1),
+			XEnd:   clock(hh2, mm2),
+			XWkday: wkday(w),
+		}.Build()
+	}
+	day := func(tm ...*schema.TimeRange) *schema.Schedule_ActivityDay {
+		return schema.Schedule_ActivityDay_builder{
+			Times: tm,
+		}.Build()
+	}
+	return schema.Data_builder{
+		Attribution: []string{"Test attribution."},
+		Facilities: []*schema.Facility{
+			schema.Facility_builder{
+				Name:    "Facility A",
+				Address: "1 Test St",
+				Source: schema.Source_builder{
+					Url:   "https://example.com/a",
+					XDate: timestamppb.New(time.Date(2025, 9, 1, 12, 0, 0, 0, time.UTC)),
+				}.Build(),
+				ScheduleGroups: []*schema.ScheduleGroup{
+					schema.ScheduleGroup_builder{
+						Label: "Swimming",
+						ReservationLinks: []*schema.ReservationLink{
+							schema.ReservationLink_builder{
+								Label: "Reserve",
+								Url:   "https://example.com/resv",
+							}.Build(),
+						},
+						Schedules: []*schema.Schedule{
+							schema.Schedule_builder{
+								Caption: "Swimming - September 2 to December 21",
+								Days:    []string{"Monday", "Tuesday"},
+								Activities: []*schema.Schedule_Activity{
+									schema.Schedule_Activity_builder{
+										Label: "Lane swim",
+										XName: "lane swim",
+										Days: []*schema.Schedule_ActivityDay{
+											day(tm("7 - 9 am", time.Monday, 7, 0, 9, 0), tm("6 - 8 pm", time.Monday, 18, 0, 20, 0)),
+											day(tm("7 - 9 am", time.Tuesday, 7, 0, 9, 0)),
+										},
+									}.Build(),
+									schema.Schedule_Activity_builder{
+										Label: "Aquafit",
+										XName: "aquafit",
+										XResv: proto.Bool(true),
+										Days: []*schema.Schedule_ActivityDay{
+											day(),
+											day(tm("noon - 1 pm", time.Tuesday, 12, 0, 13, 0)),
+										},
+									}.Build(),
+								},
+							}.Build(),
+						},
+					}.Build(),
+					schema.ScheduleGroup_builder{
+						Label: "Empty",
+					}.Build(),
+				},
+			}.Build(),
+			schema.Facility_builder{
+				Name: "Facility B",
+				Source: schema.Source_builder{
+					Url:   "https://example.com/b",
+					XDate: timestamppb.New(time.Date(2025, 9, 2, 12, 0, 0, 0, time.UTC)),
+				}.Build(),
+				ScheduleGroups: []*schema.ScheduleGroup{
+					schema.ScheduleGroup_builder{
+						Label: "Skating",
+						Schedules: []*schema.Schedule{
+							schema.Schedule_builder{
+								Caption: "Skating",
+								Days:    []string{"Saturday"},
+								Activities: []*schema.Schedule_Activity{
+									schema.Schedule_Activity_builder{
+										Label: "Public skating",
+										XName: "public skating",
+										Days: []*schema.Schedule_ActivityDay{
+											day(tm("1 - 2:30 pm", time.Saturday, 13, 0, 14, 30), schema.TimeRange_builder{Label: "unparsed"}.Build()),
+										},
+									}.Build(),
+								},
+							}.Build(),
+						},
+					}.Build(),
+				},
+			}.Build(),
+		},
+	}.Build()
+}
+
+func testIndex(t *testing.T) (*Index, *schema.Data) {
+	t.Helper()
+	data := testData()
+	pb, err := proto.MarshalOptions{Deterministic: true}.Marshal(data)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	idx, err := new(Indexer).Load(pb)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	return idx, data
+}
+
+func TestLoad(t *testing.T) {
+	idx, data := testIndex(t)
+
+	if err := idx.Verify(); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if err := sanityCheck1(idx, data); err != nil {
+		t.Fatalf("sanity check against data: %v", err)
+	}
+
+	dat := idx.Data()
+	if n := dat.Facilities().Len(); n != 2 {
+		t.Errorf("expected 2 facilities, got %d", n)
+	}
+	if n := dat.ScheduleGroups().Len(); n != 3 {
+		t.Errorf("expected 3 schedule groups, got %d", n)
+	}
+	if n := dat.Schedules().Len(); n != 2 {
+		t.Errorf("expected 2 schedules, got %d", n)
+	}
+	if n := dat.Activities().Len(); n != 3 {
+		t.Errorf("expected 3 activities, got %d", n)
+	}
+	if n := dat.Times().Len(); n != 6 {
+		t.Errorf("expected 6 times, got %d", n)
+	}
+	if exp := time.Date(2025, 9, 2, 12, 0, 0, 0, time.UTC); !idx.Updated().Equal(exp) {
+		t.Errorf("expected updated %s, got %s", exp, idx.Updated())
+	}
+	if a := slices.Collect(dat.GetAttribution()); !slices.Equal(a, data.GetAttribution()) {
+		t.Errorf("incorrect attribution %q", a)
+	}
+
+	// check the fields and navigation against the original data
+	fi := 0
+	for fac := range dat.Facilities() {
+		xfac := data.GetFacilities()[fi]
+		if fac.GetName() != xfac.GetName() {
+			t.Errorf("facility %d: expected name %q, got %q", fi, xfac.GetName(), fac.GetName())
+		}
+		if fac.GetSourceURL() != xfac.GetSource().GetUrl() {
+			t.Errorf("facility %d: expected url %q, got %q", fi, xfac.GetSource().GetUrl(), fac.GetSourceURL())
+		}
+		gi := 0
+		for grp := range fac.ScheduleGroups() {
+			xgrp := xfac.GetScheduleGroups()[gi]
+			if grp.GetLabel() != xgrp.GetLabel() {
+				t.Errorf("facility %d group %d: expected label %q, got %q", fi, gi, xgrp.GetLabel(), grp.GetLabel())
+			}
+			if n := iterCount(grp.GetReservationLinks()); n != len(xgrp.GetReservationLinks()) {
+				t.Errorf("facility %d group %d: expected %d reservation links, got %d", fi, gi, len(xgrp.GetReservationLinks()), n)
+			}
+			si := 0
+			for sch := range grp.Schedules() {
+				xsch := xgrp.GetSchedules()[si]
+				if sch.GetCaption() != xsch.GetCaption() {
+					t.Errorf("facility %d group %d schedule %d: expected caption %q, got %q", fi, gi, si, xsch.GetCaption(), sch.GetCaption())
+				}
+				ai := 0
+				for act := range sch.Activities() {
+					xact := xsch.GetActivities()[ai]
+					if act.GetLabel() != xact.GetLabel() || act.GetName() != xact.GetXName() {
+						t.Errorf("facility %d group %d schedule %d activity %d: incorrect label or name", fi, gi, si, ai)
+					}
+					if resv, ok := act.GetResv(); resv != xact.GetXResv() || ok != xact.HasXResv() {
+						t.Errorf("facility %d group %d schedule %d activity %d: incorrect resv", fi, gi, si, ai)
+					}
+					var xtms []*schema.TimeRange
+					for _, xday := range xact.GetDays() {
+						xtms = append(xtms, xday.GetTimes()...)
+					}
+					ti := 0
+					for tm := range act.Times() {
+						if ti >= len(xtms) {
+							t.Fatalf("facility %d group %d schedule %d activity %d: too many times", fi, gi, si, ai)
+						}
+						xtm := xtms[ti]
+						if tm.GetLabel() != xtm.GetLabel() {
+							t.Errorf("facility %d group %d schedule %d activity %d time %d: expected label %q, got %q", fi, gi, si, ai, ti, xtm.GetLabel(), tm.GetLabel())
+						}
+						if w, r, ok := xtm.AsXParsed(); ok {
+							if tw, ok := tm.GetWeekday(); !ok || tw != w {
+								t.Errorf("facility %d group %d schedule %d activity %d time %d: incorrect weekday", fi, gi, si, ai, ti)
+							}
+							if tr, ok := tm.GetRange(); !ok || tr != r {
+								t.Errorf("facility %d group %d schedule %d activity %d time %d: incorrect range", fi, gi, si, ai, ti)
+							}
+						} else if _, ok := tm.GetWeekday(); ok {
+							t.Errorf("facility %d group %d schedule %d activity %d time %d: expected no weekday", fi, gi, si, ai, ti)
+						}
+						if tm.Facility().GetName() != xfac.GetName() {
+							t.Errorf("facility %d group %d schedule %d activity %d time %d: incorrect parent facility", fi, gi, si, ai, ti)
+						}
+						ti++
+					}
+					if ti != len(xtms) {
+						t.Errorf("facility %d group %d schedule %d activity %d: expected %d times, got %d", fi, gi, si, ai, len(xtms), ti)
+					}
+					ai++
+				}
+				si++
+			}
+			gi++
+		}
+		fi++
+	}
+}
+
+func TestStats(t *testing.T) {
+	idx, _ := testIndex(t)
+
+	st := idx.Stats()
+	if st.Hash != idx.Hash() {
+		t.Errorf("expected hash %q, got %q", idx.Hash(), st.Hash)
+	}
+	if !st.Updated.Equal(idx.Updated()) {
+		t.Errorf("expected updated %s, got %s", idx.Updated(), st.Updated)
+	}
+	if exp := 1 + 2 + 3 + 2 + 3 + 6; st.Objects != exp {
+		t.Errorf("expected %d objects, got %d", exp, st.Objects)
+	}
+	for _, c := range []struct {
+		name     string
+		exp, act int
+	}{
+		{"facilities", 2, st.Facilities},
+		{"schedule groups", 3, st.ScheduleGroups},
+		{"schedules", 2, st.Schedules},
+		{"activities", 3, st.Activities},
+		{"times", 6, st.Times},
+	} {
+		if c.exp != c.act {
+			t.Errorf("expected %d %s, got %d", c.exp, c.name, c.act)
+		}
+	}
+}
+
+func TestLoadCached(t *testing.T) {
+	pb, err := proto.Marshal(testData())
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var dxr Indexer
+	a, err := dxr.Load(pb)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	b, err := dxr.Load(slices.Clone(pb))
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if a != b {
+		t.Errorf("expected the same index to be returned for identical data")
+	}
+	if a.Hash() != b.Hash() {
+		t.Errorf("expected the same hash")
+	}
+}
+
+func TestLoadReader(t *testing.T) {
+	pb, err := proto.Marshal(testData())
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	var dxr Indexer
+	a, err := dxr.Load(pb)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	for _, size := range []int64{int64(len(pb)), -1} {
+		b, err := dxr.LoadReader(bytes.NewReader(pb), size)
+		if err != nil {
+			t.Fatalf("load reader (size %d): %v", size, err)
+		}
+		if a != b {
+			t.Errorf("load reader (size %d): expected the same index to be returned for identical data", size)
+		}
+	}
+	if _, err := dxr.LoadReader(bytes.NewReader(pb), int64(len(pb))+1); err == nil {
+		t.Errorf("expected error for short data")
+	}
+	if _, err := dxr.LoadReader(bytes.NewReader(pb), int64(len(pb))-1); err == nil {
+		t.Errorf("expected error for long data")
+	}
+}
+
+func TestSkipPrecompute(t *testing.T) {
+	pb, err := proto.Marshal(testData())
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	a, err := new(Indexer).Load(pb)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	b, err := (&Indexer{SkipPrecompute: true}).Load(pb)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if b.cached_ActivityRef_GuessReservationRequirement || b.cached_ScheduleRef_ComputeEffectiveDateRange {
+		t.Fatalf("expected derived fields not to be precomputed")
+	}
+	if !a.Updated().Equal(b.Updated()) {
+		t.Errorf("expected the same updated time")
+	}
+	for ra, rb := range iterZip(a.Data().Activities().Iter(), b.Data().Activities().Iter()) {
+		a1, b1 := ra.GuessReservationRequirement()
+		a2, b2 := rb.GuessReservationRequirement()
+		if a1 != a2 || b1 != b2 {
+			t.Errorf("activity %q: reservation requirement mismatch", ra.GetLabel())
+		}
+	}
+	for ra, rb := range iterZip(a.Data().Schedules().Iter(), b.Data().Schedules().Iter()) {
+		a1, b1, c1 := ra.ComputeEffectiveDateRange()
+		a2, b2, c2 := rb.ComputeEffectiveDateRange()
+		if !a1.Equal(a2) || !b1.Equal(b2) || c1 != c2 {
+			t.Errorf("schedule %q: effective date range mismatch", ra.GetCaption())
+		}
+	}
+}
+
+func iterZip[A, B any](a iter.Seq[A], b iter.Seq[B]) iter.Seq2[A, B] {
+	return func(yield func(A, B) bool) {
+		nb, stop := iter.Pull(b)
+		defer stop()
+		for va := range a {
+			vb, ok := nb()
+			if !ok || !yield(va, vb) {
+				return
+			}
+		}
+	}
+}
+
+func TestSortTimesByWeekday(t *testing.T) {
+	idx, _ := testIndex(t)
+
+	times := slices.Collect(idx.Data().Times().Iter())
+	for _, c := range []struct {
+		weekStart time.Weekday
+		exp       []string
+	}{
+		{time.Sunday, []string{"7 - 9 am", "6 - 8 pm", "7 - 9 am", "noon - 1 pm", "1 - 2:30 pm", "unparsed"}},
+		{time.Tuesday, []string{"7 - 9 am", "noon - 1 pm", "1 - 2:30 pm", "7 - 9 am", "6 - 8 pm", "unparsed"}},
+	} {
+		SortTimesByWeekday(times, c.weekStart)
+		var act []string
+		for _, tm := range times {
+			act = append(act, tm.GetLabel())
+		}
+		if !slices.Equal(act, c.exp) {
+			t.Errorf("week start %s: expected %q, got %q", c.weekStart, c.exp, act)
+		}
+	}
+}
+
+func TestDuplicateScheduleGroups(t *testing.T) {
+	data := testData()
+	facs := data.GetFacilities()
+
+	c := proto.Clone(facs[1]).(*schema.Facility) // identical to B
+	c.SetName("Facility C")
+	c.GetSource().SetUrl("https://example.com/c")
+
+	d := proto.Clone(facs[1]).(*schema.Facility) // different time
+	d.SetName("Facility D")
+	d.GetSource().SetUrl("https://example.com/d")
+	d.GetScheduleGroups()[0].GetSchedules()[0].GetActivities()[0].GetDays()[0].GetTimes()[0].SetLabel("1 - 3 pm")
+
+	data.SetFacilities(append(facs, c, d, proto.Clone(facs[0]).(*schema.Facility)))
+
+	pb, err := proto.Marshal(data)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	idx, err := new(Indexer).Load(pb)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	var act [][]string
+	for grps := range idx.Data().DuplicateScheduleGroups() {
+		var names []string
+		for _, grp := range grps {
+			names = append(names, grp.Facility().GetName()+"/"+grp.GetLabel())
+		}
+		act = append(act, names)
+	}
+	exp := [][]string{
+		{"Facility A/Swimming", "Facility A/Swimming"},
+		{"Facility B/Skating", "Facility C/Skating"},
+	}
+	if !slices.EqualFunc(act, exp, slices.Equal) {
+		t.Errorf("expected %q, got %q", exp, act)
+	}
+}
+
+func TestReservationLinks(t *testing.T) {
+	data := testData()
+	facs := data.GetFacilities()
+
+	c := proto.Clone(facs[0]).(*schema.Facility) // same link as A
+	c.SetName("Facility C")
+	c.GetScheduleGroups()[0].SetReservationLinks(append(c.GetScheduleGroups()[0].GetReservationLinks(),
+		schema.ReservationLink_builder{
+			Label: "Reserve (members)",
+			Url:   "https://example.com/resv-members",
+		}.Build(),
+	))
+
+	data.SetFacilities(append(facs, c))
+
+	pb, err := proto.Marshal(data)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	idx, err := new(Indexer).Load(pb)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	var act []string
+	for grp, lnk := range idx.Data().ReservationLinks() {
+		act = append(act, grp.Facility().GetName()+"/"+grp.GetLabel()+" "+lnk.URL)
+	}
+	exp := []string{
+		"Facility A/Swimming https://example.com/resv",
+		"Facility C/Swimming https://example.com/resv-members",
+	}
+	if !slices.Equal(act, exp) {
+		t.Errorf("expected %q, got %q", exp, act)
+	}
+}
+
+func TestMutate(t *testing.T) {
+	idx, _ := testIndex(t)
+	dat := idx.Data()
+
+	mut := dat.Mutate()
+	if n := mut.FilterTimes(func(ref TimeRef) bool {
+		w, ok := ref.GetWeekday()
+		return ok && w == time.Tuesday
+	}); n != 4 {
+		t.Errorf("expected 4 times to be removed, got %d", n)
+	}
+	mut.Elide()
+	flt := mut.Data()
+
+	if n := flt.Times().Len(); n != 2 {
+		t.Errorf("expected 2 times, got %d", n)
+	}
+	if n := flt.Activities().Len(); n != 2 {
+		t.Errorf("expected 2 activities, got %d", n)
+	}
+	if n := flt.Facilities().Len(); n != 1 {
+		t.Errorf("expected 1 facility, got %d", n)
+	}
+	for tm := range flt.Times() {
+		if w, _ := tm.GetWeekday(); w != time.Tuesday {
+			t.Errorf("unexpected weekday %s", w)
+		}
+	}
+
+	// the original should be unchanged
+	if n := dat.Times().Len(); n != 6 {
+		t.Errorf("expected original to still have 6 times, got %d", n)
+	}
+}
+
+func TestKeepFacilities(t *testing.T) {
+	idx, _ := testIndex(t)
+	dat := idx.Data()
+
+	mut := dat.Mutate()
+	if n := mut.KeepFacilities("https://example.com/b", "https://example.com/c"); n != 1 {
+		t.Errorf("expected 1 facility to be removed, got %d", n)
+	}
+	flt := mut.Data()
+
+	if n := flt.Facilities().Len(); n != 1 {
+		t.Fatalf("expected 1 facility, got %d", n)
+	}
+	for fac := range flt.Facilities() {
+		if k := fac.Key(); k != "https://example.com/b" {
+			t.Errorf("unexpected facility %q", k)
+		}
+		if n := fac.Times().Len(); n == 0 {
+			t.Errorf("expected facility times to be kept")
+		}
+	}
+	if n := flt.Times().Len(); n >= dat.Times().Len() {
+		t.Errorf("expected times from removed facilities to be removed")
+	}
+}
+
+func TestKeepActivities(t *testing.T) {
+	idx, _ := testIndex(t)
+	dat := idx.Data()
+
+	mut := dat.Mutate()
+	if n := mut.KeepActivities("aquafit", "public skating"); n != 1 {
+		t.Errorf("expected 1 activity to be removed, got %d", n)
+	}
+	flt := mut.Data()
+
+	var act []string
+	for ref := range flt.Activities() {
+		act = append(act, ref.GetName())
+		if ref.Times().Empty() {
+			t.Errorf("expected activity %q times to be kept", ref.GetName())
+		}
+	}
+	if exp := []string{"aquafit", "public skating"}; !slices.Equal(act, exp) {
+		t.Errorf("expected activities %q, got %q", exp, act)
+	}
+	if n := flt.Facilities().Len(); n != 2 {
+		t.Errorf("expected 2 facilities, got %d", n)
+	}
+
+	mut = dat.Mutate()
+	if n := mut.KeepActivitiesMatching(func(name string) bool { return name == "lane swim" }); n != 2 {
+		t.Errorf("expected 2 activities to be removed, got %d", n)
+	}
+	flt = mut.Data()
+	if n := flt.Facilities().Len(); n != 1 {
+		t.Errorf("expected empty facilities to be elided, got %d facilities", n)
+	}
+	if n := flt.ScheduleGroups().Len(); n != 1 {
+		t.Errorf("expected empty schedule groups to be elided, got %d schedule groups", n)
+	}
+}
+
+func TestParseCoverage(t *testing.T) {
+	idx, _ := testIndex(t)
+
+	st := idx.Data().ParseCoverage()
+	if exp := (ParseStats{Times: 6, TimeWeekdays: 5, TimeRanges: 5, Schedules: 2}); st != exp {
+		t.Errorf("expected %+v, got %+v", exp, st)
+	}
+	if act, exp := st.WeekdayCoverage(), 5.0/6; act != exp {
+		t.Errorf("expected weekday coverage %v, got %v", exp, act)
+	}
+	if act := st.DateRangeCoverage(); act != 0 {
+		t.Errorf("expected date range coverage 0, got %v", act)
+	}
+	if act := (ParseStats{}).RangeCoverage(); act != 1 {
+		t.Errorf("expected range coverage 1 without any times, got %v", act)
+	}
+}
+
+func TestClusterFacilities(t *testing.T) {
+	data := testData()
+	facs := data.GetFacilities()
+	facs[0].SetXLnglat(schema.LngLat_builder{Lng: -75.72, Lat: 45.42}.Build())
+	facs[1].SetXLnglat(schema.LngLat_builder{Lng: -75.78, Lat: 45.44}.Build())
+
+	c := proto.Clone(facs[1]).(*schema.Facility) // far away
+	c.SetName("Facility C")
+	c.GetSource().SetUrl("https://example.com/c")
+	c.SetXLnglat(schema.LngLat_builder{Lng: -75.25, Lat: 45.42}.Build())
+
+	d := proto.Clone(facs[1]).(*schema.Facility) // no location
+	d.SetName("Facility D")
+	d.GetSource().SetUrl("https://example.com/d")
+	d.ClearXLnglat()
+
+	data.SetFacilities(append(facs, c, d))
+
+	pb, err := proto.Marshal(data)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	idx, err := new(Indexer).Load(pb)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+
+	clusters := idx.Data().ClusterFacilities(-76, 45, -75, 46, 0.1)
+	if len(clusters) != 2 {
+		t.Fatalf("expected 2 clusters, got %d", len(clusters))
+	}
+	if n := len(clusters[0].Facilities); n != 2 {
+		t.Errorf("expected 2 facilities in the first cluster, got %d", n)
+	}
+	if lng, lat := clusters[0].Lng, clusters[0].Lat; math.Abs(lng+75.75) > 1e-4 || math.Abs(lat-45.43) > 1e-4 {
+		t.Errorf("incorrect centroid %f,%f", lng, lat)
+	}
+	if n := len(clusters[1].Facilities); n != 1 || clusters[1].Facilities[0].GetName() != "Facility C" {
+		t.Errorf("expected the second cluster to only contain facility C")
+	}
+
+	if clusters := idx.Data().ClusterFacilities(-75.3, 45, -75, 46, 0.1); len(clusters) != 1 {
+		t.Errorf("expected facilities outside the bounding box to be excluded, got %d clusters", len(clusters))
+	}
+}
+
+func TestSummaryText(t *testing.T) {
+	idx, _ := testIndex(t)
+
+	var act []string
+	for fac := range idx.Data().Facilities() {
+		act = append(act, fac.SummaryText())
+	}
+	if exp := []string{
+		"Lane swim Mon, Tue 7am–8pm; aquafit Tue 12–1pm.",
+		"Public skating Sat 1–2:30pm.",
+	}; !slices.Equal(act, exp) {
+		t.Errorf("expected %q, got %q", exp, act)
+	}
+
+	for _, tc := range []struct {
+		days [7]bool
+		exp  string
+	}{
+		{[7]bool{true, true, true, true, true, true, true}, "daily"},
+		{[7]bool{true, false, false, false, false, false, true}, "weekends"},
+		{[7]bool{false, true, true, true, true, true, false}, "Mon–Fri"},
+		{[7]bool{true, true, false, true, false, true, true}, "Mon, Wed, Fri–Sun"},
+	} {
+		if act := summaryWeekdays(tc.days); act != tc.exp {
+			t.Errorf("summaryWeekdays(%v): expected %q, got %q", tc.days, tc.exp, act)
+		}
+	}
+
+	for _, tc := range []struct {
+		r   schema.ClockRange
+		exp string
+	}{
+		{schema.MakeClockRange(6, 0, 21, 0), "6am–9pm"},
+		{schema.MakeClockRange(13, 0, 14, 30), "1–2:30pm"},
+		{schema.MakeClockRange(11, 5, 12, 0), "11:05am–12pm"},
+		{schema.MakeClockRange(22, 0, 0, 0), "10pm–12am"},
+	} {
+		if act := summaryClockRange(tc.r.Start, tc.r.End); act != tc.exp {
+			t.Errorf("summaryClockRange(%s): expected %q, got %q", tc.r, tc.exp, act)
+		}
+	}
+}
+
+func TestLoadFiltered(t *testing.T) {
+	full, data := testIndex(t)
+
+	pb, err := proto.Marshal(data)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	idx, err := new(Indexer).LoadFiltered(pb, func(fac *schema.Facility) bool {
+		return fac.GetName() == "Facility A"
+	})
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := idx.Verify(); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	if idx.Hash() == full.Hash() {
+		t.Errorf("expected filtered index to have a different hash")
+	}
+
+	var names []string
+	for fac := range idx.Data().Facilities() {
+		names = append(names, fac.GetName())
+	}
+	if exp := []string{"Facility A"}; !slices.Equal(names, exp) {
+		t.Errorf("expected facilities %q, got %q", exp, names)
+	}
+	for tm := range idx.Data().Times() {
+		if name := tm.Facility().GetName(); name != "Facility A" {
+			t.Errorf("unexpected time for %q", name)
+		}
+	}
+	if act, exp := idx.Data().Times().Len(), full.Data().Times().Len()-2; act != exp {
+		t.Errorf("expected %d times, got %d", exp, act)
+	}
+}
+
+// benchData returns a larger dataset by repeating the facilities in
+// [testData].
+func benchData(n int) *schema.Data {
+	data := testData()
+	facs := data.GetFacilities()
+	for range n - 1 {
+		facs = append(facs, testData().GetFacilities()...)
+	}
+	data.SetFacilities(facs)
+	return data
+}
+
+func BenchmarkChildRefSeq(b *testing.B) {
+	pb, err := proto.Marshal(benchData(250))
+	if err != nil {
+		b.Fatalf("marshal: %v", err)
+	}
+	idx, err := new(Indexer).Load(pb)
+	if err != nil {
+		b.Fatalf("load: %v", err)
+	}
+	walk := func(dat DataRef) (n int) {
+		for fac := range dat.Facilities() {
+			for grp := range fac.ScheduleGroups() {
+				for sch := range grp.Schedules() {
+					for act := range sch.Activities() {
+						for range act.Times() {
+							n++
+						}
+					}
+				}
+			}
+		}
+		return
+	}
+	b.Run("Unfiltered", func(b *testing.B) {
+		dat := idx.Data()
+		b.ReportAllocs()
+		for b.Loop() {
+			walk(dat)
+		}
+	})
+	b.Run("Filtered", func(b *testing.B) {
+		dat := idx.Data().Mutate().Data()
+		b.ReportAllocs()
+		for b.Loop() {
+			walk(dat)
+		}
+	})
+}
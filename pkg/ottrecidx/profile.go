@@ -27,6 +27,7 @@ var (
 	MemProfile = flag.String("memprofile", "", "write memory profile")
 	CPUProfile = flag.String("cpuprofile", "", "write cpu profile")
 	Check      = flag.Bool("check", false, "enable indexer sanity checking")
+	Verify     = flag.Bool("verify", false, "verify each index after loading (non-fatal)")
 	Quiet      = flag.Bool("quiet", false, "do not print progress info")
 	Limit      = flag.Int("limit", 0, "maximum number of schedules to import")
 )
@@ -77,6 +78,11 @@ func main() {
 			}
 			tb += len(buf)
 			progress(off, x)
+			if *Verify {
+				if err := x.Verify(); err != nil {
+					progress(off, "verify failed:", err)
+				}
+			}
 		}
 		if err != nil {
 			panic(err)
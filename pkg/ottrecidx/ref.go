@@ -248,9 +248,14 @@ func (ref TimeRef) Index() *Index          { return ref.index() }
 
 func (ref DataRef) GetAttribution() iter.Seq[string] { return slices.Values(ref.deref().Attribution) }
 
+// Key returns a string uniquely identifying the facility within the data. It
+// is currently the source URL.
+func (ref FacilityRef) Key() string { return ref.deref().SourceURL }
+
 func (ref FacilityRef) GetName() string          { return ref.deref().Name }
 func (ref FacilityRef) GetSourceURL() string     { return ref.deref().SourceURL }
 func (ref FacilityRef) GetSourceDate() time.Time { return ref.deref().SourceDate }
+func (ref FacilityRef) GetDescription() string   { return ref.deref().Description }
 func (ref FacilityRef) GetAddress() string       { return ref.deref().Address }
 func (ref FacilityRef) GetLngLat() (lng float32, lat float32, ok bool) {
 	x := ref.deref()
@@ -377,7 +382,10 @@ func childRefSeq[T, U schemaObj](ref typedRef[T]) iter.Seq[typedRef[U]] {
 			until = refObj(len(ref.idx.obj)) // end
 		}
 		if mask := typeBitmap[U](ref.index()); !mask.IsNil() {
-			for obj := range ref.applyFilter(mask).RangeBetween(start, until) {
+			if !ref.flt.IsNil() {
+				mask = ref.applyFilter(mask)
+			} // else, we don't need to clone it since we're not modifying it
+			for obj := range mask.RangeBetween(start, until) {
 				if !yield(reference[U](ref, obj)) {
 					return
 				}
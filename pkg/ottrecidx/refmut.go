@@ -1,5 +1,7 @@
 package ottrecidx
 
+import "slices"
+
 // this file contains the user-facing interface to create filtered copies of the indexed data
 
 // MutableDataRef lets you create a mutated DataRef.
@@ -46,11 +48,8 @@ func mutRemoveRef[T schemaObj](mut *MutableDataRef, ref typedRef[T]) bool {
 	} else {
 		until = refObj(len(ref.idx.obj)) // end
 	}
-	// TODO: optimize
 	// remove it and all remaining children
-	for obj := start; obj < until; obj++ {
-		mut.unsafe.flt.Remove(obj)
-	}
+	mut.unsafe.flt.RemoveRange(start, until)
 	return true
 }
 func (mut *MutableDataRef) RemoveFacility(ref FacilityRef) bool {
@@ -133,6 +132,74 @@ func (mut *MutableDataRef) FilterTimes(fn func(ref TimeRef) bool) int {
 	return n
 }
 
+// KeepFacilities removes all facilities where [FacilityRef.Key] is not one of
+// keys, then elides empty objects, returning the number of facilities removed.
+func (mut *MutableDataRef) KeepFacilities(keys ...string) int {
+	var (
+		n    int
+		keep = makeBitmap[refObj](len(mut.unsafe.idx.obj))
+		objs = refObj(len(mut.unsafe.idx.obj))
+	)
+	keep.Set(0) // data
+	for ref := range mut.unsafe.Facilities() {
+		if !slices.Contains(keys, ref.Key()) {
+			n++
+			continue
+		}
+		start := ref.object()
+		until, ok := ref.typeNotChildBitmap().Next(start + 1)
+		if !ok {
+			until = objs
+		}
+		keep.SetRange(start, until)
+	}
+	mut.unsafe.flt.And(keep)
+	mut.Elide()
+	return n
+}
+
+// KeepActivities removes all activities where [ActivityRef.GetName] is not one
+// of names, then elides empty objects, returning the number of activities
+// removed.
+func (mut *MutableDataRef) KeepActivities(names ...string) int {
+	return mut.KeepActivitiesMatching(func(name string) bool {
+		return slices.Contains(names, name)
+	})
+}
+
+// KeepActivitiesMatching removes all activities where fn returns false for the
+// [ActivityRef.GetName], then elides empty objects, returning the number of
+// activities removed. The result of fn is cached for each name.
+func (mut *MutableDataRef) KeepActivitiesMatching(fn func(name string) bool) int {
+	var (
+		n      int
+		remove = makeBitmap[refObj](len(mut.unsafe.idx.obj))
+		objs   = refObj(len(mut.unsafe.idx.obj))
+		match  = map[string]bool{}
+	)
+	for ref := range mut.unsafe.Activities() {
+		name := ref.GetName()
+		keep, ok := match[name]
+		if !ok {
+			keep = fn(name)
+			match[name] = keep
+		}
+		if keep {
+			continue
+		}
+		start := ref.object()
+		until, ok := ref.typeNotChildBitmap().Next(start + 1)
+		if !ok {
+			until = objs
+		}
+		remove.SetRange(start, until)
+		n++
+	}
+	mut.unsafe.flt.AndNot(remove)
+	mut.Elide()
+	return n
+}
+
 func (mut *MutableDataRef) Elide() {
 	mut.ElideActivities()
 	mut.ElideSchedules()
@@ -1,7 +1,17 @@
 package ottrecidx
 
 import (
+	"cmp"
+	"iter"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/pgaskin/ottrec/schema"
 )
 
 // this file contains additional helpers to perform computations on refs, possibly with optimizations
@@ -272,6 +282,393 @@ func (ref TimeRef) SingleDate() (time.Time, bool) {
 
 }
 
+// OpenNow checks whether any activity at the facility is happening at the
+// specified time. Times without a parsed weekday and time range are ignored.
+func (ref FacilityRef) OpenNow(at time.Time) bool {
+	at = at.In(TZ)
+	today := time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, TZ)
+	clock := schema.ClockTime(at.Hour()*60 + at.Minute())
+	for tm := range ref.Times() {
+		wkday, ok := tm.GetWeekday()
+		if !ok {
+			continue
+		}
+		r, ok := tm.GetRange()
+		if !ok || !r.IsValid() {
+			continue
+		}
+		// check the day it starts on (ranges may go past midnight)
+		for days := range int(r.End/(24*60)) + 1 {
+			date := today.AddDate(0, 0, -days)
+			if t := clock + schema.ClockTime(days*24*60); t < r.Start || t >= r.End {
+				continue
+			}
+			if d, ok := tm.SingleDate(); ok {
+				if !d.Equal(date) {
+					continue
+				}
+			} else {
+				if wkday != date.Weekday() {
+					continue
+				}
+				if from, to, ok := tm.Schedule().ComputeEffectiveDateRange(); ok {
+					if (!from.IsZero() && date.Before(from)) || (!to.IsZero() && date.After(to)) {
+						continue
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// DuplicateScheduleGroups finds sets of schedule groups (usually at different
+// facilities) with the same title and structurally identical schedules,
+// activities, and times. Only sets with more than one schedule group are
+// returned, and schedule groups without any times are ignored.
+func (ref DataRef) DuplicateScheduleGroups() iter.Seq[[]ScheduleGroupRef] {
+	return func(yield func([]ScheduleGroupRef) bool) {
+		var (
+			keys   []string
+			groups = map[string][]ScheduleGroupRef{}
+			act    = map[*xActivity]int{} // interned, so we can compare pointers
+			tm     = map[*xTime]int{}     // interned, so we can compare pointers
+			b      []byte
+		)
+		for grp := range ref.ScheduleGroups() {
+			b = append(b[:0], grp.GetTitle()...)
+			var n int
+			for sch := range grp.Schedules() {
+				b = append(b, 0, 's')
+				b = append(b, sch.GetCaption()...)
+				for i := range sch.NumDays() {
+					b = append(b, 0)
+					b = append(b, sch.GetDay(i)...)
+				}
+				for a := range sch.Activities() {
+					x, ok := act[a.deref()]
+					if !ok {
+						x = len(act)
+						act[a.deref()] = x
+					}
+					b = append(b, 0, 'a')
+					b = strconv.AppendInt(b, int64(x), 10)
+					for t := range a.Times() {
+						x, ok := tm[t.deref()]
+						if !ok {
+							x = len(tm)
+							tm[t.deref()] = x
+						}
+						b = append(b, 0, 't')
+						b = strconv.AppendInt(b, int64(x), 10)
+						n++
+					}
+				}
+			}
+			if n == 0 {
+				continue
+			}
+			k := string(b)
+			if _, ok := groups[k]; !ok {
+				keys = append(keys, k)
+			}
+			groups[k] = append(groups[k], grp)
+		}
+		for _, k := range keys {
+			if g := groups[k]; len(g) > 1 {
+				if !yield(g) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ReservationLinks returns the distinct (by URL) reservation links across all
+// schedule groups, along with the first schedule group each one was found in.
+// Links without a URL are skipped.
+func (ref DataRef) ReservationLinks() iter.Seq2[ScheduleGroupRef, ReservationLink] {
+	return func(yield func(ScheduleGroupRef, ReservationLink) bool) {
+		seen := map[string]struct{}{}
+		for grp := range ref.ScheduleGroups() {
+			for lnk := range grp.GetReservationLinks() {
+				if lnk.URL == "" {
+					continue
+				}
+				if _, ok := seen[lnk.URL]; ok {
+					continue
+				}
+				seen[lnk.URL] = struct{}{}
+				if !yield(grp, lnk) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// ParseStats contains the number of objects with successfully parsed fields,
+// for measuring the quality of the scraped data.
+type ParseStats struct {
+	Times        int
+	TimeWeekdays int // times with a weekday
+	TimeRanges   int // times with a time range
+
+	Schedules          int
+	ScheduleDateRanges int // schedules with a date range
+}
+
+// WeekdayCoverage returns the fraction of times with a parsed weekday.
+func (s ParseStats) WeekdayCoverage() float64 {
+	return parseFraction(s.TimeWeekdays, s.Times)
+}
+
+// RangeCoverage returns the fraction of times with a parsed time range.
+func (s ParseStats) RangeCoverage() float64 {
+	return parseFraction(s.TimeRanges, s.Times)
+}
+
+// DateRangeCoverage returns the fraction of schedules with a parsed date range.
+func (s ParseStats) DateRangeCoverage() float64 {
+	return parseFraction(s.ScheduleDateRanges, s.Schedules)
+}
+
+func parseFraction(n, total int) float64 {
+	if total == 0 {
+		return 1
+	}
+	return float64(n) / float64(total)
+}
+
+// ParseCoverage counts the times and schedules with successfully parsed
+// weekdays, time ranges, and date ranges.
+func (ref DataRef) ParseCoverage() ParseStats {
+	var s ParseStats
+	for tm := range ref.Times() {
+		s.Times++
+		if _, ok := tm.GetWeekday(); ok {
+			s.TimeWeekdays++
+		}
+		if _, ok := tm.GetRange(); ok {
+			s.TimeRanges++
+		}
+	}
+	for sch := range ref.Schedules() {
+		s.Schedules++
+		if _, ok := sch.GetDateRange(); ok {
+			s.ScheduleDateRanges++
+		}
+	}
+	return s
+}
+
+// FacilityCluster is a group of facilities in a grid cell.
+type FacilityCluster struct {
+	Lng, Lat   float64       // centroid
+	Facilities []FacilityRef // at least one
+}
+
+// ClusterFacilities groups the facilities with a location inside the bounding
+// box (inclusive) into square grid cells of the specified size in degrees. The
+// cells are aligned to the origin so clusters are stable when the bounding box
+// changes. Clusters are returned in an arbitrary but deterministic order.
+func (ref DataRef) ClusterFacilities(minLng, minLat, maxLng, maxLat, cell float64) []FacilityCluster {
+	if !(cell > 0) {
+		panic("ottrecidx: cell size must be positive")
+	}
+	type cellKey struct{ x, y int64 }
+	var (
+		keys  []cellKey
+		cells = map[cellKey]*FacilityCluster{}
+	)
+	for fac := range ref.Facilities() {
+		lng32, lat32, ok := fac.GetLngLat()
+		if !ok {
+			continue
+		}
+		lng, lat := float64(lng32), float64(lat32)
+		if lng < minLng || lng > maxLng || lat < minLat || lat > maxLat {
+			continue
+		}
+		k := cellKey{int64(math.Floor(lng / cell)), int64(math.Floor(lat / cell))}
+		c, ok := cells[k]
+		if !ok {
+			c = new(FacilityCluster)
+			cells[k] = c
+			keys = append(keys, k)
+		}
+		c.Lng += lng
+		c.Lat += lat
+		c.Facilities = append(c.Facilities, fac)
+	}
+	clusters := make([]FacilityCluster, len(keys))
+	for i, k := range keys {
+		c := cells[k]
+		c.Lng /= float64(len(c.Facilities))
+		c.Lat /= float64(len(c.Facilities))
+		clusters[i] = *c
+	}
+	return clusters
+}
+
+// SortTimesByWeekday sorts times by weekday (starting from weekStart), then by
+// start time. Times without a parsed weekday or time range sort after the ones
+// with one. The sort is stable.
+func SortTimesByWeekday(times []TimeRef, weekStart time.Weekday) {
+	key := func(ref TimeRef) (day, start int) {
+		day, start = 7, math.MaxInt
+		if wd, ok := ref.GetWeekday(); ok {
+			day = (int(wd) - int(weekStart) + 7) % 7
+		}
+		if r, ok := ref.GetRange(); ok && r.Start.IsValid() {
+			start = int(r.Start)
+		}
+		return
+	}
+	slices.SortStableFunc(times, func(a, b TimeRef) int {
+		aDay, aStart := key(a)
+		bDay, bStart := key(b)
+		return cmp.Or(cmp.Compare(aDay, bDay), cmp.Compare(aStart, bStart))
+	})
+}
+
+// summaryMaxLength is the maximum length of [FacilityRef.SummaryText] in
+// characters.
+const summaryMaxLength = 160
+
+// SummaryText returns a short sentence summarizing when each activity at the
+// facility is held (e.g., "Lane swim Mon–Fri 6am–9pm; public swim weekends
+// 1–4pm."), or an empty string if there aren't any times with a parsed weekday
+// and time range. Activities with more times come first, and ones which don't
+// fit within the length limit are left out. Each activity's time range is the
+// earliest start to the latest end time on any day.
+func (ref FacilityRef) SummaryText() string {
+	type activitySummary struct {
+		n          int
+		days       [7]bool
+		start, end schema.ClockTime
+	}
+	var (
+		names []string
+		acts  = map[string]*activitySummary{}
+	)
+	for tm := range ref.Times() {
+		wd, ok1 := tm.GetWeekday()
+		r, ok2 := tm.GetRange()
+		if !ok1 || !ok2 || !r.IsValid() {
+			continue
+		}
+		name := tm.Activity().GetName()
+		if name == "" {
+			continue
+		}
+		a, ok := acts[name]
+		if !ok {
+			a = &activitySummary{start: r.Start, end: r.End}
+			acts[name] = a
+			names = append(names, name)
+		}
+		a.n++
+		a.days[wd] = true
+		a.start = min(a.start, r.Start)
+		a.end = max(a.end, r.End)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Or(cmp.Compare(acts[b].n, acts[a].n), cmp.Compare(a, b))
+	})
+
+	var (
+		b strings.Builder
+		n int // runes in b
+	)
+	for _, name := range names {
+		a := acts[name]
+		clause := name + " " + summaryWeekdays(a.days) + " " + summaryClockRange(a.start, a.end)
+		if b.Len() == 0 {
+			r, size := utf8.DecodeRuneInString(clause)
+			clause = string(unicode.ToUpper(r)) + clause[size:]
+		} else {
+			clause = "; " + clause
+		}
+		if c := utf8.RuneCountInString(clause); n+c+1 <= summaryMaxLength {
+			b.WriteString(clause)
+			n += c
+		} else if b.Len() == 0 {
+			b.WriteString(string([]rune(clause)[:summaryMaxLength-1]))
+			b.WriteString("…")
+			return b.String()
+		}
+	}
+	if b.Len() != 0 {
+		b.WriteByte('.')
+	}
+	return b.String()
+}
+
+// summaryWeekdays formats a set of weekdays (e.g., daily, weekends, Mon–Fri,
+// Mon, Wed, Fri–Sun).
+func summaryWeekdays(days [7]bool) string {
+	switch days {
+	case [7]bool{true, true, true, true, true, true, true}:
+		return "daily"
+	case [7]bool{true, false, false, false, false, false, true}:
+		return "weekends"
+	}
+	var (
+		parts []string
+		order = [...]time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}
+	)
+	for i := 0; i < len(order); {
+		if !days[order[i]] {
+			i++
+			continue
+		}
+		j := i
+		for j+1 < len(order) && days[order[j+1]] {
+			j++
+		}
+		if j-i >= 2 {
+			parts = append(parts, order[i].String()[:3]+"–"+order[j].String()[:3])
+		} else {
+			for k := i; k <= j; k++ {
+				parts = append(parts, order[k].String()[:3])
+			}
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
+
+// summaryClockRange formats a time range compactly (e.g., 6am–9pm, 1–2:30pm).
+func summaryClockRange(start, end schema.ClockTime) string {
+	a, apA := summaryClock(start)
+	b, apB := summaryClock(end)
+	if apA == apB {
+		return a + "–" + b + apB
+	}
+	return a + apA + "–" + b + apB
+}
+
+// summaryClock formats a time as an hour with optional minutes, ignoring the
+// day, and returns the am/pm suffix separately.
+func summaryClock(t schema.ClockTime) (string, string) {
+	_, hh, mm := t.Split()
+	ap := "am"
+	if hh >= 12 {
+		ap = "pm"
+		hh -= 12
+	}
+	if hh == 0 {
+		hh = 12
+	}
+	s := strconv.Itoa(hh)
+	if mm != 0 {
+		s += ":" + strconv.Itoa(mm/10) + strconv.Itoa(mm%10)
+	}
+	return s, ap
+}
+
 func daysInMonth(year int, month time.Month) int {
 	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
 }
@@ -1,16 +1,19 @@
 package routes
 
 import (
+	"archive/tar"
 	"bufio"
 	"bytes"
 	"cmp"
 	"context"
 	"crypto/sha1"
 	"encoding/base32"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
 	"net/http"
 	"net/url"
 	"runtime"
@@ -22,7 +25,8 @@ import (
 	"weak"
 
 	"github.com/a-h/templ"
-	"github.com/klauspost/compress/zip"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
 	"github.com/pgaskin/ottrec-website/internal/httpx"
 	"github.com/pgaskin/ottrec-website/pkg/ottrecdata"
 	"github.com/pgaskin/ottrec-website/pkg/ottrecexp"
@@ -32,8 +36,20 @@ import (
 )
 
 type DataConfig struct {
-	Host  string
-	Cache *ottrecdata.Cache
+	Host     string
+	Cache    *ottrecdata.Cache
+	Validate bool // enable the validation endpoint (don't enable in production)
+
+	// MaxExportSize is the maximum size of an uncompressed export. If zero,
+	// there is no limit.
+	MaxExportSize int64
+
+	// Branches contains additional branches (e.g., for previewing scraper
+	// changes), which are served under /v1-NAME/ and /export-NAME/.
+	Branches map[string]*ottrecdata.Cache
+
+	// Static configures how static assets are compressed and served.
+	Static static.Options
 }
 
 func Data(cfg DataConfig) (http.Handler, error) {
@@ -43,6 +59,17 @@ func Data(cfg DataConfig) (http.Handler, error) {
 	if cfg.Cache == nil {
 		return nil, fmt.Errorf("no cache specified")
 	}
+	if err := cfg.Static.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid static options: %w", err)
+	}
+	for name, cache := range cfg.Branches {
+		if name == "" || strings.Trim(name, "abcdefghijklmnopqrstuvwxyz0123456789-") != "" {
+			return nil, fmt.Errorf("invalid branch name %q", name)
+		}
+		if cache == nil {
+			return nil, fmt.Errorf("no cache specified for branch %q", name)
+		}
+	}
 
 	mux := http.NewServeMux()
 
@@ -53,15 +80,33 @@ func Data(cfg DataConfig) (http.Handler, error) {
 		Cache:                 cfg.Cache,
 		MaxHistoricalVersions: 50,
 	})
-	mux.Handle("/v1/", &dataAPIv1{
-		Base:  "/v1/",
-		Cache: cfg.Cache,
-	})
+	for _, name := range slices.Sorted(maps.Keys(cfg.Branches)) {
+		mux.Handle("/v1-"+name+"/", &dataAPIv1{
+			Base:         "/v1-" + name + "/",
+			Cache:        cfg.Branches[name],
+			SinceTimeout: 30 * time.Second,
+		})
+		mux.Handle("/export-"+name+"/", &dataExportHandler{
+			Base:    "/export-" + name + "/",
+			Cache:   cfg.Branches[name],
+			MaxSize: cfg.MaxExportSize,
+		})
+	}
+	api := &dataAPIv1{
+		Base:         "/v1/",
+		Cache:        cfg.Cache,
+		SinceTimeout: 30 * time.Second,
+	}
+	if cfg.Validate {
+		api.ValidateLimit = 64 << 20
+	}
+	mux.Handle("/v1/", api)
 	mux.Handle("/export/", &dataExportHandler{
-		Base:  "/export/",
-		Cache: cfg.Cache,
+		Base:    "/export/",
+		Cache:   cfg.Cache,
+		MaxSize: cfg.MaxExportSize,
 	})
-	mux.Handle("/static/", static.Handler(static.Data))
+	mux.Handle("/static/", static.HandlerWithOptions(static.Data, cfg.Static))
 
 	// so if they panic, they panic early
 	dataExportSchemaCSV()
@@ -77,91 +122,249 @@ type dataHomeHandler struct {
 }
 
 func (h *dataHomeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept")
 	w.Header().Add("Vary", "Accept-Encoding")
 	w.Header().Set("Cache-Control", "public, no-cache")
 
-	if r.URL.RawQuery != "" {
+	// only allow a valid before id
+	var before, query string
+	if v := r.URL.Query().Get("before"); ottrecdata.IsID(v) {
+		before, query = v, "before="+v
+	}
+	if r.URL.RawQuery != query {
+		u := r.URL.EscapedPath()
+		if query != "" {
+			u += "?" + query
+		}
 		w.Header().Set("Cache-Control", "no-store")
-		http.Redirect(w, r, r.URL.EscapedPath(), http.StatusTemporaryRedirect)
+		http.Redirect(w, r, u, http.StatusTemporaryRedirect)
 		return
 	}
 
 	latest, _, _, err := h.Cache.ResolveVersion(r.Context(), "latest")
 	if err != nil {
 		slog.Error("data: failed to resolve latest version", "error", err)
-		h.serveError(w, "internal server error: "+err.Error(), http.StatusInternalServerError)
+		httpError(w, r, "internal server error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	if err := templates.Render(w, r, templates.WebsiteErrorPage, latest, func() (c templ.Component, status int, err error) {
-		versions := slices.Collect(iterLimit(h.Cache.DataVersions(r.Context())(&err), h.MaxHistoricalVersions))
+	if httpx.NegotiateContent(r.Header.Values("Accept"), []string{"text/html", "application/json"}) == "application/json" {
+		h.serveJSON(w, r, latest, before)
+		return
+	}
+
+	lang := templates.NegotiateLanguage(w, r)
+	if err := templates.Render(w, r, templates.WebsiteErrorPage, lang, latest, func() (c templ.Component, status int, err error) {
+		versions, next, err := h.versions(r.Context(), before)
 		if err != nil {
 			return nil, http.StatusInternalServerError, fmt.Errorf("get data versions: %w", err)
 		}
-		if len(versions) == 0 {
+		var latest []ottrecdata.DataVersion
+		if before == "" {
+			latest = versions
+		} else {
+			latest = slices.Collect(iterLimit(h.Cache.DataVersions(r.Context())(&err), 1))
+			if err != nil {
+				return nil, http.StatusInternalServerError, fmt.Errorf("get latest data version: %w", err)
+			}
+		}
+		if len(latest) == 0 {
 			return nil, http.StatusServiceUnavailable, fmt.Errorf("data not available, try again later")
 		}
+		blobs, blobRefs, _, blobsStored, blobsLogical, err := h.Cache.BlobStats(r.Context())
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("get blob stats: %w", err)
+		}
+		canonical := reqScheme(r) + "://" + h.Host + "/"
+		if query != "" {
+			canonical += "?" + query
+		}
 		return templates.DataHome(templates.DataHomeParams{
-			Canonical: reqScheme(r) + "://" + h.Host + "/",
-			Latest:    versions[0],
-			Versions:  versions,
+			Lang:         lang,
+			Canonical:    canonical,
+			Latest:       latest[0],
+			Versions:     versions,
+			Before:       before,
+			Next:         next,
+			Blobs:        blobs,
+			BlobRefs:     blobRefs,
+			BlobsStored:  blobsStored,
+			BlobsLogical: blobsLogical,
 		}), http.StatusOK, nil
 	}); err != nil {
 		slog.Error("data: failed to render page", "url", r.URL.String(), "error", err)
 	}
 }
 
-func (h *dataHomeHandler) serveError(w http.ResponseWriter, message string, code int) {
-	d := w.Header()
-	d.Set("Content-Length", strconv.Itoa(len(message)+1))
-	d.Set("Content-Type", "text/plain; charset=utf-8")
-	d.Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(code)
-	io.WriteString(w, message+"\n")
+// serveJSON serves the version list in the same format as the v1 API list.
+func (h *dataHomeHandler) serveJSON(w http.ResponseWriter, r *http.Request, latest, before string) {
+	ctx := r.Context()
+
+	// the list only changes when there's a new version
+	etag := `W/"` + latest + `-` + before + `-json"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if slices.Contains(r.Header.Values("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	versions, _, err := h.versions(ctx, before)
+	if err != nil {
+		if canceled := ctx.Err() != nil; !canceled {
+			slog.Error("data: failed to get data versions", "error", err)
+			httpError(w, r, "internal server error: "+err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	buf := []byte{'['}
+	for i, ver := range versions {
+		if i != 0 {
+			buf = append(buf, ',')
+		}
+		buf = appendDataVersionJSON(buf, ver)
+	}
+	buf = append(buf, "]\n"...)
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(buf)
+	}
+}
+
+// versions gets up to MaxHistoricalVersions versions older than before (or
+// from the latest if empty), and the id to continue from if there are more.
+func (h *dataHomeHandler) versions(ctx context.Context, before string) ([]ottrecdata.DataVersion, string, error) {
+	seq := h.Cache.DataVersions(ctx)
+	if before != "" {
+		seq = h.Cache.DataVersionsBefore(ctx, before)
+	}
+	if h.MaxHistoricalVersions < 0 {
+		var err error
+		versions := slices.Collect(seq(&err))
+		return versions, "", err
+	}
+	var err error
+	versions := slices.Collect(iterLimit(seq(&err), h.MaxHistoricalVersions+1))
+	if err != nil {
+		return nil, "", err
+	}
+	var next string
+	if len(versions) > h.MaxHistoricalVersions && h.MaxHistoricalVersions != 0 {
+		versions = versions[:h.MaxHistoricalVersions]
+		next = versions[len(versions)-1].ID
+	}
+	return versions, next, nil
 }
 
 type dataExportHandler struct {
-	Base  string
-	Cache *ottrecdata.Cache
+	Base    string
+	Cache   *ottrecdata.Cache
+	MaxSize int64 // for each uncompressed export, zero for no limit
 
 	cacheMu sync.Mutex
 	cache   map[string]weak.Pointer[dataExportData]
 
 	latestMu sync.Mutex
 	latest   *dataExportData
+
+	encodedMu sync.Mutex
+	encoded   []*dataExportEncoded // lru, most recently used last
+
+	historyMu sync.Mutex // held while streaming the history archive
+}
+
+// dataExportEncoded is a content-encoded export. It is evicted when the
+// corresponding [dataExportData] is freed.
+type dataExportEncoded struct {
+	id       string
+	ext      string
+	encoding string
+	buf      []byte
 }
 
+// dataExportMaxEncoded is the maximum number of encoded exports to keep.
+const dataExportMaxEncoded = 8
+
 type dataExportData struct {
 	id    string
+	blob  string // pb hash
 	ready <-chan struct{}
 
 	err      error
+	exp      *ottrecexp.Data // for paging
 	csv      []byte
 	csvETag  string
 	csvErr   error
+	bom      []byte // csv with a bom
+	bomETag  string
+	bomErr   error
 	json     []byte
 	jsonETag string
 	jsonErr  error
+	html     []byte
+	htmlETag string
+	htmlErr  error
+
+	// indented json, generated on demand
+	jsonPrettyOnce sync.Once
+	jsonPretty     []byte
+	jsonPrettyErr  error
+
+	// json without unstable fields, generated on demand
+	jsonStableOnce sync.Once
+	jsonStable     []byte
+	jsonStableErr  error
 }
 
 // lazy since not everything needs it, and to give a chance to set stuff like
 // [ottrecsimple.JSONSchemaID]
 var (
-	dataExportSchemaJSON = sync.OnceValue(func() []byte {
-		return append(ottrecexp.JSONSchema(), '\n')
+	dataExportSchemaJSON = sync.OnceValue(func() map[string][]byte {
+		return dataExportSchemaEncode(append(ottrecexp.JSONSchema(), '\n'))
 	})
-	dataExportSchemaCSV = sync.OnceValue(func() []byte {
-		return ottrecexp.CSVSchema()
+	dataExportSchemaCSV = sync.OnceValue(func() map[string][]byte {
+		return dataExportSchemaEncode(ottrecexp.CSVSchema())
 	})
 )
 
+// dataExportSchemaEncode compresses b with each supported content-encoding.
+func dataExportSchemaEncode(b []byte) map[string][]byte {
+	m := map[string][]byte{"": b}
+	for _, encoding := range []string{"gzip", "zstd"} {
+		var buf bytes.Buffer
+		if err := compress(&buf, encoding, b); err != nil {
+			panic(fmt.Errorf("wtf: compress schema: %w", err))
+		}
+		m[encoding] = buf.Bytes()
+	}
+	return m
+}
+
 func (h *dataExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		w.Header().Set("Allow", "GET, HEAD")
-		h.serveError(w, "method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
+	// these are the only ones which take a query
+	if r.URL.Path == h.Base+"history.tar" {
+		h.serveHistory(w, r)
+		return
+	}
+	if r.URL.RawQuery != "" {
+		if rest, ok := strings.CutPrefix(r.URL.Path, h.Base); ok {
+			if spec, ok := strings.CutSuffix(rest, ".json"); ok && !strings.Contains(spec, "/") && !strings.Contains(spec, ".") && spec != "schema" {
+				h.serveJSONPage(w, r, spec)
+				return
+			}
+		}
+	}
+
 	if r.URL.RawQuery != "" {
 		w.Header().Set("Cache-Control", "no-store")
 		http.Redirect(w, r, r.URL.EscapedPath(), http.StatusTemporaryRedirect)
@@ -177,70 +380,131 @@ func (h *dataExportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			h.serveSchemaCSV(w, r)
 			return
 		}
-		if spec, ok := strings.CutSuffix(rest, ".json"); ok {
-			h.serveJSON(w, r, spec)
+		if rest == "version" {
+			h.serveVersion(w, r)
 			return
 		}
-		if spec, ok := strings.CutSuffix(rest, ".csv.zip"); ok {
-			h.serveCSV(w, r, spec)
-			return
+		for _, f := range dataExportFormats {
+			if spec, ok := strings.CutSuffix(rest, f.Ext); ok {
+				if f.Stream != nil && f.Stream(h, w, r, spec, f) {
+					return
+				}
+				h.serveFile(w, r, spec, f)
+				return
+			}
 		}
 	}
 
-	h.serveError(w, "not found", http.StatusNotFound)
+	httpError(w, r, "not found", http.StatusNotFound)
 }
 
 func (h *dataExportHandler) redirectFile(w http.ResponseWriter, spec, ext string) {
 	var u strings.Builder
 	u.WriteString(h.Base)
 	u.WriteString(spec)
-	u.WriteString(url.PathEscape(ext))
+	u.WriteString(ext)
 	w.Header().Set("Location", u.String())
 	w.Header().Set("Content-Length", "0")
 	w.WriteHeader(http.StatusTemporaryRedirect)
 }
 
-func (h *dataExportHandler) serveError(w http.ResponseWriter, message string, code int) {
-	d := w.Header()
-	d.Set("Content-Length", strconv.Itoa(len(message)+1))
-	d.Set("Content-Type", "text/plain; charset=utf-8")
-	d.Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(code)
-	io.WriteString(w, message+"\n")
+func (h *dataExportHandler) serveSchemaJSON(w http.ResponseWriter, r *http.Request) {
+	h.serveSchema(w, r, "application/schema+json; charset=utf-8", dataExportSchemaJSON())
 }
 
-func (h *dataExportHandler) serveSchemaJSON(w http.ResponseWriter, r *http.Request) {
-	b := dataExportSchemaJSON()
+func (h *dataExportHandler) serveSchemaCSV(w http.ResponseWriter, r *http.Request) {
+	h.serveSchema(w, r, "text/csv; charset=utf-8", dataExportSchemaCSV())
+}
+
+func (h *dataExportHandler) serveSchema(w http.ResponseWriter, r *http.Request, contentType string, encoded map[string][]byte) {
+	encoding := httpx.NegotiateContent(r.Header.Values("Accept-Encoding"), []string{"", "gzip", "zstd"})
+	b := encoded[encoding]
 	d := w.Header()
+	d.Add("Vary", "Accept-Encoding")
+	if encoding != "" {
+		d.Set("Content-Encoding", encoding)
+	}
 	d.Set("Content-Length", strconv.Itoa(len(b)))
-	d.Set("Content-Type", "application/schema+json; charset=utf-8")
+	d.Set("Content-Type", contentType)
 	w.WriteHeader(http.StatusOK)
-	w.Write(b)
+	if r.Method != http.MethodHead {
+		w.Write(b)
+	}
 }
 
-func (h *dataExportHandler) serveSchemaCSV(w http.ResponseWriter, r *http.Request) {
-	b := dataExportSchemaCSV()
+func (h *dataExportHandler) serveVersion(w http.ResponseWriter, r *http.Request) {
+	b := []byte(`{"export":` + strconv.Itoa(ottrecexp.SchemaVersion) + `,"cache":` + strconv.Itoa(ottrecdata.SchemaVersion) + "}\n")
 	d := w.Header()
 	d.Set("Content-Length", strconv.Itoa(len(b)))
-	d.Set("Content-Type", "text/csv; charset=utf-8")
+	d.Set("Content-Type", "application/json; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
-	w.Write(b)
+	if r.Method != http.MethodHead {
+		w.Write(b)
+	}
+}
+
+// dataExportFormat is a file served by [dataExportHandler].
+type dataExportFormat struct {
+	Ext         string // suffix after the spec, including the query if any
+	ContentType string
+	Compress    bool // whether to negotiate a content encoding
+	Uncached    bool // whether to skip caching the encoded file (e.g., for pages since they'd evict the full exports)
+	Resolve     func(h *dataExportHandler, ctx context.Context, spec string) (buf []byte, etag, id string, err error)
+	Stream      func(h *dataExportHandler, w http.ResponseWriter, r *http.Request, spec string, f dataExportFormat) bool // optional, returns false to fall back to Resolve
+}
+
+// dataExportFormats contains the files served by [dataExportHandler], matched
+// by suffix in order.
+var dataExportFormats = []dataExportFormat{
+	{Ext: "/html.json", ContentType: "application/json", Compress: true, Resolve: (*dataExportHandler).resolveHTML},
+	{Ext: ".pretty.json", ContentType: "application/json", Compress: true, Resolve: (*dataExportHandler).resolvePrettyJSON},
+	{Ext: ".json", ContentType: "application/json", Compress: true, Resolve: (*dataExportHandler).resolveJSON, Stream: (*dataExportHandler).streamJSON},
+	{Ext: ".bom.csv.zip", ContentType: "application/zip", Resolve: (*dataExportHandler).resolveBOMCSV, Stream: (*dataExportHandler).streamBOMCSV},
+	{Ext: ".csv.zip", ContentType: "application/zip", Resolve: (*dataExportHandler).resolveCSV, Stream: (*dataExportHandler).streamCSV},
+}
+
+// dataExportStableFormat is the json export without unstable fields. It isn't
+// in [dataExportFormats] since it's selected by the query.
+var dataExportStableFormat = dataExportFormat{
+	Ext:         ".json?raw=0",
+	ContentType: "application/json",
+	Compress:    true,
+	Resolve:     (*dataExportHandler).resolveStableJSON,
 }
 
-func (h *dataExportHandler) serveCSV(w http.ResponseWriter, r *http.Request, spec string) {
+// serveFile resolves and serves an export file.
+func (h *dataExportHandler) serveFile(w http.ResponseWriter, r *http.Request, spec string, f dataExportFormat) {
 	w.Header().Set("Cache-Control", "public, max-age=60")
 
-	buf, etag, id, err := h.resolveCSV(r.Context(), spec)
+	var encoding string
+	if f.Compress {
+		// we do content encoding negotiation
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		// negotiate encoding
+		encoding = httpx.NegotiateContent(r.Header.Values("Accept-Encoding"), []string{"", "gzip", "zstd"})
+	}
+
+	if h.notModified(w, r, spec, f.Ext, encoding) {
+		return
+	}
+
+	buf, etag, id, err := f.Resolve(h, r.Context(), spec)
 	if err != nil {
 		if errors.Is(err, errInvalidSpecFormat) {
-			h.serveError(w, "invalid spec format "+strconv.Quote(spec), http.StatusBadRequest)
+			httpError(w, r, "invalid spec format "+strconv.Quote(spec), http.StatusBadRequest)
 		} else {
-			h.serveError(w, "internal error: "+err.Error(), http.StatusInternalServerError)
+			httpError(w, r, "internal error: "+err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
 	if buf == nil {
-		h.serveError(w, "no data found for "+strconv.Quote(spec), http.StatusNotFound)
+		if spec == "" || spec == "latest" {
+			slog.Error("export: no data available")
+			httpError(w, r, "no data available, try again later", http.StatusServiceUnavailable)
+		} else {
+			httpError(w, r, "no data found for "+strconv.Quote(spec), http.StatusNotFound)
+		}
 		return
 	}
 
@@ -248,52 +512,521 @@ func (h *dataExportHandler) serveCSV(w http.ResponseWriter, r *http.Request, spe
 	// better caching) as long as it isn't a latest/latest-relative request (so
 	// refreshing will still get the latest one for that).
 	if !strings.HasPrefix(spec, "latest") && spec != id {
-		h.redirectFile(w, id, ".csv.zip")
+		h.redirectFile(w, id, f.Ext)
 		return
 	}
 
 	w.Header().Set("Cache-Control", "public, no-cache")
+
+	if encoding != "" {
+		if f.Uncached {
+			var b bytes.Buffer
+			err = compress(&b, encoding, buf)
+			buf = b.Bytes()
+		} else {
+			buf, err = h.encode(id, f.Ext, encoding, buf)
+		}
+		if err != nil {
+			slog.Error("export: failed to encode file", "id", id, "ext", f.Ext, "encoding", encoding, "error", err)
+			httpError(w, r, "internal error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Encoding", encoding)
+		etag = strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+	}
+
 	w.Header().Set("ETag", etag)
-	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Type", f.ContentType)
 	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf))
 }
 
-func (h *dataExportHandler) serveJSON(w http.ResponseWriter, r *http.Request, spec string) {
-	w.Header().Set("Cache-Control", "public, max-age=60")
+// streamJSON streams the json export for an uncached id.
+func (h *dataExportHandler) streamJSON(w http.ResponseWriter, r *http.Request, spec string, f dataExportFormat) bool {
+	return h.stream(w, r, spec, f, func(w io.Writer, exp *ottrecexp.Data) error {
+		return ottrecexp.WriteJSON(exp, w)
+	})
+}
+
+// streamCSV streams the csv zip export for an uncached id.
+func (h *dataExportHandler) streamCSV(w http.ResponseWriter, r *http.Request, spec string, f dataExportFormat) bool {
+	return h.stream(w, r, spec, f, func(w io.Writer, exp *ottrecexp.Data) error {
+		return exportCSV(w, exp, false)
+	})
+}
+
+// streamBOMCSV streams the csv zip export with a bom for an uncached id.
+func (h *dataExportHandler) streamBOMCSV(w http.ResponseWriter, r *http.Request, spec string, f dataExportFormat) bool {
+	return h.stream(w, r, spec, f, func(w io.Writer, exp *ottrecexp.Data) error {
+		return exportCSV(w, exp, true)
+	})
+}
+
+// stream writes an export for an uncached id directly to the response rather
+// than preparing and caching every export format for it. This saves memory for
+// rarely requested versions at the cost of exporting it again for every
+// request. If there is a size limit, the uncompressed export is buffered up to
+// it (and compressed) so it can fail before the response is written and so the
+// Content-Length can be set. It returns false if the request should be handled
+// by serveFile instead (i.e., if it's a HEAD request, if it's the latest version
+// or otherwise already prepared, if it isn't a canonical url, or if the spec
+// couldn't be resolved).
+func (h *dataExportHandler) stream(w http.ResponseWriter, r *http.Request, spec string, f dataExportFormat, write func(io.Writer, *ottrecexp.Data) error) bool {
+	ctx := r.Context()
 
-	buf, etag, id, err := h.resolveJSON(r.Context(), spec)
+	// serveFile knows the size without writing the body
+	if r.Method == http.MethodHead {
+		return false
+	}
+	if !ottrecdata.IsID(spec) || h.prepare(spec, true) != nil {
+		return false
+	}
+	id, etag, err := h.etag(ctx, spec, f.Ext)
+	if err != nil || id != spec {
+		return false
+	}
+	blob, err := h.blob(ctx, id)
 	if err != nil {
-		if errors.Is(err, errInvalidSpecFormat) {
-			h.serveError(w, "invalid spec format "+strconv.Quote(spec), http.StatusBadRequest)
-		} else {
-			h.serveError(w, "internal error: "+err.Error(), http.StatusInternalServerError)
+		return false
+	}
+
+	w.Header().Set("Cache-Control", "public, no-cache")
+
+	var encoding string
+	if f.Compress {
+		// we do content encoding negotiation
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		// negotiate encoding
+		encoding = httpx.NegotiateContent(r.Header.Values("Accept-Encoding"), []string{"", "gzip", "zstd"})
+		if encoding != "" {
+			etag = strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+		}
+	}
+	w.Header().Set("ETag", etag)
+
+	// check etag match
+	if slices.Contains(r.Header.Values("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+
+	exp, err := h.export(ctx, id, blob)
+	if err != nil {
+		slog.Error("export: failed to stream file", "id", id, "ext", f.Ext, "error", err)
+		httpError(w, r, "internal error: "+err.Error(), http.StatusInternalServerError)
+		return true
+	}
+
+	// the size limit needs to be checked before writing the header so it can
+	// fail properly, so buffer it (up to the limit) if there is one
+	var buf []byte
+	if h.MaxSize != 0 {
+		var b bytes.Buffer
+		if err := write(h.limit(&b), exp); err != nil {
+			slog.Error("export: failed to stream file", "id", id, "ext", f.Ext, "error", err)
+			httpError(w, r, "internal error: "+err.Error(), http.StatusInternalServerError)
+			return true
+		}
+		buf = b.Bytes()
+		if encoding != "" {
+			var zb bytes.Buffer
+			if err := compress(&zb, encoding, buf); err != nil {
+				slog.Error("export: failed to encode file", "id", id, "ext", f.Ext, "encoding", encoding, "error", err)
+				httpError(w, r, "internal error: "+err.Error(), http.StatusInternalServerError)
+				return true
+			}
+			buf = zb.Bytes()
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	}
+
+	w.Header().Set("Content-Type", f.ContentType)
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.WriteHeader(http.StatusOK)
+
+	if buf != nil {
+		_, err = w.Write(buf)
+	} else {
+		var zw io.WriteCloser
+		if zw, err = compressWriter(w, encoding); err == nil {
+			if err = write(zw, exp); err == nil {
+				err = zw.Close()
+			}
+		}
+	}
+	if err != nil && ctx.Err() == nil {
+		slog.Error("export: failed to stream file", "id", id, "ext", f.Ext, "error", err)
+	}
+	return true
+}
+
+// serveJSONPage serves the json export with only a subset of the activity
+// table.
+func (h *dataExportHandler) serveJSONPage(w http.ResponseWriter, r *http.Request, spec string) {
+	var (
+		limit  = -1
+		offset = 0
+		raw    = true
+	)
+	for k, v := range r.URL.Query() {
+		var p *int
+		switch k {
+		case "activityLimit":
+			p = &limit
+		case "activityOffset":
+			p = &offset
+		case "raw":
+		default:
+			httpError(w, r, "invalid parameter "+strconv.Quote(k), http.StatusBadRequest)
+			return
+		}
+		if len(v) != 1 {
+			httpError(w, r, "parameter "+strconv.Quote(k)+" specified more than once", http.StatusBadRequest)
+			return
+		}
+		if p == nil {
+			switch v[0] {
+			case "0":
+				raw = false
+			case "1":
+				raw = true
+			default:
+				httpError(w, r, "invalid "+k+" "+strconv.Quote(v[0]), http.StatusBadRequest)
+				return
+			}
+			continue
 		}
+		n, err := strconv.Atoi(v[0])
+		if err != nil || n < 0 || (p == &limit && n == 0) {
+			httpError(w, r, "invalid "+k+" "+strconv.Quote(v[0]), http.StatusBadRequest)
+			return
+		}
+		*p = n
+	}
+
+	// the full export without unstable fields is cached like the other ones
+	if !raw && offset == 0 && limit == -1 {
+		h.serveFile(w, r, spec, dataExportStableFormat)
 		return
 	}
-	if buf == nil {
-		h.serveError(w, "no data found for "+strconv.Quote(spec), http.StatusNotFound)
+
+	// canonical query for the redirect and encoding cache
+	q := "?activityOffset=" + strconv.Itoa(offset)
+	if limit != -1 {
+		q += "&activityLimit=" + strconv.Itoa(limit)
+	}
+	if !raw {
+		q += "&raw=0"
+	}
+
+	h.serveFile(w, r, spec, dataExportFormat{
+		Ext:         ".json" + q,
+		ContentType: "application/json",
+		Compress:    true,
+		Uncached:    true,
+		Resolve: func(h *dataExportHandler, ctx context.Context, spec string) ([]byte, string, string, error) {
+			d, err := h.ready(ctx, spec)
+			if d == nil {
+				return nil, "", "", err
+			}
+			if d.jsonErr != nil {
+				return nil, "", d.id, d.jsonErr
+			}
+
+			page := *d.exp
+			page.Activity = page.Activity[min(offset, len(page.Activity)):]
+			if limit != -1 {
+				page.Activity = page.Activity[:min(limit, len(page.Activity))]
+			}
+			w.Header().Set("X-Activity-Total", strconv.Itoa(len(d.exp.Activity)))
+
+			var b bytes.Buffer
+			if err := ottrecexp.WriteJSONWithOptions(&page, &b, ottrecexp.JSONOptions{OmitUnstable: !raw}); err != nil {
+				return nil, "", d.id, err
+			}
+			return b.Bytes(), dataExportETag(d.blob, ".json"+q), d.id, nil
+		},
+	})
+}
+
+// serveHistory streams a tar of the pb for every version updated within the
+// optional from/to dates (YYYY-MM-DD, inclusive), oldest first.
+func (h *dataExportHandler) serveHistory(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	var from, to time.Time
+	for k, v := range r.URL.Query() {
+		var t *time.Time
+		switch k {
+		case "from":
+			t = &from
+		case "to":
+			t = &to
+		default:
+			httpError(w, r, "invalid parameter "+strconv.Quote(k), http.StatusBadRequest)
+			return
+		}
+		if len(v) != 1 {
+			httpError(w, r, "parameter "+strconv.Quote(k)+" specified more than once", http.StatusBadRequest)
+			return
+		}
+		d, err := time.ParseInLocation("2006-01-02", v[0], ottrecdata.TZ)
+		if err != nil {
+			httpError(w, r, "invalid "+k+" date "+strconv.Quote(v[0]), http.StatusBadRequest)
+			return
+		}
+		*t = d
+	}
+	if !to.IsZero() {
+		to = to.AddDate(0, 0, 1)
+	}
+
+	// this is heavy, so only allow one at a time
+	if !h.historyMu.TryLock() {
+		w.Header().Set("Retry-After", "60")
+		httpError(w, r, "another history download is in progress, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.historyMu.Unlock()
+
+	// resolve everything first so we can still return an error
+	type historyFile struct {
+		id      string
+		name    string
+		hash    string
+		updated time.Time
+	}
+	var (
+		files []historyFile
+		err   error
+	)
+	for ver := range h.Cache.DataVersions(ctx)(&err) {
+		if !from.IsZero() && ver.Updated.Before(from) {
+			break // newest first
+		}
+		if !to.IsZero() && !ver.Updated.Before(to) {
+			continue
+		}
+		files = append(files, historyFile{
+			id:      ver.ID,
+			name:    ver.Updated.In(ottrecdata.TZ).Format("2006-01-02") + "_r" + strconv.Itoa(ver.Revision) + "_" + ver.ID + ".pb",
+			updated: ver.Updated,
+		})
+	}
+	if err != nil {
+		slog.Error("export: failed to list versions for history", "error", err)
+		httpError(w, r, "internal server error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
+	slices.Reverse(files)
+	for i, f := range files {
+		for hash, format := range h.Cache.DataFormats(ctx, f.id)(&err) {
+			if format == "pb" {
+				files[i].hash = hash
+				break
+			}
+		}
+		if err != nil {
+			slog.Error("export: failed to resolve formats for history", "id", f.id, "error", err)
+			httpError(w, r, "internal server error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	files = slices.DeleteFunc(files, func(f historyFile) bool {
+		return f.hash == ""
+	})
 
-	// if it isn't the canonical URL, redirect it to the canonical one (for
-	// better caching) as long as it isn't a latest/latest-relative request (so
-	// refreshing will still get the latest one for that).
-	if !strings.HasPrefix(spec, "latest") && spec != id {
-		h.redirectFile(w, id, ".json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", `attachment; filename="ottrec_history.tar"`)
+	w.WriteHeader(http.StatusOK)
+
+	if r.Method == http.MethodHead {
 		return
 	}
 
-	w.Header().Set("Cache-Control", "public, no-cache")
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		ok, err := h.Cache.ReadBlob(ctx, f.hash, false, func(r io.Reader, size int64) error {
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     f.name,
+				Size:     size,
+				Mode:     0644,
+				ModTime:  f.updated,
+				Format:   tar.FormatPAX,
+			}); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, contextReader{ctx, r})
+			return err
+		})
+		if err == nil && !ok {
+			err = fmt.Errorf("missing blob %s", f.hash)
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("export: failed to write history", "name", f.name, "error", err)
+			}
+			return // the response will be truncated
+		}
+	}
+	if err := tw.Close(); err != nil && ctx.Err() == nil {
+		slog.Error("export: failed to write history", "error", err)
+	}
+}
+
+// encode gets the cached content-encoded buf for the export id and extension,
+// compressing and caching it if required.
+func (h *dataExportHandler) encode(id, ext, encoding string, buf []byte) ([]byte, error) {
+	h.encodedMu.Lock()
+	for i, e := range h.encoded {
+		if e.id == id && e.ext == ext && e.encoding == encoding {
+			h.encoded = append(slices.Delete(h.encoded, i, i+1), e)
+			h.encodedMu.Unlock()
+			return e.buf, nil
+		}
+	}
+	h.encodedMu.Unlock()
 
-	// TODO: negotiate and cache compression
+	// compress it outside the lock since it may take a while (it's fine if
+	// we end up doing it more than once concurrently)
+	var b bytes.Buffer
+	if err := compress(&b, encoding, buf); err != nil {
+		return nil, err
+	}
+	slog.Debug("export: encoded json", "id", id, "ext", ext, "encoding", encoding, "size", len(buf), "encoded_size", b.Len())
 
-	w.Header().Set("ETag", etag)
-	w.Header().Set("Content-Type", "application/json")
-	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf))
+	h.encodedMu.Lock()
+	defer h.encodedMu.Unlock()
+	h.encoded = slices.DeleteFunc(h.encoded, func(e *dataExportEncoded) bool {
+		return e.id == id && e.ext == ext && e.encoding == encoding
+	})
+	if n := len(h.encoded) - dataExportMaxEncoded + 1; n > 0 {
+		h.encoded = slices.Delete(h.encoded, 0, n)
+	}
+	h.encoded = append(h.encoded, &dataExportEncoded{
+		id:       id,
+		ext:      ext,
+		encoding: encoding,
+		buf:      b.Bytes(),
+	})
+	return b.Bytes(), nil
+}
+
+// evictEncoded removes all cached encoded exports for the export id.
+func (h *dataExportHandler) evictEncoded(id string) {
+	h.encodedMu.Lock()
+	defer h.encodedMu.Unlock()
+	h.encoded = slices.DeleteFunc(h.encoded, func(e *dataExportEncoded) bool {
+		return e.id == id
+	})
 }
 
 var errInvalidSpecFormat = errors.New("invalid spec format")
 
+// dataExportETag returns the etag for an export of the pb blob. Since exports
+// are deterministic for a specific binary, this can be checked before actually
+// doing the export.
+func dataExportETag(blob, ext string) string {
+	sum := sha1.Sum([]byte(exehash + "-" + blob + "-" + ext))
+	return `W/"` + base32.StdEncoding.EncodeToString(sum[:]) + `"`
+}
+
+// etag resolves spec and returns the id and export etag for ext without
+// preparing the export. If the spec doesn't match anything, the id is empty.
+func (h *dataExportHandler) etag(ctx context.Context, spec, ext string) (string, string, error) {
+	id, _, ok, err := h.Cache.ResolveVersion(ctx, cmp.Or(spec, "latest"))
+	if err != nil {
+		return "", "", fmt.Errorf("resolve %q: %w", spec, err)
+	}
+	if !ok {
+		return "", "", errInvalidSpecFormat
+	}
+	if id == "" {
+		return "", "", nil
+	}
+	blob, err := h.blob(ctx, id)
+	if err != nil {
+		return "", "", err
+	}
+	return id, dataExportETag(blob, ext), nil
+}
+
+// notModified writes a 304 if the request has a matching If-None-Match for the
+// export etag of spec. Any errors are ignored since they'll be handled when
+// actually resolving it.
+func (h *dataExportHandler) notModified(w http.ResponseWriter, r *http.Request, spec, ext, encoding string) bool {
+	if r.Header.Get("If-None-Match") == "" {
+		return false
+	}
+	id, etag, err := h.etag(r.Context(), spec, ext)
+	if err != nil || id == "" {
+		return false
+	}
+	if !strings.HasPrefix(spec, "latest") && spec != id {
+		return false // will be redirected
+	}
+	if encoding != "" {
+		etag = strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+	}
+	if !slices.Contains(r.Header.Values("If-None-Match"), etag) {
+		return false
+	}
+	w.Header().Set("Cache-Control", "public, no-cache")
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// export loads and exports the pb blob for id.
+func (h *dataExportHandler) export(ctx context.Context, id, blob string) (*ottrecexp.Data, error) {
+	var pb []byte
+	exists, err := h.Cache.ReadBlob(ctx, blob, false, func(r io.Reader, size int64) error {
+		pb = make([]byte, size)
+		_, err := io.ReadFull(r, pb)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("load data %q: read pb: %w", id, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("load data %q: missing blob", id)
+	}
+
+	idx, err := new(ottrecidx.Indexer).Load(pb)
+	if err != nil {
+		return nil, fmt.Errorf("load data %q: %w", id, err)
+	}
+
+	exp, err := ottrecexp.New(idx.Data())
+	if err != nil {
+		return nil, fmt.Errorf("export data %q: %w", id, err)
+	}
+	return exp, nil
+}
+
+// blob gets the pb hash for id.
+func (h *dataExportHandler) blob(ctx context.Context, id string) (string, error) {
+	var blob string
+	var err error
+	for hash, format := range h.Cache.DataFormats(ctx, id)(&err) {
+		if format == "pb" {
+			blob = hash
+			break
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("resolve format: %w", err)
+	}
+	if blob == "" {
+		return "", fmt.Errorf("no pb found")
+	}
+	return blob, nil
+}
+
 func (h *dataExportHandler) resolve(spec string) (*dataExportData, error) {
 	if spec == "" {
 		spec = "latest"
@@ -362,6 +1095,7 @@ func (h *dataExportHandler) prepare(id string, cachedOnly bool) *dataExportData
 	}
 	runtime.AddCleanup(d, func(id string) {
 		slog.Info("export: freed unused cache", "id", id)
+		h.evictEncoded(id)
 	}, id)
 	h.cache[id] = weak.Make(d)
 
@@ -383,79 +1117,68 @@ func (h *dataExportHandler) prepare(id string, cachedOnly bool) *dataExportData
 				if d.csvErr != nil {
 					slog.Error("export: csv failed", "id", id, "error", d.csvErr)
 				}
+				if d.bomErr != nil {
+					slog.Error("export: csv with bom failed", "id", id, "error", d.bomErr)
+				}
 				if d.jsonErr != nil {
 					slog.Error("export: json failed", "id", id, "error", d.jsonErr)
 				}
-				slog.Debug("export: done", "id", id, "csv_size", len(d.csv), "json_size", len(d.json))
+				if d.htmlErr != nil {
+					slog.Error("export: html json failed", "id", id, "error", d.htmlErr)
+				}
+				slog.Debug("export: done", "id", id, "csv_size", len(d.csv), "json_size", len(d.json), "html_size", len(d.html))
 			}
 		}()
 
 		d.err = func() error {
 			defer close(r)
 
-			var blob string
-			var err error
-			for hash, format := range h.Cache.DataFormats(context.Background(), id)(&err) {
-				if format == "pb" {
-					blob = hash
-					break
-				}
-			}
-			if err != nil {
-				return fmt.Errorf("load data %q: resolve format: %w", id, err)
-			}
-			if blob == "" {
-				return fmt.Errorf("load data %q: no pb found", id)
-			}
-
-			var pb []byte
-			exists, err := h.Cache.ReadBlob(context.Background(), blob, false, func(r io.Reader, size int64) error {
-				pb = make([]byte, size)
-				_, err := io.ReadFull(r, pb)
-				return err
-			})
-			if err != nil {
-				return fmt.Errorf("load data %q: read pb: %w", id, err)
-			}
-			if !exists {
-				return fmt.Errorf("load data %q: missing blob", id)
-			}
-
-			idx, err := new(ottrecidx.Indexer).Load(pb)
+			blob, err := h.blob(context.Background(), id)
 			if err != nil {
 				return fmt.Errorf("load data %q: %w", id, err)
 			}
+			d.blob = blob
 
-			exp, err := ottrecexp.New(idx.Data())
+			exp, err := h.export(context.Background(), id, blob)
 			if err != nil {
-				return fmt.Errorf("export data %q: %w", id, err)
+				return err
 			}
+			d.exp = exp
 
 			buf := templ.GetBuffer()
 			defer templ.ReleaseBuffer(buf)
 
-			// note: we could have used the exehash and data hash as the etag to
-			// be able to check it before actually doing the export, but export
-			// is cheap, and this is simple enough (and still saves bandwidth,
-			// which is the point)
-
-			if err := exportCSV(buf, exp); err != nil {
+			if err := exportCSV(h.limit(buf), exp, false); err != nil {
 				d.csvErr = err
 			} else {
-				sum := sha1.Sum(buf.Bytes())
 				d.csv = slices.Clone(buf.Bytes())
-				d.csvETag = `W/"` + base32.StdEncoding.EncodeToString(sum[:]) + `"`
+				d.csvETag = dataExportETag(blob, ".csv.zip")
 			}
-			d.csvErr = exportCSV(buf, exp)
+			d.csvErr = exportCSV(h.limit(buf), exp, false)
+
+			buf.Reset()
 
+			if err := exportCSV(h.limit(buf), exp, true); err != nil {
+				d.bomErr = err
+			} else {
+				d.bom = slices.Clone(buf.Bytes())
+				d.bomETag = dataExportETag(blob, ".bom.csv.zip")
+			}
 			buf.Reset()
 
-			if err := ottrecexp.WriteJSON(exp, buf); err != nil {
+			if err := ottrecexp.WriteJSON(exp, h.limit(buf)); err != nil {
 				d.jsonErr = err
 			} else {
-				sum := sha1.Sum(buf.Bytes())
 				d.json = slices.Clone(buf.Bytes())
-				d.jsonETag = `W/"` + base32.StdEncoding.EncodeToString(sum[:]) + `"`
+				d.jsonETag = dataExportETag(blob, ".json")
+			}
+			buf.Reset()
+
+			if err := ottrecexp.WriteTableJSON(exp.HTML, h.limit(buf)); err != nil {
+				d.htmlErr = err
+			} else {
+				d.html = slices.Clone(buf.Bytes())
+				d.htmlETag = dataExportETag(blob, "/html.json")
 			}
 			buf.Reset()
 
@@ -466,87 +1189,211 @@ func (h *dataExportHandler) prepare(id string, cachedOnly bool) *dataExportData
 	return d
 }
 
-func (h *dataExportHandler) resolveCSV(ctx context.Context, spec string) ([]byte, string, string, error) {
+// ready resolves spec and waits for it to be prepared. It returns nil if there
+// is no data for spec or if preparing it failed.
+func (h *dataExportHandler) ready(ctx context.Context, spec string) (*dataExportData, error) {
 	d, err := h.resolve(spec)
-	if err != nil {
-		return nil, "", "", err
-	}
-	if d == nil {
-		return nil, "", "", nil
+	if err != nil || d == nil {
+		return nil, err
 	}
 	select {
 	case <-ctx.Done():
-		return nil, "", d.id, ctx.Err()
+		return nil, ctx.Err()
 	case <-d.ready:
 		if d.err != nil {
-			return nil, "", d.id, err
+			return nil, d.err
 		}
-		return d.csv, d.csvETag, d.id, d.csvErr
+		return d, nil
+	}
+}
+
+func (h *dataExportHandler) resolveCSV(ctx context.Context, spec string) ([]byte, string, string, error) {
+	d, err := h.ready(ctx, spec)
+	if d == nil {
+		return nil, "", "", err
+	}
+	return d.csv, d.csvETag, d.id, d.csvErr
+}
+
+func (h *dataExportHandler) resolveBOMCSV(ctx context.Context, spec string) ([]byte, string, string, error) {
+	d, err := h.ready(ctx, spec)
+	if d == nil {
+		return nil, "", "", err
 	}
+	return d.bom, d.bomETag, d.id, d.bomErr
 }
 
 func (h *dataExportHandler) resolveJSON(ctx context.Context, spec string) ([]byte, string, string, error) {
-	d, err := h.resolve(spec)
-	if err != nil {
+	d, err := h.ready(ctx, spec)
+	if d == nil {
 		return nil, "", "", err
 	}
+	return d.json, d.jsonETag, d.id, d.jsonErr
+}
+
+func (h *dataExportHandler) resolvePrettyJSON(ctx context.Context, spec string) ([]byte, string, string, error) {
+	d, err := h.ready(ctx, spec)
 	if d == nil {
-		return nil, "", "", nil
+		return nil, "", "", err
 	}
-	select {
-	case <-ctx.Done():
-		return nil, "", d.id, ctx.Err()
-	case <-d.ready:
-		if d.err != nil {
-			return nil, "", d.id, err
+	if d.jsonErr != nil {
+		return nil, "", d.id, d.jsonErr
+	}
+	d.jsonPrettyOnce.Do(func() {
+		var b bytes.Buffer
+		if err := json.Indent(&b, d.json, "", "  "); err != nil {
+			d.jsonPrettyErr = err
+			return
+		}
+		if h.MaxSize != 0 && int64(b.Len()) > h.MaxSize {
+			d.jsonPrettyErr = errExportTooLarge
+			slog.Error("export: pretty json failed", "id", d.id, "error", d.jsonPrettyErr)
+			return
+		}
+		d.jsonPretty = b.Bytes()
+	})
+	return d.jsonPretty, dataExportETag(d.blob, ".pretty.json"), d.id, d.jsonPrettyErr
+}
+
+func (h *dataExportHandler) resolveStableJSON(ctx context.Context, spec string) ([]byte, string, string, error) {
+	d, err := h.ready(ctx, spec)
+	if d == nil {
+		return nil, "", "", err
+	}
+	if d.jsonErr != nil {
+		return nil, "", d.id, d.jsonErr
+	}
+	d.jsonStableOnce.Do(func() {
+		var b bytes.Buffer
+		if err := ottrecexp.WriteJSONWithOptions(d.exp, h.limit(&b), ottrecexp.JSONOptions{OmitUnstable: true}); err != nil {
+			d.jsonStableErr = err
+			slog.Error("export: stable json failed", "id", d.id, "error", err)
+			return
 		}
-		return d.json, d.jsonETag, d.id, d.jsonErr
+		d.jsonStable = b.Bytes()
+	})
+	return d.jsonStable, dataExportETag(d.blob, ".json?raw=0"), d.id, d.jsonStableErr
+}
+
+func (h *dataExportHandler) resolveHTML(ctx context.Context, spec string) ([]byte, string, string, error) {
+	d, err := h.ready(ctx, spec)
+	if d == nil {
+		return nil, "", "", err
+	}
+	return d.html, d.htmlETag, d.id, d.htmlErr
+}
+
+var errExportTooLarge = errors.New("export too large")
+
+// limit wraps w to fail with errExportTooLarge if more than MaxSize bytes are
+// written to it.
+func (h *dataExportHandler) limit(w io.Writer) io.Writer {
+	if h.MaxSize == 0 {
+		return w
+	}
+	return &exportLimitWriter{w, h.MaxSize}
+}
+
+type exportLimitWriter struct {
+	w io.Writer
+	n int64 // remaining
+}
+
+func (w *exportLimitWriter) Write(b []byte) (int, error) {
+	if int64(len(b)) > w.n {
+		w.n = -1
+		return 0, errExportTooLarge
 	}
+	n, err := w.w.Write(b)
+	w.n -= int64(n)
+	return n, err
+}
+
+func exportCSV(w io.Writer, exp *ottrecexp.Data, bom bool) error {
+	return ottrecexp.WriteCSVZip(exp, w, ottrecexp.CSVOptions{BOM: bom, ValidUTF8: true})
 }
 
-func exportCSV(w io.Writer, exp *ottrecexp.Data) error {
-	zw := zip.NewWriter(w)
-	{
-		w, err := zw.Create("schema.csv")
+// compressWriter returns a writer which compresses to w with encoding. It must
+// be closed to flush it.
+func compressWriter(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case "":
+		return nopWriteCloser{w}, nil
+	case "gzip":
+		return gzip.NewWriter(w), nil
+	case "zstd":
+		zw, err := zstd.NewWriter(w)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("zstd: %w", err)
 		}
-		w.Write(dataExportSchemaCSV())
+		return zw, nil
+	default:
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
 	}
-	var serr error
-	if err := ottrecexp.WriteCSV(exp, func(table string) io.Writer {
-		if serr != nil {
-			return nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func compress(w io.Writer, encoding string, b []byte) error {
+	switch encoding {
+	case "":
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	case "gzip":
+		zw := gzip.NewWriter(w)
+		if _, err := zw.Write(b); err != nil {
+			return fmt.Errorf("gzip: %w", err)
 		}
-		w, err := zw.Create(table + ".csv")
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("gzip: %w", err)
+		}
+	case "zstd":
+		zw, err := zstd.NewWriter(w)
 		if err != nil {
-			serr = err
-			return nil
+			return fmt.Errorf("zstd: %w", err)
 		}
-		return w
-	}); err != nil {
-		return err
-	}
-	if serr != nil {
-		return serr
-	}
-	if err := zw.Close(); err != nil {
-		return err
+		if _, err := zw.Write(b); err != nil {
+			return fmt.Errorf("zstd: %w", err)
+		}
+		if err := zw.Close(); err != nil {
+			return fmt.Errorf("zstd: %w", err)
+		}
+	default:
+		return fmt.Errorf("unknown encoding %q", encoding)
 	}
 	return nil
 }
 
 type dataAPIv1 struct {
-	Base  string
-	Cache *ottrecdata.Cache
+	Base          string
+	Cache         *ottrecdata.Cache
+	SinceTimeout  time.Duration
+	ValidateLimit int64 // max body size for POST validate (0 to disable it)
 }
 
 func (h *dataAPIv1) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("X-Robots-Tag", "noindex")
 
+	if h.ValidateLimit > 0 && r.URL.Path == h.Base+"validate" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			httpError(w, r, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		h.serveValidate(w, r)
+		return
+	}
+
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		w.Header().Set("Allow", "GET, HEAD")
-		h.serveError(w, "method not allowed", http.StatusMethodNotAllowed)
+		httpError(w, r, "method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
@@ -561,16 +1408,7 @@ func (h *dataAPIv1) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	h.serveError(w, "not found", http.StatusNotFound)
-}
-
-func (h *dataAPIv1) serveError(w http.ResponseWriter, message string, code int) {
-	d := w.Header()
-	d.Set("Content-Length", strconv.Itoa(len(message)+1))
-	d.Set("Content-Type", "text/plain; charset=utf-8")
-	d.Set("X-Content-Type-Options", "nosniff")
-	w.WriteHeader(code)
-	io.WriteString(w, message+"\n")
+	httpError(w, r, "not found", http.StatusNotFound)
 }
 
 func (h *dataAPIv1) serveList(w http.ResponseWriter, r *http.Request) {
@@ -579,8 +1417,10 @@ func (h *dataAPIv1) serveList(w http.ResponseWriter, r *http.Request) {
 	// validate query
 	var (
 		after           = ""
+		since           = ""
 		limit, maxLimit = 25, 500
 		revisions       = false
+		granularity     = ""
 	)
 	for k, v := range r.URL.Query() {
 		if len(v) == 0 {
@@ -590,35 +1430,74 @@ func (h *dataAPIv1) serveList(w http.ResponseWriter, r *http.Request) {
 		case "limit":
 			v, err := strconv.ParseInt(v[0], 10, 64)
 			if err != nil {
-				h.serveError(w, "invalid limit int", http.StatusBadRequest)
+				httpError(w, r, "invalid limit int", http.StatusBadRequest)
 				return
 			}
 			limit = int(v)
 		case "after":
 			after = v[0]
+		case "since":
+			since = v[0]
 		case "revisions":
 			v, err := strconv.ParseBool(v[0])
 			if err != nil {
-				h.serveError(w, "invalid revisions bool", http.StatusBadRequest)
+				httpError(w, r, "invalid revisions bool", http.StatusBadRequest)
 				return
 			}
 			revisions = v
+		case "granularity":
+			if v[0] != "month" {
+				httpError(w, r, "invalid granularity (must be month)", http.StatusBadRequest)
+				return
+			}
+			granularity = v[0]
 		default:
-			h.serveError(w, "invalid parameter "+strconv.Quote(k), http.StatusBadRequest)
+			httpError(w, r, "invalid parameter "+strconv.Quote(k), http.StatusBadRequest)
 			return
 		}
 	}
 	if limit <= 0 || limit > maxLimit {
-		h.serveError(w, "limit out of range", http.StatusBadRequest)
+		httpError(w, r, "limit out of range", http.StatusBadRequest)
 		return
 	}
 	if after != "" && !ottrecdata.IsID(after) {
-		h.serveError(w, "after is not a valid data id", http.StatusBadRequest)
+		httpError(w, r, "after is not a valid data id", http.StatusBadRequest)
+		return
+	}
+	if since != "" && !ottrecdata.IsID(since) {
+		httpError(w, r, "since is not a valid data id", http.StatusBadRequest)
+		return
+	}
+	if since != "" && after != "" {
+		httpError(w, r, "since and after are mutually exclusive", http.StatusBadRequest)
+		return
+	}
+	if since != "" && granularity != "" {
+		httpError(w, r, "since and granularity are mutually exclusive", http.StatusBadRequest)
 		return
 	}
 
-	// cache the list for a minute
-	w.Header().Set("Cache-Control", "public, max-age=60")
+	if since != "" {
+		// don't cache long-polling responses
+		w.Header().Set("Cache-Control", "no-store")
+
+		// wait for a newer version
+		newer, err := h.waitSince(ctx, since, h.SinceTimeout)
+		if err != nil {
+			if canceled := ctx.Err() != nil; !canceled {
+				slog.Error("data api v1: failed to wait for new data", "since", since, "error", err)
+				httpError(w, r, "internal server error: "+err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		if !newer {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	} else {
+		// cache the list for a minute
+		w.Header().Set("Cache-Control", "public, max-age=60")
+	}
 
 	// set the mimetype
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
@@ -635,14 +1514,21 @@ func (h *dataAPIv1) serveList(w http.ResponseWriter, r *http.Request) {
 		wrote     bool
 		bw        = bufio.NewWriterSize(w, 512)
 		seenAfter bool
+		versions  = h.Cache.DataVersions
 	)
-	for prev, ver := range iterPrev(h.Cache.DataVersions(ctx)(&err)) {
+	if granularity == "month" {
+		versions = h.Cache.MonthlyVersions
+	}
+	for prev, ver := range iterPrev(versions(ctx)(&err)) {
 		if after != "" && !seenAfter {
 			if ver.ID == after {
 				seenAfter = true
 			}
 			continue
 		}
+		if since != "" && ver.ID == since {
+			break
+		}
 		if !revisions && prev.Updated.Equal(ver.Updated) {
 			continue // this must be after the after check, or we might miss revisions
 		}
@@ -655,13 +1541,7 @@ func (h *dataAPIv1) serveList(w http.ResponseWriter, r *http.Request) {
 		} else {
 			bw.WriteByte(',')
 		}
-		bw.WriteString(`{"id":"`)
-		bw.WriteString(ver.ID)
-		bw.WriteString(`","updated":"`)
-		bw.WriteString(ver.Updated.In(ottrecdata.TZ).Format(time.RFC3339))
-		bw.WriteString(`","revision":`)
-		bw.Write(strconv.AppendInt(bw.AvailableBuffer(), int64(ver.Revision), 10))
-		bw.WriteString(`}`)
+		bw.Write(appendDataVersionJSON(bw.AvailableBuffer(), ver))
 	}
 	if !wrote {
 		bw.WriteByte('[')
@@ -674,13 +1554,116 @@ func (h *dataAPIv1) serveList(w http.ResponseWriter, r *http.Request) {
 			if wrote {
 				io.WriteString(w, "\ninternal server error: "+err.Error()+"\n")
 			} else {
-				h.serveError(w, "internal server error: "+err.Error(), http.StatusInternalServerError)
+				httpError(w, r, "internal server error: "+err.Error(), http.StatusInternalServerError)
 			}
 		}
 		return
 	}
 }
 
+func (h *dataAPIv1) serveValidate(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	for k := range r.URL.Query() {
+		httpError(w, r, "invalid parameter "+strconv.Quote(k), http.StatusBadRequest)
+		return
+	}
+
+	buf, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.ValidateLimit))
+	if err != nil {
+		if errors.As(err, new(*http.MaxBytesError)) {
+			httpError(w, r, "request body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			httpError(w, r, "failed to read request body: "+err.Error(), http.StatusBadRequest)
+		}
+		return
+	}
+
+	rep, err := h.Cache.Validate(buf)
+	if err != nil {
+		httpError(w, r, "invalid data: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	var res struct {
+		ID                    string `json:"id"`
+		Updated               string `json:"updated,omitempty"`
+		Facilities            int    `json:"facilities"`
+		WithoutDate           int    `json:"withoutDate"`
+		WithoutName           int    `json:"withoutName"`
+		WithoutScheduleGroups int    `json:"withoutScheduleGroups"`
+		Times                 int    `json:"times"`
+		UnparsedTimes         int    `json:"unparsedTimes"`
+		Skip                  string `json:"skip,omitempty"`
+	}
+	res.ID = rep.ID
+	if !rep.Updated.IsZero() {
+		res.Updated = rep.Updated.In(ottrecdata.TZ).Format(time.RFC3339)
+	}
+	res.Facilities = rep.Facilities
+	res.WithoutDate = rep.WithoutDate
+	res.WithoutName = rep.WithoutName
+	res.WithoutScheduleGroups = rep.WithoutScheduleGroups
+	res.Times = rep.Times
+	res.UnparsedTimes = rep.UnparsedTimes
+	if rep.Skip != nil {
+		res.Skip = rep.Skip.Error()
+	}
+
+	b, err := json.Marshal(res)
+	if err != nil {
+		panic(err)
+	}
+	b = append(b, '\n')
+
+	d := w.Header()
+	d.Set("Content-Length", strconv.Itoa(len(b)))
+	d.Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
+
+// appendDataVersionJSON appends the JSON object for ver in the v1 list format.
+func appendDataVersionJSON(b []byte, ver ottrecdata.DataVersion) []byte {
+	b = append(b, `{"id":"`...)
+	b = append(b, ver.ID...)
+	b = append(b, `","updated":"`...)
+	b = ver.Updated.In(ottrecdata.TZ).AppendFormat(b, time.RFC3339)
+	b = append(b, `","committed":"`...)
+	b = ver.Committed.In(ottrecdata.TZ).AppendFormat(b, time.RFC3339)
+	b = append(b, `","revision":`...)
+	b = strconv.AppendInt(b, int64(ver.Revision), 10)
+	b = append(b, '}')
+	return b
+}
+
+// waitSince waits until the latest version is not since, returning false if the
+// timeout is reached first.
+func (h *dataAPIv1) waitSince(ctx context.Context, since string, timeout time.Duration) (bool, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		// get the channel before resolving so we don't miss an update
+		updated := h.Cache.Updated()
+
+		latest, _, _, err := h.Cache.ResolveVersion(ctx, "latest")
+		if err != nil {
+			return false, fmt.Errorf("resolve latest: %w", err)
+		}
+		if latest != "" && latest != since {
+			return true, nil
+		}
+
+		select {
+		case <-updated:
+		case <-timer.C:
+			return false, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+}
+
 func (h *dataAPIv1) serveFile(w http.ResponseWriter, r *http.Request, spec, format string) {
 	ctx := r.Context()
 
@@ -689,7 +1672,7 @@ func (h *dataAPIv1) serveFile(w http.ResponseWriter, r *http.Request, spec, form
 
 	// validate query
 	for k := range r.URL.Query() {
-		h.serveError(w, "invalid parameter "+strconv.Quote(k), http.StatusBadRequest)
+		httpError(w, r, "invalid parameter "+strconv.Quote(k), http.StatusBadRequest)
 		return
 	}
 
@@ -697,11 +1680,11 @@ func (h *dataAPIv1) serveFile(w http.ResponseWriter, r *http.Request, spec, form
 	id, updated, ok, err := h.Cache.ResolveVersion(ctx, cmp.Or(spec, "latest"))
 	if err != nil {
 		slog.Error("data api v1: failed to resolve spec", "spec", spec, "error", err)
-		h.serveError(w, "internal server error: "+err.Error(), http.StatusInternalServerError)
+		httpError(w, r, "internal server error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	if !ok {
-		h.serveError(w, "invalid spec format "+strconv.Quote(spec), http.StatusBadRequest)
+		httpError(w, r, "invalid spec format "+strconv.Quote(spec), http.StatusBadRequest)
 		return
 	}
 
@@ -718,9 +1701,9 @@ func (h *dataAPIv1) serveFile(w http.ResponseWriter, r *http.Request, spec, form
 	if id == "" {
 		if spec == "" || spec == "latest" {
 			slog.Error("data api v1: no data available")
-			h.serveError(w, "no data available, try again later", http.StatusServiceUnavailable)
+			httpError(w, r, "no data available, try again later", http.StatusServiceUnavailable)
 		} else {
-			h.serveError(w, "no match for "+strconv.Quote(spec), http.StatusNotFound)
+			httpError(w, r, "no match for "+strconv.Quote(spec), http.StatusNotFound)
 		}
 		return
 	}
@@ -737,6 +1720,9 @@ func (h *dataAPIv1) serveFile(w http.ResponseWriter, r *http.Request, spec, form
 		return
 	}
 
+	// serve the stored gzip as-is if requested
+	format, raw := strings.CutSuffix(format, ".gz")
+
 	// validate the format and set mimetype
 	switch format {
 	case "pb":
@@ -745,10 +1731,10 @@ func (h *dataAPIv1) serveFile(w http.ResponseWriter, r *http.Request, spec, form
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	case "json":
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	case "textpb":
+	case "textpb", "textpb-pretty":
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	default:
-		h.serveError(w, "unknown format", http.StatusNotFound)
+		httpError(w, r, "unknown format", http.StatusNotFound)
 		return
 	}
 
@@ -762,18 +1748,24 @@ func (h *dataAPIv1) serveFile(w http.ResponseWriter, r *http.Request, spec, form
 	}
 	if err != nil {
 		slog.Error("data api v1: failed to resolve formats", "id", id, "error", err)
-		h.serveError(w, "internal server error: "+err.Error(), http.StatusInternalServerError)
+		httpError(w, r, "internal server error: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	if hash == "" {
-		h.serveError(w, "format not found", http.StatusNotFound)
+		httpError(w, r, "format not found", http.StatusNotFound)
 		return
 	}
 
 	// negotiate encoding
-	encoding := httpx.NegotiateContent(r.Header.Values("Accept-Encoding"), []string{"", "gzip"})
-	if encoding != "" {
-		w.Header().Set("Content-Encoding", encoding)
+	var encoding string
+	if raw {
+		encoding = "gzip"
+		w.Header().Set("Content-Type", "application/gzip")
+	} else {
+		encoding = httpx.NegotiateContent(r.Header.Values("Accept-Encoding"), []string{"", "gzip"})
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
 	}
 
 	// cache the data for longer since it's immutable (but don't say immutable
@@ -784,7 +1776,9 @@ func (h *dataAPIv1) serveFile(w http.ResponseWriter, r *http.Request, spec, form
 	var etag strings.Builder
 	etag.WriteString(`W/"`)
 	etag.WriteString(hash)
-	if encoding != "" {
+	if raw {
+		etag.WriteString("-gz")
+	} else if encoding != "" {
 		etag.WriteByte('-')
 		etag.WriteString(encoding)
 	}
@@ -809,23 +1803,38 @@ func (h *dataAPIv1) serveFile(w http.ResponseWriter, r *http.Request, spec, form
 			w.Header().Set("Content-Length", strconv.FormatInt(len, 10))
 		}
 		w.WriteHeader(http.StatusOK)
-		_, _ = io.Copy(w, r)
+		if _, err := io.Copy(w, contextReader{ctx, r}); err != nil && ctx.Err() != nil {
+			return ctx.Err() // stop reading the blob if the client went away
+		}
 		return nil
 	})
 	if err != nil {
 		if canceled := r.Context().Err() != nil; !canceled {
 			slog.Error("data api v1: failed to serve blob", "hash", hash, "encoding", encoding, "error", err)
-			h.serveError(w, "internal server error: "+err.Error(), http.StatusInternalServerError)
+			httpError(w, r, "internal server error: "+err.Error(), http.StatusInternalServerError)
 		}
 		return
 	}
 	if !ok {
 		slog.Error("data api v1: missing blob", "hash", hash, "encoding", encoding)
-		h.serveError(w, "internal server error: missing blob", http.StatusInternalServerError)
+		httpError(w, r, "internal server error: missing blob", http.StatusInternalServerError)
 		return
 	}
 }
 
+// contextReader wraps a reader, failing reads once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
 func (h *dataAPIv1) redirectFile(w http.ResponseWriter, spec, format string) {
 	var u strings.Builder
 	u.WriteString(h.Base)
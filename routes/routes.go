@@ -4,10 +4,15 @@ package routes
 import (
 	"crypto/sha1"
 	"encoding/base32"
+	"encoding/json"
 	"fmt"
+	"io"
 	"iter"
 	"net/http"
 	"os"
+	"strconv"
+
+	"github.com/pgaskin/ottrec-website/internal/httpx"
 )
 
 func commonMiddleware(next http.Handler) http.Handler {
@@ -15,6 +20,33 @@ func commonMiddleware(next http.Handler) http.Handler {
 	return next
 }
 
+// httpError writes an error response, as JSON if the client prefers it, and
+// plain text otherwise.
+func httpError(w http.ResponseWriter, r *http.Request, message string, code int) {
+	d := w.Header()
+	d.Add("Vary", "Accept")
+	d.Set("X-Content-Type-Options", "nosniff")
+	if httpx.NegotiateContent(r.Header.Values("Accept"), []string{"text/plain", "application/json"}) == "application/json" {
+		buf, err := json.Marshal(struct {
+			Error  string `json:"error"`
+			Status int    `json:"status"`
+		}{message, code})
+		if err != nil {
+			panic(err)
+		}
+		buf = append(buf, '\n')
+		d.Set("Content-Length", strconv.Itoa(len(buf)))
+		d.Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(code)
+		w.Write(buf)
+		return
+	}
+	d.Set("Content-Length", strconv.Itoa(len(message)+1))
+	d.Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	io.WriteString(w, message+"\n")
+}
+
 func iterPrev[T any](seq iter.Seq[T]) iter.Seq2[T, T] {
 	return func(yield func(T, T) bool) {
 		var x T
@@ -1,19 +1,51 @@
 package routes
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/a-h/templ"
+	"github.com/pgaskin/ottrec-website/internal/httpx"
 	"github.com/pgaskin/ottrec-website/pkg/ottrecidx"
 	"github.com/pgaskin/ottrec-website/static"
 	"github.com/pgaskin/ottrec-website/templates"
+	"github.com/pgaskin/ottrec/schema"
+	"golang.org/x/text/language"
 )
 
 type WebsiteConfig struct {
 	Host string
 	Data func() (ottrecidx.DataRef, bool)
+
+	// MaxAge and StaleWhileRevalidate set the Cache-Control freshness for
+	// pages. If MaxAge is zero, pages must always be revalidated.
+	MaxAge               time.Duration
+	StaleWhileRevalidate time.Duration
+
+	// Updated, if set, returns a channel which is closed the next time Data
+	// may return new data. It enables the /events endpoint, which notifies
+	// open pages of new data. MaxEventSubscribers limits the number of
+	// concurrent /events connections, and must be positive if Updated is set.
+	Updated             func() <-chan struct{}
+	MaxEventSubscribers int
+
+	// Static configures how static assets are compressed and served.
+	Static static.Options
 }
 
 func Website(cfg WebsiteConfig) (http.Handler, error) {
@@ -23,10 +55,14 @@ func Website(cfg WebsiteConfig) (http.Handler, error) {
 	if cfg.Data == nil {
 		return nil, fmt.Errorf("no data getter specified")
 	}
+	if err := cfg.Static.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid static options: %w", err)
+	}
 
 	base := websiteHandlerBase{
-		Host: cfg.Host,
-		Data: cfg.Data,
+		Host:         cfg.Host,
+		Data:         cfg.Data,
+		CacheControl: websiteCacheControl(cfg.MaxAge, cfg.StaleWhileRevalidate),
 	}
 	mux := http.NewServeMux()
 
@@ -37,17 +73,107 @@ func Website(cfg WebsiteConfig) (http.Handler, error) {
 	mux.Handle("GET /{$}", &websiteHomeHandler{
 		websiteHandlerBase: base,
 	})
-	mux.Handle("/static/", static.Handler(static.Website))
+	mux.Handle("GET /api/facilities.json", &websiteFacilitiesHandler{
+		websiteHandlerBase: base,
+	})
+	if cfg.Updated != nil {
+		if cfg.MaxEventSubscribers <= 0 {
+			return nil, fmt.Errorf("max event subscribers must be positive")
+		}
+		mux.Handle("GET /events", &websiteEventsHandler{
+			websiteHandlerBase: base,
+			Updated:            cfg.Updated,
+			sem:                make(chan struct{}, cfg.MaxEventSubscribers),
+		})
+	}
+	mux.Handle("/static/", static.HandlerWithOptions(static.Website, cfg.Static))
 
 	return commonMiddleware(mux), nil
 }
 
+// websiteSnapshotPages maps the file to render each page to for
+// [WebsiteSnapshot].
+var websiteSnapshotPages = []struct{ File, Path string }{
+	{"index.html", "/"},
+	{"api/facilities.json", "/api/facilities.json"},
+}
+
+// WebsiteSnapshot renders the website pages and static assets to dir for
+// serving as static files. The rendered pages only reflect the data as of the
+// current day.
+func WebsiteSnapshot(cfg WebsiteConfig, dir string) error {
+	h, err := Website(cfg)
+	if err != nil {
+		return err
+	}
+	for _, page := range websiteSnapshotPages {
+		req, err := http.NewRequest(http.MethodGet, "http://"+cfg.Host+page.Path, nil)
+		if err != nil {
+			return fmt.Errorf("render %s: %w", page.Path, err)
+		}
+		rec := &websiteSnapshotRecorder{header: make(http.Header)}
+		h.ServeHTTP(rec, req)
+		if rec.code != http.StatusOK {
+			return fmt.Errorf("render %s: response status %d", page.Path, rec.code)
+		}
+		p := filepath.Join(dir, filepath.FromSlash(page.File))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			return fmt.Errorf("write %s: %w", page.Path, err)
+		}
+		if err := os.WriteFile(p, rec.body.Bytes(), 0666); err != nil {
+			return fmt.Errorf("write %s: %w", page.Path, err)
+		}
+	}
+	if err := static.WriteDir(static.Website, dir); err != nil {
+		return fmt.Errorf("write static assets: %w", err)
+	}
+	return nil
+}
+
+// websiteSnapshotRecorder is a [http.ResponseWriter] which buffers the
+// response in memory for [WebsiteSnapshot].
+type websiteSnapshotRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (w *websiteSnapshotRecorder) Header() http.Header {
+	return w.header
+}
+
+func (w *websiteSnapshotRecorder) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *websiteSnapshotRecorder) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// websiteCacheControl returns the Cache-Control header for pages.
+func websiteCacheControl(maxAge, stale time.Duration) string {
+	if maxAge <= 0 {
+		return "public, no-cache"
+	}
+	cc := "public, max-age=" + strconv.Itoa(int(maxAge.Seconds()))
+	if stale > 0 {
+		cc += ", stale-while-revalidate=" + strconv.Itoa(int(stale.Seconds()))
+	}
+	return cc
+}
+
 type websiteHandlerBase struct {
-	Host string
-	Data func() (ottrecidx.DataRef, bool)
+	Host         string
+	Data         func() (ottrecidx.DataRef, bool)
+	CacheControl string
 }
 
-func (h *websiteHandlerBase) render(w http.ResponseWriter, r *http.Request, fn func(data ottrecidx.DataRef) (c templ.Component, status int, err error)) {
+func (h *websiteHandlerBase) render(w http.ResponseWriter, r *http.Request, fn func(data ottrecidx.DataRef, lang language.Tag) (c templ.Component, status int, err error)) {
+	lang := templates.NegotiateLanguage(w, r)
+
 	var (
 		data ottrecidx.DataRef
 		ok   bool
@@ -60,8 +186,10 @@ func (h *websiteHandlerBase) render(w http.ResponseWriter, r *http.Request, fn f
 		templates.RenderError(w, r, templates.WebsiteErrorPage, "Data Unavailable", "data not available, try again later", http.StatusServiceUnavailable)
 		return
 	}
-	if err := templates.Render(w, r, templates.WebsiteErrorPage, data.Index().Hash(), func() (c templ.Component, status int, err error) {
-		return fn(data)
+	// pages are filtered by the current date, so include it in the etag
+	etag := data.Index().Hash() + "-" + time.Now().In(ottrecidx.TZ).Format("20060102")
+	if err := templates.Render(w, r, templates.WebsiteErrorPage, lang, etag, func() (c templ.Component, status int, err error) {
+		return fn(data, lang)
 	}); err != nil {
 		slog.Error("website: failed to render page", "url", r.URL.String(), "error", err)
 	}
@@ -73,17 +201,587 @@ type websiteHomeHandler struct {
 
 func (h *websiteHomeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Vary", "Accept-Encoding")
-	w.Header().Set("Cache-Control", "public, no-cache")
+	w.Header().Set("Cache-Control", h.CacheControl)
 
-	if r.URL.RawQuery != "" {
+	// only keep known and valid query params
+	q := r.URL.Query()
+	f := parseWebsiteFilter(q)
+	if c := f.Query(); c.Encode() != q.Encode() {
+		u := r.URL.EscapedPath()
+		if len(c) != 0 {
+			u += "?" + c.Encode()
+		}
 		w.Header().Set("Cache-Control", "no-store")
-		http.Redirect(w, r, r.URL.EscapedPath(), http.StatusTemporaryRedirect)
+		http.Redirect(w, r, u, http.StatusTemporaryRedirect)
 		return
 	}
 
-	h.render(w, r, func(data ottrecidx.DataRef) (templ.Component, int, error) {
-		return templates.WebsitePage(templates.WebsitePageParams{
-			Title: "test",
+	h.render(w, r, func(data ottrecidx.DataRef, lang language.Tag) (templ.Component, int, error) {
+		share := reqScheme(r) + "://" + h.Host + "/"
+		if q := f.Query(); len(q) != 0 {
+			share += "?" + q.Encode()
+		}
+		toggle := f
+		toggle.Expired = !toggle.Expired
+		toggleURL := "/"
+		if q := toggle.Query(); len(q) != 0 {
+			toggleURL += "?" + q.Encode()
+		}
+		return templates.WebsiteHome(templates.WebsiteHomeParams{
+			Lang:          lang,
+			Data:          f.Apply(data, time.Now()),
+			Share:         share,
+			Expired:       f.Expired,
+			ExpiredToggle: toggleURL,
 		}), http.StatusOK, nil
 	})
 }
+
+// websiteFilter is the filter state for the home page, which is encoded in the
+// query parameters so filtered views can be shared. The parameters are:
+//
+//   - when: today or week (see [websiteFilterWhen])
+//   - expired: 1 to include expired schedules (see [websiteFilterExpired])
+//   - day: comma-separated weekdays (sun, mon, tue, wed, thu, fri, sat)
+//   - after: only times starting at or after HH:MM
+//   - before: only times ending at or before HH:MM (up to 24:00)
+//   - activity: normalized activity name (may be repeated, up to 16)
+//   - near: LAT,LNG to only include facilities within radius
+//   - radius: distance in km for near (0.5 to 50, default 5)
+//
+// Invalid values are dropped and out-of-range ones are clamped when parsing,
+// and [websiteFilter.Query] always returns the canonical encoding.
+type websiteFilter struct {
+	When       string
+	Expired    bool
+	Days       []time.Weekday // sorted, unique
+	After      schema.ClockTime
+	Before     schema.ClockTime
+	Activities []string // sorted, unique
+	Near       bool
+	Lat, Lng   float64 // rounded to 3 decimals (~100m)
+	Radius     float64 // km, rounded to 1 decimal
+}
+
+const (
+	websiteFilterMaxActivities = 16
+	websiteFilterDefaultRadius = 5
+	websiteFilterMinRadius     = 0.5
+	websiteFilterMaxRadius     = 50
+)
+
+var websiteFilterDays = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+func parseWebsiteFilter(q url.Values) websiteFilter {
+	f := websiteFilter{
+		After:  -1,
+		Before: -1,
+	}
+	switch when := q.Get("when"); when {
+	case "today", "week":
+		f.When = when
+	}
+	f.Expired = q.Get("expired") == "1"
+	if v := q.Get("day"); v != "" {
+		var days [7]bool
+		for d := range strings.SplitSeq(v, ",") {
+			if i := slices.Index(websiteFilterDays[:], strings.ToLower(strings.TrimSpace(d))); i != -1 {
+				days[i] = true
+			}
+		}
+		for i, ok := range days {
+			if ok {
+				f.Days = append(f.Days, time.Weekday(i))
+			}
+		}
+		if len(f.Days) == 7 {
+			f.Days = nil // no-op
+		}
+	}
+	if t, ok := parseWebsiteFilterClock(q.Get("after")); ok && t < 24*60 {
+		f.After = t
+	}
+	if t, ok := parseWebsiteFilterClock(q.Get("before")); ok && t <= 24*60 {
+		f.Before = t
+	}
+	for _, v := range q["activity"] {
+		if v = strings.TrimSpace(v); v != "" && !slices.Contains(f.Activities, v) {
+			f.Activities = append(f.Activities, v)
+		}
+	}
+	slices.Sort(f.Activities)
+	f.Activities = f.Activities[:min(len(f.Activities), websiteFilterMaxActivities)]
+	if a, b, ok := strings.Cut(q.Get("near"), ","); ok {
+		lat, err1 := strconv.ParseFloat(strings.TrimSpace(a), 64)
+		lng, err2 := strconv.ParseFloat(strings.TrimSpace(b), 64)
+		if err1 == nil && err2 == nil && !math.IsNaN(lat) && !math.IsNaN(lng) {
+			f.Near = true
+			f.Lat = math.Round(max(-90, min(90, lat))*1000) / 1000
+			f.Lng = math.Round(max(-180, min(180, lng))*1000) / 1000
+			f.Radius = websiteFilterDefaultRadius
+			if r, err := strconv.ParseFloat(q.Get("radius"), 64); err == nil && !math.IsNaN(r) {
+				f.Radius = math.Round(max(websiteFilterMinRadius, min(websiteFilterMaxRadius, r))*10) / 10
+			}
+		}
+	}
+	return f
+}
+
+// parseWebsiteFilterClock parses a HH:MM time.
+func parseWebsiteFilterClock(s string) (schema.ClockTime, bool) {
+	hh, mm, ok := strings.Cut(s, ":")
+	if !ok || len(hh) != 2 || len(mm) != 2 {
+		return -1, false
+	}
+	h, err1 := strconv.Atoi(hh)
+	m, err2 := strconv.Atoi(mm)
+	if err1 != nil || err2 != nil || h < 0 || m < 0 || m >= 60 {
+		return -1, false
+	}
+	return schema.MakeClockTime(h, m), true
+}
+
+// formatWebsiteFilterClock formats a HH:MM time, allowing 24:00.
+func formatWebsiteFilterClock(t schema.ClockTime) string {
+	return fmt.Sprintf("%02d:%02d", t/60, t%60)
+}
+
+// Query returns the canonical query parameters for the filter.
+func (f websiteFilter) Query() url.Values {
+	q := url.Values{}
+	if f.When != "" {
+		q.Set("when", f.When)
+	}
+	if f.Expired {
+		q.Set("expired", "1")
+	}
+	if len(f.Days) != 0 {
+		days := make([]string, len(f.Days))
+		for i, d := range f.Days {
+			days[i] = websiteFilterDays[d]
+		}
+		q.Set("day", strings.Join(days, ","))
+	}
+	if f.After.IsValid() {
+		q.Set("after", formatWebsiteFilterClock(f.After))
+	}
+	if f.Before.IsValid() {
+		q.Set("before", formatWebsiteFilterClock(f.Before))
+	}
+	for _, a := range f.Activities {
+		q.Add("activity", a)
+	}
+	if f.Near {
+		q.Set("near", strconv.FormatFloat(f.Lat, 'f', -1, 64)+","+strconv.FormatFloat(f.Lng, 'f', -1, 64))
+		if f.Radius != websiteFilterDefaultRadius {
+			q.Set("radius", strconv.FormatFloat(f.Radius, 'f', -1, 64))
+		}
+	}
+	return q
+}
+
+// Apply filters data (as of now). Like the other filters, times without a
+// known weekday or time range, and facilities without a known location, are
+// kept.
+func (f websiteFilter) Apply(data ottrecidx.DataRef, now time.Time) ottrecidx.DataRef {
+	if !f.Expired {
+		data = websiteFilterExpired(data, now)
+	}
+	if f.When != "" {
+		data = websiteFilterWhen(data, f.When, now)
+	}
+	if len(f.Days) == 0 && !f.After.IsValid() && !f.Before.IsValid() && len(f.Activities) == 0 && !f.Near {
+		return data
+	}
+	mut := data.Mutate()
+	if len(f.Activities) != 0 {
+		mut.KeepActivities(f.Activities...)
+	}
+	if f.Near {
+		mut.FilterFacilities(func(ref ottrecidx.FacilityRef) bool {
+			lng, lat, ok := ref.GetLngLat()
+			return !ok || haversineKm(f.Lat, f.Lng, float64(lat), float64(lng)) <= f.Radius
+		})
+	}
+	if len(f.Days) != 0 || f.After.IsValid() || f.Before.IsValid() {
+		mut.FilterTimes(func(ref ottrecidx.TimeRef) bool {
+			if len(f.Days) != 0 {
+				if d, ok := ref.SingleDate(); ok {
+					if !slices.Contains(f.Days, d.Weekday()) {
+						return false
+					}
+				} else if wd, ok := ref.GetWeekday(); ok && !slices.Contains(f.Days, wd) {
+					return false
+				}
+			}
+			if r, ok := ref.GetRange(); ok {
+				if f.After.IsValid() && r.Start.IsValid() && r.Start < f.After {
+					return false
+				}
+				if f.Before.IsValid() && r.End.IsValid() && r.End > f.Before {
+					return false
+				}
+			}
+			return true
+		})
+	}
+	mut.Elide()
+	return mut.Data()
+}
+
+// haversineKm returns the great-circle distance in km between two points.
+func haversineKm(lat1, lng1, lat2, lng2 float64) float64 {
+	const r = 6371
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dlat, dlng := rad(lat2-lat1), rad(lng2-lng1)
+	a := math.Sin(dlat/2)*math.Sin(dlat/2) + math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dlng/2)*math.Sin(dlng/2)
+	return 2 * r * math.Asin(math.Sqrt(a))
+}
+
+// websiteFilterExpired filters data to remove schedules which ended before the
+// current day (as of now). Schedules without a known or unambiguous date range
+// are kept.
+func websiteFilterExpired(data ottrecidx.DataRef, now time.Time) ottrecidx.DataRef {
+	now = now.In(ottrecidx.TZ)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, ottrecidx.TZ)
+
+	mut := data.Mutate()
+	if mut.FilterSchedules(func(ref ottrecidx.ScheduleRef) bool {
+		_, sto, ok := ref.ComputeEffectiveDateRange()
+		return !ok || sto.IsZero() || !sto.Before(today)
+	}) == 0 {
+		return data
+	}
+	mut.Elide()
+	return mut.Data()
+}
+
+// websiteFilterWhen filters data to only include activities which may occur
+// today or within the next week (as of now). Times and schedules without a
+// known weekday or date range are kept.
+func websiteFilterWhen(data ottrecidx.DataRef, when string, now time.Time) ottrecidx.DataRef {
+	now = now.In(ottrecidx.TZ)
+
+	var (
+		weekdays []time.Weekday
+		from     = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, ottrecidx.TZ)
+		to       time.Time
+	)
+	switch when {
+	case "today":
+		weekdays = []time.Weekday{now.Weekday()}
+		to = from.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	case "week":
+		for i := range 7 {
+			weekdays = append(weekdays, time.Weekday(i))
+		}
+		to = from.AddDate(0, 0, 7).Add(-time.Nanosecond)
+	default:
+		return data
+	}
+
+	mut := data.Mutate()
+	mut.FilterSchedules(func(ref ottrecidx.ScheduleRef) bool {
+		sfrom, sto, ok := ref.ComputeEffectiveDateRange()
+		if !ok {
+			return true
+		}
+		return (sfrom.IsZero() || !sfrom.After(to)) && (sto.IsZero() || !sto.Before(from))
+	})
+	mut.FilterTimes(func(ref ottrecidx.TimeRef) bool {
+		if d, ok := ref.SingleDate(); ok {
+			return !d.Before(from) && !d.After(to)
+		}
+		if wd, ok := ref.GetWeekday(); ok {
+			return slices.Contains(weekdays, wd)
+		}
+		return true
+	})
+	mut.Elide()
+	return mut.Data()
+}
+
+type websiteFacilitiesHandler struct {
+	websiteHandlerBase
+
+	mu   sync.Mutex
+	hash string // data hash for buf
+	buf  []byte
+}
+
+// websiteFacility is a facility for the map.
+type websiteFacility struct {
+	Key  string  `json:"key"`
+	Name string  `json:"name"`
+	Lng  float32 `json:"lng"`
+	Lat  float32 `json:"lat"`
+}
+
+func (h *websiteFacilitiesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Accept-Encoding")
+	w.Header().Set("Cache-Control", h.CacheControl)
+
+	var (
+		data ottrecidx.DataRef
+		ok   bool
+	)
+	if h.Data != nil {
+		data, ok = h.Data()
+	}
+	if !ok {
+		slog.Error("website: no data available")
+		httpError(w, r, "data not available, try again later", http.StatusServiceUnavailable)
+		return
+	}
+
+	cluster, err := parseWebsiteFacilityCluster(r.URL.Query())
+	if err != nil {
+		httpError(w, r, "bad request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var buf []byte
+	if cluster != nil {
+		buf, err = cluster.encode(data)
+	} else {
+		buf, err = h.get(data)
+	}
+	if err != nil {
+		slog.Error("website: failed to encode facilities", "error", err)
+		httpError(w, r, "internal error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// compress it if it's worth it (it's usually small enough for it to not be)
+	encoding := httpx.NegotiateContent(r.Header.Values("Accept-Encoding"), []string{"", "gzip", "zstd"})
+	if len(buf) < 1024 {
+		encoding = ""
+	}
+
+	etagKey := exehash + "-" + data.Index().Hash()
+	if cluster != nil {
+		etagKey += "-" + cluster.String()
+	}
+	sum := sha1.Sum([]byte(etagKey))
+	etag := `W/"` + base32.StdEncoding.EncodeToString(sum[:])
+	if encoding != "" {
+		etag += "-" + encoding
+	}
+	etag += `"`
+	w.Header().Set("ETag", etag)
+
+	if slices.Contains(r.Header.Values("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if encoding != "" {
+		var b bytes.Buffer
+		if err := compress(&b, encoding, buf); err != nil {
+			httpError(w, r, "internal error: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		buf = b.Bytes()
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(buf)
+	}
+}
+
+// get gets the encoded facilities for data, re-encoding it if it changed.
+func (h *websiteFacilitiesHandler) get(data ottrecidx.DataRef) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if hash := data.Index().Hash(); h.buf == nil || h.hash != hash {
+		facs := []websiteFacility{}
+		for fac := range data.Facilities() {
+			if lng, lat, ok := fac.GetLngLat(); ok {
+				facs = append(facs, websiteFacility{
+					Key:  fac.Key(),
+					Name: fac.GetName(),
+					Lng:  lng,
+					Lat:  lat,
+				})
+			}
+		}
+		buf, err := json.Marshal(facs)
+		if err != nil {
+			return nil, err
+		}
+		h.hash, h.buf = hash, append(buf, '\n')
+	}
+	return h.buf, nil
+}
+
+// websiteFacilityClusterMaxCells limits the number of grid cells a bounding box
+// can cover.
+const websiteFacilityClusterMaxCells = 10000
+
+// websiteFacilityCluster clusters facilities into a grid for the map. It is
+// enabled by setting the bbox (minLng,minLat,maxLng,maxLat) and cell (degrees)
+// query parameters.
+type websiteFacilityCluster struct {
+	MinLng, MinLat float64
+	MaxLng, MaxLat float64
+	Cell           float64
+}
+
+// websiteFacilityClusterItem is a cluster of facilities for the map. If it only
+// contains a single facility, the key and name are set.
+type websiteFacilityClusterItem struct {
+	Lng   float64 `json:"lng"`
+	Lat   float64 `json:"lat"`
+	Count int     `json:"count"`
+	Key   string  `json:"key,omitempty"`
+	Name  string  `json:"name,omitempty"`
+}
+
+// parseWebsiteFacilityCluster parses the clustering parameters from q. If
+// clustering was not requested, nil is returned.
+func parseWebsiteFacilityCluster(q url.Values) (*websiteFacilityCluster, error) {
+	if !q.Has("bbox") && !q.Has("cell") {
+		return nil, nil
+	}
+	if !q.Has("bbox") || !q.Has("cell") {
+		return nil, fmt.Errorf("both bbox and cell must be specified")
+	}
+	var (
+		c    websiteFacilityCluster
+		bbox [4]float64
+	)
+	parts := strings.Split(q.Get("bbox"), ",")
+	if len(parts) != len(bbox) {
+		return nil, fmt.Errorf("bbox must be minLng,minLat,maxLng,maxLat")
+	}
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("invalid bbox coordinate %q", part)
+		}
+		bbox[i] = v
+	}
+	c.MinLng, c.MinLat, c.MaxLng, c.MaxLat = bbox[0], bbox[1], bbox[2], bbox[3]
+	if c.MinLng < -180 || c.MaxLng > 180 || c.MinLat < -90 || c.MaxLat > 90 {
+		return nil, fmt.Errorf("bbox out of range")
+	}
+	if c.MinLng >= c.MaxLng || c.MinLat >= c.MaxLat {
+		return nil, fmt.Errorf("bbox minimum must be less than maximum")
+	}
+	cell, err := strconv.ParseFloat(q.Get("cell"), 64)
+	if err != nil || !(cell >= 0.0001 && cell <= 10) {
+		return nil, fmt.Errorf("cell must be between 0.0001 and 10 degrees")
+	}
+	c.Cell = cell
+	if n := math.Ceil((c.MaxLng-c.MinLng)/c.Cell) * math.Ceil((c.MaxLat-c.MinLat)/c.Cell); n > websiteFacilityClusterMaxCells {
+		return nil, fmt.Errorf("too many cells (%.0f > %d), use a larger cell size or a smaller bbox", n, websiteFacilityClusterMaxCells)
+	}
+	return &c, nil
+}
+
+// String returns the canonical form of the clustering parameters.
+func (c websiteFacilityCluster) String() string {
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return "bbox=" + f(c.MinLng) + "," + f(c.MinLat) + "," + f(c.MaxLng) + "," + f(c.MaxLat) + "&cell=" + f(c.Cell)
+}
+
+// encode clusters and encodes the facilities in data.
+func (c websiteFacilityCluster) encode(data ottrecidx.DataRef) ([]byte, error) {
+	items := []websiteFacilityClusterItem{}
+	for _, cl := range data.ClusterFacilities(c.MinLng, c.MinLat, c.MaxLng, c.MaxLat, c.Cell) {
+		item := websiteFacilityClusterItem{
+			Lng:   cl.Lng,
+			Lat:   cl.Lat,
+			Count: len(cl.Facilities),
+		}
+		if len(cl.Facilities) == 1 {
+			item.Key = cl.Facilities[0].Key()
+			item.Name = cl.Facilities[0].GetName()
+		}
+		items = append(items, item)
+	}
+	buf, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, '\n'), nil
+}
+
+// websiteEventsKeepalive is how often a comment is sent on idle event streams
+// so proxies don't close them.
+const websiteEventsKeepalive = time.Second * 30
+
+// websiteEventsHandler streams server-sent events with the current data hash.
+// The first event contains the hash of the data when the client connected (or
+// is skipped if it matches Last-Event-ID), and each subsequent event means the
+// data has changed.
+type websiteEventsHandler struct {
+	websiteHandlerBase
+	Updated func() <-chan struct{}
+
+	sem chan struct{}
+}
+
+func (h *websiteEventsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case h.sem <- struct{}{}:
+		defer func() { <-h.sem }()
+	default:
+		w.Header().Set("Retry-After", "60")
+		httpError(w, r, "too many subscribers", http.StatusServiceUnavailable)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{}) // best-effort
+
+	d := w.Header()
+	d.Set("Cache-Control", "no-store")
+	d.Set("Content-Type", "text/event-stream")
+	d.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		slog.Warn("website: cannot stream events", "error", err)
+		return
+	}
+
+	keepalive := time.NewTicker(websiteEventsKeepalive)
+	defer keepalive.Stop()
+
+	last := r.Header.Get("Last-Event-ID")
+	for {
+		// get the channel before checking so we don't miss an update
+		updated := h.Updated()
+
+		if data, ok := h.Data(); ok {
+			if hash := data.Index().Hash(); hash != last {
+				if _, err := io.WriteString(w, "event: data\nid: "+hash+"\ndata: "+hash+"\n\n"); err != nil {
+					return
+				}
+				if err := rc.Flush(); err != nil {
+					return
+				}
+				last = hash
+			}
+		}
+
+		select {
+		case <-updated:
+		case <-keepalive.C:
+			if _, err := io.WriteString(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -3,20 +3,26 @@ package static
 
 import (
 	"bytes"
+	"cmp"
 	"crypto/sha1"
 	"embed"
 	"encoding/base32"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/andybalholm/brotli"
 	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
 	"github.com/klauspost/compress/zstd"
 	"github.com/pgaskin/ottrec-website/internal/httpx"
 	"github.com/pgaskin/ottrec-website/internal/postcss"
@@ -59,11 +65,93 @@ var (
 	)
 )
 
-// Handler compresses all files not already compressed and returns a handler to
-// be served under [Base].
+// DefaultEncodings is the default list of content encodings offered in
+// addition to identity, in order of preference.
+var DefaultEncodings = []string{"gzip", "zstd"}
+
+// Options configures a static file handler.
+type Options struct {
+	// Encodings is the list of content encodings (br, deflate, gzip, or zstd)
+	// to offer in addition to identity, which is always used as the fallback.
+	// Where the client does not have a preference, earlier encodings are
+	// preferred. If nil, DefaultEncodings is used.
+	Encodings []string
+
+	// Lazy, if true, compresses files on first request rather than up front,
+	// keeping at most LazyCacheSize (or DefaultLazyCacheSize if zero)
+	// compressed files in memory.
+	Lazy          bool
+	LazyCacheSize int
+}
+
+// Validate checks that the options are supported.
+func (opt Options) Validate() error {
+	for _, encoding := range opt.Encodings {
+		switch encoding {
+		case "br", "deflate", "gzip", "zstd":
+		default:
+			return fmt.Errorf("unsupported encoding %q", encoding)
+		}
+	}
+	if opt.LazyCacheSize < 0 {
+		return fmt.Errorf("invalid lazy cache size %d", opt.LazyCacheSize)
+	}
+	return nil
+}
+
+// DefaultLazyCacheSize is the default maximum number of lazily compressed files
+// to keep.
+const DefaultLazyCacheSize = 32
+
+// Handler is like [HandlerWithOptions], but with the default options.
 func Handler(g *group) http.Handler {
-	g.compress()
-	return http.HandlerFunc(g.serveHTTP)
+	return HandlerWithOptions(g, Options{})
+}
+
+// HandlerWithOptions compresses all files not already compressed and returns a
+// handler to be served under [Base].
+func HandlerWithOptions(g *group, opt Options) http.Handler {
+	encodings := opt.Encodings
+	if encodings == nil {
+		encodings = DefaultEncodings
+	}
+	if err := (Options{Encodings: encodings}).Validate(); err != nil {
+		panic("static: " + err.Error())
+	}
+	offers := []string{""}
+	for _, encoding := range encodings {
+		if !slices.Contains(offers, encoding) {
+			offers = append(offers, encoding)
+		}
+	}
+	if opt.Lazy {
+		lc := &lazyCache{max: cmp.Or(opt.LazyCacheSize, DefaultLazyCacheSize)}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			g.serveHTTP(w, r, offers, lc.get)
+		})
+	}
+	g.compress(offers[1:])
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.serveHTTP(w, r, offers, (*file).get)
+	})
+}
+
+// WriteDir writes the files in the group to dir as they would be served under
+// [Base] (i.e., dir/static/HASHNAME).
+func WriteDir(g *group, dir string) error {
+	for name, f := range g.files {
+		if name != f.HashName {
+			continue // also in the map by the original name
+		}
+		p := filepath.Join(dir, filepath.FromSlash(strings.TrimPrefix(Path(f), "/")))
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			return err
+		}
+		if err := os.WriteFile(p, f.get(""), 0666); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Path returns the path to a file.
@@ -75,30 +163,49 @@ func Path(f *file) string {
 var res embed.FS
 
 type file struct {
-	Name         string
-	HashName     string
-	ContentType  string
-	Hash         string
-	Encodings    []string
-	Raw          [][]byte
-	prepare      func() ([]byte, error)
-	compressOnce sync.Once
+	Name        string
+	HashName    string
+	ContentType string
+	Hash        string
+	Compressed  bool     // already compressed, so only serve it as identity
+	Encodings   []string // guarded by mu
+	Raw         [][]byte // guarded by mu
+	prepare     func() ([]byte, error)
+	mu          sync.RWMutex
 }
 
-func (f *file) compress() {
-	f.compressOnce.Do(func() {
-		slog.Info("static: compressing asset", "name", f.Name, "hash_name", f.HashName)
-		gzipped, err := gzipBytes(f.Raw[0])
-		if err != nil {
-			panic(fmt.Errorf("gzip %q: %w", f.Name, err))
+// compress adds the specified encodings if not already present.
+func (f *file) compress(encodings []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.Compressed {
+		return
+	}
+	for _, encoding := range encodings {
+		if slices.Contains(f.Encodings, encoding) {
+			continue
 		}
-		zstdded, err := zstdBytes(f.Raw[0])
+		slog.Info("static: compressing asset", "name", f.Name, "hash_name", f.HashName, "encoding", encoding)
+		buf, err := encodeBytes(encoding, f.Raw[0])
 		if err != nil {
-			panic(fmt.Errorf("zstd %q: %w", f.Name, err))
+			panic(fmt.Errorf("%s %q: %w", encoding, f.Name, err))
 		}
-		f.Encodings = append(f.Encodings, "gzip", "zstd")
-		f.Raw = append(f.Raw, gzipped, zstdded)
-	})
+		f.Encodings = append(f.Encodings, encoding)
+		f.Raw = append(f.Raw, buf)
+	}
+}
+
+// get gets the file content for the specified encoding, returning nil if it
+// isn't available.
+func (f *file) get(encoding string) []byte {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	if i := slices.Index(f.Encodings, encoding); i != -1 {
+		return f.Raw[i]
+	}
+	return nil
 }
 
 var cache = map[string]*file{}
@@ -118,6 +225,9 @@ func newFile(name string) *file {
 		if !strings.Contains(name, "/") {
 			switch ext {
 			case ".css":
+				if postcss.Noop() {
+					slog.Warn("static: postcss is disabled by DEBUG_POSTCSS_NOOP, css will not be transformed", "name", name)
+				}
 				css, err := postcss.Transform(string(buf), "defaults, safari > 15, chrome > 110, firefox > 110")
 				if err != nil {
 					return nil, fmt.Errorf("compile css: %w", err)
@@ -149,6 +259,7 @@ func newFile(name string) *file {
 			HashName:    hashName,
 			ContentType: mimetype,
 			Hash:        hash,
+			Compressed:  isCompressedType(mimetype),
 			Encodings:   []string{""},
 			Raw:         [][]byte{buf},
 		}, nil
@@ -160,6 +271,17 @@ func newFile(name string) *file {
 	return v
 }
 
+// isCompressedType returns true if mimetype is already compressed, so there's
+// no point in compressing it again.
+func isCompressedType(mimetype string) bool {
+	mimetype, _, _ = strings.Cut(mimetype, ";")
+	switch mimetype {
+	case "font/woff2", "application/zip":
+		return true
+	}
+	return false
+}
+
 func getFile(name string) *file {
 	f, ok := cache[name]
 	if !ok {
@@ -170,7 +292,6 @@ func getFile(name string) *file {
 
 type group struct {
 	name  string
-	load  sync.Once
 	files map[string]*file
 }
 
@@ -186,16 +307,15 @@ func newGroup(name string, f ...*file) *group {
 	return g
 }
 
-// Compress compresses all files not already compressed.
-func (g *group) compress() {
-	g.load.Do(func() {
-		for _, f := range g.files {
-			f.compress()
-		}
-	})
+// compress compresses all files with the specified encodings if not already
+// compressed.
+func (g *group) compress(encodings []string) {
+	for _, f := range g.files {
+		f.compress(encodings)
+	}
 }
 
-func (g *group) serveHTTP(w http.ResponseWriter, r *http.Request) {
+func (g *group) serveHTTP(w http.ResponseWriter, r *http.Request, offers []string, get func(f *file, encoding string) []byte) {
 	if r.Method != http.MethodGet && r.Method != http.MethodHead {
 		w.Header().Set("Allow", "GET, HEAD")
 		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
@@ -229,11 +349,17 @@ func (g *group) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// negotiate the content encoding
-	encoding := httpx.NegotiateContent(r.Header.Values("Accept-Encoding"), file.Encodings)
+	if file.Compressed {
+		offers = offers[:1] // identity
+	}
+	encoding := httpx.NegotiateContent(r.Header.Values("Accept-Encoding"), offers)
 	if encoding != "" {
 		w.Header().Set("Content-Encoding", encoding)
 	}
-	buf := file.Raw[slices.Index(file.Encodings, encoding)]
+	buf := get(file, encoding)
+	if buf == nil {
+		panic("wtf: file not compressed with negotiated encoding")
+	}
 
 	// set the mimetype
 	if file.ContentType != "" {
@@ -255,22 +381,106 @@ func (g *group) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	etag.WriteString(`"`)
 	w.Header().Set("ETag", etag.String())
 
-	// check etag match
-	if slices.Contains(r.Header.Values("If-None-Match"), etag.String()) {
-		w.WriteHeader(http.StatusNotModified)
-		return
+	// serve the content, handling etag matches and ranges (note: ranges apply
+	// to the encoded content, and since the etag is weak, If-Range will always
+	// result in the full content being served)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf))
+}
+
+// lazyCache is a lru cache of compressed files.
+type lazyCache struct {
+	max     int
+	mu      sync.Mutex
+	entries []*lazyEntry // most recently used last
+}
+
+type lazyEntry struct {
+	file     *file
+	encoding string
+	buf      []byte
+}
+
+// get gets the file content for the specified encoding, compressing and caching
+// it if required. It panics if compression fails.
+func (lc *lazyCache) get(f *file, encoding string) []byte {
+	if buf := f.get(encoding); buf != nil {
+		return buf // already compressed up front, or identity
 	}
 
-	// no body for head request
-	if r.Method == http.MethodHead {
-		w.WriteHeader(http.StatusOK)
-		return
+	lc.mu.Lock()
+	for i, e := range lc.entries {
+		if e.file == f && e.encoding == encoding {
+			lc.entries = append(slices.Delete(lc.entries, i, i+1), e)
+			lc.mu.Unlock()
+			return e.buf
+		}
 	}
+	lc.mu.Unlock()
 
-	// serve the content
-	w.Header().Set("Content-Length", strconv.Itoa(len(buf)))
-	w.WriteHeader(http.StatusOK)
-	w.Write(buf)
+	// compress it outside the lock since it may take a while (it's fine if
+	// we end up doing it more than once concurrently)
+	slog.Info("static: lazily compressing asset", "name", f.Name, "hash_name", f.HashName, "encoding", encoding)
+	buf, err := encodeBytes(encoding, f.get(""))
+	if err != nil {
+		panic(fmt.Errorf("%s %q: %w", encoding, f.Name, err))
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+	lc.entries = slices.DeleteFunc(lc.entries, func(e *lazyEntry) bool {
+		return e.file == f && e.encoding == encoding
+	})
+	if n := len(lc.entries) - lc.max + 1; n > 0 {
+		lc.entries = slices.Delete(lc.entries, 0, n)
+	}
+	lc.entries = append(lc.entries, &lazyEntry{
+		file:     f,
+		encoding: encoding,
+		buf:      buf,
+	})
+	return buf
+}
+
+func encodeBytes(encoding string, b []byte) ([]byte, error) {
+	switch encoding {
+	case "br":
+		return brotliBytes(b)
+	case "deflate":
+		return deflateBytes(b)
+	case "gzip":
+		return gzipBytes(b)
+	case "zstd":
+		return zstdBytes(b)
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+}
+
+func brotliBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := brotli.NewWriterLevel(&buf, brotli.BestCompression)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func deflateBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := zlib.NewWriterLevel(&buf, zlib.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 func gzipBytes(b []byte) ([]byte, error) {
@@ -0,0 +1,195 @@
+package static
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/klauspost/compress/zlib"
+)
+
+func TestRange(t *testing.T) {
+	h := Handler(Data)
+
+	for _, encoding := range []string{"", "gzip", "zstd"} {
+		t.Run("Encoding="+encoding, func(t *testing.T) {
+			raw := DataCSS.Raw[slices.Index(DataCSS.Encodings, encoding)]
+			if len(raw) < 20 {
+				t.Fatalf("file too short")
+			}
+
+			req := httptest.NewRequest(http.MethodGet, Path(DataCSS), nil)
+			if encoding != "" {
+				req.Header.Set("Accept-Encoding", encoding)
+			}
+			req.Header.Set("Range", "bytes=5-14")
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusPartialContent {
+				t.Fatalf("expected status %d, got %d", http.StatusPartialContent, rec.Code)
+			}
+			if v := rec.Header().Get("Content-Encoding"); v != encoding {
+				t.Errorf("expected content encoding %q, got %q", encoding, v)
+			}
+			if v, exp := rec.Header().Get("Content-Range"), "bytes 5-14/"+strconv.Itoa(len(raw)); v != exp {
+				t.Errorf("expected content range %q, got %q", exp, v)
+			}
+			if v := rec.Header().Get("Accept-Ranges"); v != "bytes" {
+				t.Errorf("expected accept-ranges bytes, got %q", v)
+			}
+			if !bytes.Equal(rec.Body.Bytes(), raw[5:15]) {
+				t.Errorf("incorrect range content")
+			}
+		})
+	}
+
+	t.Run("Unsatisfiable", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, Path(DataCSS), nil)
+		req.Header.Set("Range", "bytes="+strconv.Itoa(len(DataCSS.Raw[0])+10)+"-")
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusRequestedRangeNotSatisfiable {
+			t.Fatalf("expected status %d, got %d", http.StatusRequestedRangeNotSatisfiable, rec.Code)
+		}
+		if v, exp := rec.Header().Get("Content-Range"), "bytes */"+strconv.Itoa(len(DataCSS.Raw[0])); v != exp {
+			t.Errorf("expected content range %q, got %q", exp, v)
+		}
+	})
+
+	t.Run("NotModified", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, Path(DataCSS), nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		etag := rec.Header().Get("ETag")
+		if etag == "" {
+			t.Fatalf("missing etag")
+		}
+
+		req = httptest.NewRequest(http.MethodGet, Path(DataCSS), nil)
+		req.Header.Set("If-None-Match", etag)
+		req.Header.Set("Range", "bytes=0-9")
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusNotModified {
+			t.Fatalf("expected status %d, got %d", http.StatusNotModified, rec.Code)
+		}
+	})
+}
+
+func TestEncodings(t *testing.T) {
+	h := HandlerWithOptions(Data, Options{
+		Encodings: []string{"br", "gzip"},
+	})
+	for accept, exp := range map[string]string{
+		"":                     "",
+		"identity":             "",
+		"gzip":                 "gzip",
+		"br, gzip":             "br",
+		"gzip, br":             "br",
+		"gzip;q=1, br;q=0.5":   "gzip",
+		"zstd":                 "",
+		"deflate, br;q=0.1":    "br",
+		"*":                    "",
+		"identity;q=0, gzip":   "gzip",
+		"identity;q=0.5, zstd": "",
+	} {
+		req := httptest.NewRequest(http.MethodGet, Path(DataCSS), nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("accept %q: expected status %d, got %d", accept, http.StatusOK, rec.Code)
+			continue
+		}
+		if v := rec.Header().Get("Content-Encoding"); v != exp {
+			t.Errorf("accept %q: expected encoding %q, got %q", accept, exp, v)
+		}
+		if exp != "" && !bytes.Equal(rec.Body.Bytes(), DataCSS.get(exp)) {
+			t.Errorf("accept %q: incorrect content", accept)
+		}
+	}
+}
+
+func TestCompressed(t *testing.T) {
+	h := Handler(Data)
+	if !SourceSans3WOFF2.Compressed {
+		t.Fatalf("expected woff2 to be detected as compressed")
+	}
+	if DataCSS.Compressed {
+		t.Fatalf("expected css to not be detected as compressed")
+	}
+	if v := SourceSans3WOFF2.Encodings; !slices.Equal(v, []string{""}) {
+		t.Errorf("expected woff2 to only have the identity encoding, got %q", v)
+	}
+	req := httptest.NewRequest(http.MethodGet, Path(SourceSans3WOFF2), nil)
+	req.Header.Set("Accept-Encoding", "gzip, zstd")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+	if v := rec.Header().Get("Content-Encoding"); v != "" {
+		t.Errorf("expected no content encoding, got %q", v)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), SourceSans3WOFF2.get("")) {
+		t.Errorf("incorrect content")
+	}
+}
+
+func TestLazy(t *testing.T) {
+	h := HandlerWithOptions(Data, Options{
+		Encodings: []string{"deflate"},
+		Lazy:      true,
+	})
+	if DataCSS.get("deflate") != nil {
+		t.Fatalf("file should not have been compressed up front")
+	}
+	for range 2 {
+		req := httptest.NewRequest(http.MethodGet, Path(DataCSS), nil)
+		req.Header.Set("Accept-Encoding", "deflate")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if v := rec.Header().Get("Content-Encoding"); v != "deflate" {
+			t.Fatalf("expected encoding deflate, got %q", v)
+		}
+		zr, err := zlib.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		buf, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if !bytes.Equal(buf, DataCSS.get("")) {
+			t.Errorf("incorrect content")
+		}
+	}
+
+	lc := &lazyCache{max: 2}
+	for _, f := range []*file{DataCSS, SourceSans3WOFF2, SourceSerif4WOFF2, DataCSS} {
+		if buf := lc.get(f, "deflate"); len(buf) == 0 {
+			t.Fatalf("empty content")
+		}
+	}
+	if len(lc.entries) != 2 {
+		t.Fatalf("expected 2 cached entries, got %d", len(lc.entries))
+	}
+	if lc.entries[0].file != SourceSerif4WOFF2 || lc.entries[1].file != DataCSS {
+		t.Errorf("incorrect lru order")
+	}
+}
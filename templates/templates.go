@@ -18,6 +18,7 @@ import (
 	"github.com/a-h/templ"
 	"github.com/klauspost/compress/zstd"
 	"github.com/pgaskin/ottrec-website/internal/httpx"
+	"golang.org/x/text/language"
 )
 
 //go:generate go tool templ fmt .
@@ -27,13 +28,35 @@ import (
 
 type ErrorPageFunc func(title, message string) templ.Component
 
-// Render renders a page, checking and setting ETag according to the
-// binary+etagMixin+url+vary. It should be called after normalizing the URL,
-// setting the Vary header to at least include Accept-Encoding (this isn't done
-// in Render since it's supposed to be set the same for all responses for the
-// method+path), setting Cache-Control (if you don't want the default of
-// "public"), and performing any required redirects.
-func Render(w http.ResponseWriter, r *http.Request, errp ErrorPageFunc, etagMixin string, fn func() (c templ.Component, status int, err error)) error {
+// Languages contains the languages pages can be rendered in. The first one is
+// the default.
+var Languages = []language.Tag{
+	language.English,
+	// TODO: language.CanadianFrench once we have translations
+}
+
+var languageMatcher = language.NewMatcher(Languages)
+
+// NegotiateLanguage returns the best language in [Languages] for the request.
+// If there is more than one language, Accept-Language is added to Vary, so
+// this must be called before Render.
+func NegotiateLanguage(w http.ResponseWriter, r *http.Request) language.Tag {
+	if len(Languages) == 1 {
+		return Languages[0]
+	}
+	w.Header().Add("Vary", "Accept-Language")
+	tags, _, _ := language.ParseAcceptLanguage(strings.Join(r.Header.Values("Accept-Language"), ","))
+	_, i, _ := languageMatcher.Match(tags...)
+	return Languages[i]
+}
+
+// Render renders a page in lang (see [NegotiateLanguage]), checking and setting
+// ETag according to the binary+etagMixin+lang+url+vary. It should be called
+// after normalizing the URL, setting the Vary header to at least include
+// Accept-Encoding (this isn't done in Render since it's supposed to be set the
+// same for all responses for the method+path), setting Cache-Control (if you
+// don't want the default of "public"), and performing any required redirects.
+func Render(w http.ResponseWriter, r *http.Request, errp ErrorPageFunc, lang language.Tag, etagMixin string, fn func() (c templ.Component, status int, err error)) error {
 	ctx := r.Context()
 
 	// we support content encoding negotation
@@ -41,8 +64,9 @@ func Render(w http.ResponseWriter, r *http.Request, errp ErrorPageFunc, etagMixi
 		panic("vary must include accept-encoding")
 	}
 
-	// set the mimetype
+	// set the mimetype and language
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang.String())
 
 	// negotiate content encoding
 	encoding := httpx.NegotiateContent(r.Header.Values("Accept-Encoding"), []string{"", "gzip", "zstd"})
@@ -50,11 +74,13 @@ func Render(w http.ResponseWriter, r *http.Request, errp ErrorPageFunc, etagMixi
 		w.Header().Set("Content-Encoding", encoding)
 	}
 
-	// compute the etag from the server hash, data hash, vary header, and content encoding
+	// compute the etag from the server hash, data hash, language, vary header, and content encoding
 	var etag strings.Builder
 	etag.WriteString(exehash)
 	etag.WriteString(etagMixin)
 	etag.WriteByte(0)
+	etag.WriteString(lang.String())
+	etag.WriteByte(0)
 	etag.WriteString(r.URL.String())
 	for _, k := range w.Header().Values("Vary") {
 		etag.WriteByte(0)
@@ -76,7 +102,7 @@ func Render(w http.ResponseWriter, r *http.Request, errp ErrorPageFunc, etagMixi
 	w.Header().Set("ETag", etag.String())
 
 	// if a caching policy isn't already set, allow it to be cached with revalidation
-	if w.Header().Get("Cache-Control") != "" {
+	if w.Header().Get("Cache-Control") == "" {
 		w.Header().Set("Cache-Control", "public")
 	}
 
@@ -214,8 +240,3 @@ var exehash = func() string {
 	sum := sha1.Sum(buf)
 	return base32.StdEncoding.EncodeToString(sum[:])
 }()
-
-func cutBefore(s, sep string) string {
-	before, _, _ := strings.Cut(s, sep)
-	return before
-}
@@ -0,0 +1,88 @@
+package templates
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pgaskin/ottrec-website/pkg/ottrecidx"
+	"golang.org/x/text/language"
+)
+
+// langAttr returns the lang attribute for tag, defaulting to the first one in
+// [Languages].
+func langAttr(tag language.Tag) string {
+	if tag == language.Und {
+		tag = Languages[0]
+	}
+	return tag.String()
+}
+
+func cutBefore(s, sep string) string {
+	before, _, _ := strings.Cut(s, sep)
+	return before
+}
+
+// prettyWeekday returns the short label for a weekday (e.g., Mon).
+func prettyWeekday(wd time.Weekday) string {
+	return wd.String()[:3]
+}
+
+// prettyDateRange formats a date range in [ottrecidx.TZ] (e.g., Sep 3–Oct 4,
+// from Sep 3, until Oct 4). Either end may be zero for an open-ended range. The
+// year is only included if the range isn't within the current year.
+func prettyDateRange(from, to time.Time) string {
+	if !from.IsZero() {
+		from = from.In(ottrecidx.TZ)
+	}
+	if !to.IsZero() {
+		to = to.In(ottrecidx.TZ)
+	}
+	layout := "Jan 2"
+	if year := time.Now().In(ottrecidx.TZ).Year(); (!from.IsZero() && from.Year() != year) || (!to.IsZero() && to.Year() != year) {
+		layout = "Jan 2, 2006"
+	}
+	switch {
+	case from.IsZero() && to.IsZero():
+		return ""
+	case from.IsZero():
+		return "until " + to.Format(layout)
+	case to.IsZero():
+		return "from " + from.Format(layout)
+	}
+	if a, b := from.Format(layout), to.Format(layout); a == b {
+		return a
+	}
+	return from.Format(layout) + "–" + to.Format(layout)
+}
+
+// prettyTimes formats times with their weekday and range (e.g., Mon 7:00 -
+// 9:00am, Tue 6:00 - 8:00pm), using the original label for times which couldn't
+// be parsed.
+func prettyTimes(seq ottrecidx.TimeSeq) string {
+	var parts []string
+	for tm := range seq {
+		wd, ok1 := tm.GetWeekday()
+		r, ok2 := tm.GetRange()
+		if !ok1 || !ok2 || !r.IsValid() {
+			parts = append(parts, tm.GetLabel())
+			continue
+		}
+		parts = append(parts, prettyWeekday(wd)+" "+r.Format(true))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// prettyBytes formats a byte count with a binary unit.
+func prettyBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10) + " B"
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + " " + string("KMGTPE"[exp]) + "iB"
+}
@@ -0,0 +1,98 @@
+package templates
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pgaskin/ottrec-website/pkg/ottrecidx"
+	"github.com/pgaskin/ottrec/schema"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestPrettyWeekday(t *testing.T) {
+	for wd, exp := range []string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"} {
+		if act := prettyWeekday(time.Weekday(wd)); act != exp {
+			t.Errorf("%s: expected %q, got %q", time.Weekday(wd), exp, act)
+		}
+	}
+}
+
+func TestPrettyDateRange(t *testing.T) {
+	year := time.Now().In(ottrecidx.TZ).Year()
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 12, 0, 0, 0, ottrecidx.TZ)
+	}
+	next := strconv.Itoa(year + 1)
+	for _, tc := range []struct {
+		name     string
+		from, to time.Time
+		exp      string
+	}{
+		{"empty", time.Time{}, time.Time{}, ""},
+		{"from", date(year, time.September, 3), time.Time{}, "from Sep 3"},
+		{"until", time.Time{}, date(year, time.October, 4), "until Oct 4"},
+		{"range", date(year, time.September, 3), date(year, time.October, 4), "Sep 3–Oct 4"},
+		{"same day", date(year, time.September, 3), date(year, time.September, 3).Add(time.Hour), "Sep 3"},
+		{"cross year", date(year, time.December, 20), date(year+1, time.January, 5), "Dec 20, " + strconv.Itoa(year) + "–Jan 5, " + next},
+		{"other year from", date(year+1, time.January, 5), time.Time{}, "from Jan 5, " + next},
+		{"other year until", time.Time{}, date(year+1, time.January, 5), "until Jan 5, " + next},
+		{"other year same day", date(year+1, time.January, 5), date(year+1, time.January, 5), "Jan 5, " + next},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if act := prettyDateRange(tc.from, tc.to); act != tc.exp {
+				t.Errorf("expected %q, got %q", tc.exp, act)
+			}
+		})
+	}
+}
+
+func TestPrettyTimes(t *testing.T) {
+	tm := func(label string, w time.Weekday, hh1, hh2 int) *schema.TimeRange {
+		return schema.TimeRange_builder{
+			Label:  label,
+			XStart: proto.Int32(int32(schema.MakeClockTime(hh1, 0))),
+			XEnd:   proto.Int32(int32(schema.MakeClockTime(hh2, 0))),
+			XWkday: schema.Weekday(w).Enum(),
+		}.Build()
+	}
+	pb, err := proto.Marshal(schema.Data_builder{
+		Facilities: []*schema.Facility{
+			schema.Facility_builder{
+				Name: "A",
+				ScheduleGroups: []*schema.ScheduleGroup{
+					schema.ScheduleGroup_builder{
+						Schedules: []*schema.Schedule{
+							schema.Schedule_builder{
+								Days: []string{"Monday", "Tuesday"},
+								Activities: []*schema.Schedule_Activity{
+									schema.Schedule_Activity_builder{
+										XName: "lane swim",
+										Days: []*schema.Schedule_ActivityDay{
+											schema.Schedule_ActivityDay_builder{
+												Times: []*schema.TimeRange{tm("7 - 9 am", time.Monday, 7, 9), tm("6 - 8 pm", time.Monday, 18, 20)},
+											}.Build(),
+											schema.Schedule_ActivityDay_builder{
+												Times: []*schema.TimeRange{schema.TimeRange_builder{Label: "all day"}.Build()},
+											}.Build(),
+										},
+									}.Build(),
+								},
+							}.Build(),
+						},
+					}.Build(),
+				},
+			}.Build(),
+		},
+	}.Build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := new(ottrecidx.Indexer).Load(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if act, exp := prettyTimes(idx.Data().Times()), "Mon 7:00 - 9:00am, Mon 6:00 - 8:00pm, all day"; act != exp {
+		t.Errorf("expected %q, got %q", exp, act)
+	}
+}